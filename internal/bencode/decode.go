@@ -70,14 +70,62 @@ func decodeString(r io.Reader, firstByte byte) (any, error) {
 	if err != nil {
 		return "", fmt.Errorf("invalid string length: %w", err)
 	}
+	if length < 0 {
+		return "", fmt.Errorf("invalid string length: %d", length)
+	}
+	if left := remaining(r); left >= 0 && length > left {
+		return "", fmt.Errorf("string length %d exceeds the %d bytes of input left", length, left)
+	}
 
-	str := make([]byte, length)
-	_, err = io.ReadFull(r, str)
+	// Copied instead of allocated up front so a length the input can not back costs no more than the input
+	str := &bytes.Buffer{}
+	n, err := io.CopyN(str, r, int64(length))
 	if err != nil {
-		return "", fmt.Errorf("error reading string with parsed length: %w", err)
+		return "", fmt.Errorf("error reading string with parsed length: read %d of %d bytes: %w", n, length, err)
 	}
 
-	return string(str), nil
+	return str.String(), nil
+}
+
+// peekedReader puts a byte read ahead of a list item or dictionary key back in front of the rest of the input
+type peekedReader struct {
+	peeked []byte
+	r      io.Reader
+}
+
+func (p *peekedReader) Read(b []byte) (int, error) {
+	if len(p.peeked) > 0 {
+		n := copy(b, p.peeked)
+		p.peeked = p.peeked[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
+
+// pushBack returns r with b in front of it, a reader that already had its peeked bytes consumed is reused so
+// long lists and dictionaries do not nest one reader per item
+func pushBack(r io.Reader, b []byte) io.Reader {
+	if p, ok := r.(*peekedReader); ok && len(p.peeked) == 0 {
+		p.peeked = b
+		return p
+	}
+	return &peekedReader{peeked: b, r: r}
+}
+
+// remaining returns how many bytes of input r has left, or -1 when the reader can not tell
+func remaining(r io.Reader) int {
+	switch v := r.(type) {
+	case *peekedReader:
+		left := remaining(v.r)
+		if left < 0 {
+			return -1
+		}
+		return len(v.peeked) + left
+	case interface{ Len() int }:
+		return v.Len()
+	default:
+		return -1
+	}
 }
 
 func decodeList(r io.Reader) (any, error) {
@@ -92,7 +140,7 @@ func decodeList(r io.Reader) (any, error) {
 		if b[0] == 'e' {
 			break
 		}
-		r = io.MultiReader(bytes.NewReader(b), r)
+		r = pushBack(r, b)
 		val, err := Decode(r)
 		if err != nil {
 			return nil, fmt.Errorf("error reading list item: %w", err)
@@ -116,7 +164,7 @@ func decodeDict(r io.Reader) (map[string]any, error) {
 			break
 		}
 
-		r = io.MultiReader(bytes.NewReader(b), r)
+		r = pushBack(r, b)
 
 		key, err := Decode(r)
 		if err != nil {
@@ -128,6 +176,11 @@ func decodeDict(r io.Reader) (map[string]any, error) {
 			return nil, fmt.Errorf("expected string key, got %T", key)
 		}
 
+		// A duplicate key would leave it open which of the values counts
+		if _, ok := result[keyStr]; ok {
+			return nil, fmt.Errorf("duplicate dictionary key %q", keyStr)
+		}
+
 		val, err := Decode(r)
 		if err != nil {
 			return nil, fmt.Errorf("error reading dictionary value: %w", err)
@@ -138,3 +191,55 @@ func decodeDict(r io.Reader) (map[string]any, error) {
 
 	return result, nil
 }
+
+// RawValue returns the value stored under key in the dictionary data holds, as the exact bytes it has in data so
+// hashing it does not depend on how the dictionary would be encoded again. Duplicate keys are rejected like Decode
+// does, so the value is always the one Decode sees
+func RawValue(data []byte, key string) ([]byte, error) {
+	r := bytes.NewReader(data)
+	prefix, err := r.ReadByte()
+	if err != nil {
+		return nil, fmt.Errorf("error reading bencode prefix: %w", err)
+	}
+	if prefix != 'd' {
+		return nil, fmt.Errorf("expected a dictionary, got prefix %q", prefix)
+	}
+
+	var value []byte
+	seen := make(map[string]bool)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("error reading dictionary key prefix: %w", err)
+		}
+		if b == 'e' {
+			if value == nil {
+				return nil, fmt.Errorf("key %q not found in dictionary", key)
+			}
+			return value, nil
+		}
+		r.UnreadByte()
+
+		k, err := Decode(r)
+		if err != nil {
+			return nil, fmt.Errorf("error reading dictionary key: %w", err)
+		}
+		keyStr, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected string key, got %T", k)
+		}
+		if seen[keyStr] {
+			return nil, fmt.Errorf("duplicate dictionary key %q", keyStr)
+		}
+		seen[keyStr] = true
+
+		// Decode reads no further than the end of the value, so the reader position marks where it starts and ends
+		start := len(data) - r.Len()
+		if _, err := Decode(r); err != nil {
+			return nil, fmt.Errorf("error reading dictionary value: %w", err)
+		}
+		if keyStr == key {
+			value = data[start : len(data)-r.Len()]
+		}
+	}
+}
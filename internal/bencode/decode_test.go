@@ -2,6 +2,8 @@ package bencode
 
 import (
 	"bytes"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -126,7 +128,8 @@ func TestDecodeDict(t *testing.T) {
 		{"d4:bull3:cow3:cow3:mooe", map[string]any{"bull": "cow", "cow": "moo"}, false},
 		{"de", map[string]any{}, false}, // Empty dictionary
 		{"d3:cowi123ee", map[string]any{"cow": 123}, false},
-		{"d3:cow3:moo", nil, true}, // Incomplete dictionary
+		{"d3:cow3:moo", nil, true},        // Incomplete dictionary
+		{"d3:cowi1e3:cowi2ee", nil, true}, // Duplicate key
 	}
 
 	for _, test := range tests {
@@ -225,3 +228,65 @@ func TestDecode(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeStringLengthBounds(t *testing.T) {
+	tests := []string{
+		"-1:",                      // Negative length
+		"-1:abc",                   // Negative length with data after it
+		"4294967296:spam",          // Length far beyond the input
+		"l99999999999:spame",       // Length beyond the input inside a list
+		"d3:key9999999999999:xe",   // Length beyond the input as a dictionary value
+		"d9999999999999:key3:vale", // Length beyond the input as a dictionary key
+	}
+
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			if _, err := Decode(newReader(input)); err == nil {
+				t.Errorf("expected an error for input %s, but got none", input)
+			}
+		})
+	}
+}
+
+func TestDecodeStringLengthUnknownInput(t *testing.T) {
+	// A reader that can not report its length is still bounded by the bytes it actually delivers
+	reader := io.MultiReader(strings.NewReader("9999999999999:"), strings.NewReader("spam"))
+	if _, err := Decode(reader); err == nil {
+		t.Errorf("expected an error for a length beyond the input, but got none")
+	}
+}
+
+func TestRawValue(t *testing.T) {
+	tests := []struct {
+		input    string
+		key      string
+		expected string
+		hasError bool
+	}{
+		{"d4:infod4:name1:a6:lengthi1eee", "info", "d4:name1:a6:lengthi1ee", false}, // Unsorted keys are kept as they are
+		{"d8:announce3:url4:infoli1ei2eee", "info", "li1ei2ee", false},
+		{"d4:infoi-3e4:infoi4ee", "info", "", true},   // Duplicate key
+		{"d4:infoi1e1:xi1e1:xi2ee", "info", "", true}, // Duplicate key after the value
+		{"d3:cow3:mooe", "info", "", true},            // Missing key
+		{"li1ee", "info", "", true},                   // Not a dictionary
+		{"d4:infod4:name1:a", "info", "", true},       // Truncated value
+		{"d4:infoi1e1:x", "info", "", true},           // Truncated after the value
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			result, err := RawValue([]byte(test.input), test.key)
+			if test.hasError {
+				if err == nil {
+					t.Errorf("expected an error for input %s, but got none", test.input)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("unexpected error for input %s: %v", test.input, err)
+				} else if string(result) != test.expected {
+					t.Errorf("expected %s, got %s for input %s", test.expected, result, test.input)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,420 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	Alpha = 3 // Queries in flight during a lookup
+
+	DefaultPort = 6882 // Next to the peer port 6881, which uTP already uses over UDP
+
+	queryTimeout     = 5 * time.Second
+	maxLookupRounds  = 16
+	maxPacketSize    = 1500
+	refreshInterval  = 5 * time.Minute
+	secretRotation   = 5 * time.Minute  // Tokens stay valid for up to two rotations
+	peerExpiry       = 30 * time.Minute // Announced peers are forgotten unless they announce again
+	maxPeersPerReply = 50
+	minTableSize     = BucketSize // Below this many nodes the table is bootstrapped again
+)
+
+// DefaultBootstrapNodes are well known routers used to join the DHT
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// Config holds the settings of a DHT node
+type Config struct {
+	Addr           string   // UDP address to listen on, e.g. ":6881"
+	BootstrapNodes []string // host:port of nodes used to join the DHT when the routing table is empty
+	StatePath      string   // Where the node id and routing table are saved, nothing is saved when empty
+}
+
+// Node is a mainline DHT node (BEP 5), it answers queries from other nodes and looks up peers for infohashes
+type Node struct {
+	id     NodeID
+	conn   *net.UDPConn
+	table  *routingTable
+	config Config
+
+	mu           sync.Mutex
+	transactions map[string]chan *message
+	transaction  uint16
+	peers        map[NodeID]map[string]time.Time // Peers announced to us per infohash and when
+	secret       [IDLength]byte
+	oldSecret    [IDLength]byte
+}
+
+// New creates a node listening on the configured address, the node id and routing table are restored from the
+// state file when there is one
+func New(config Config) (*Node, error) {
+	id, saved, err := loadState(config.StatePath)
+	if err != nil {
+		log.Printf("Ignoring DHT state: %v", err)
+	}
+	if id == (NodeID{}) {
+		if id, err = RandomNodeID(); err != nil {
+			return nil, err
+		}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving DHT address %s: %w", config.Addr, err)
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for DHT on %s: %w", config.Addr, err)
+	}
+
+	n := &Node{
+		id:     id,
+		conn:   conn,
+		table:  newRoutingTable(id),
+		config: config,
+
+		transactions: make(map[string]chan *message),
+		peers:        make(map[NodeID]map[string]time.Time),
+	}
+	if _, err := rand.Read(n.secret[:]); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error generating token secret: %w", err)
+	}
+	n.oldSecret = n.secret
+
+	// Saved nodes start out with a failure so they are replaced soon unless they answer again
+	for _, saved := range saved {
+		n.table.seen(saved.id, saved.addr)
+		n.table.failed(saved.id)
+	}
+
+	return n, nil
+}
+
+// ID returns the id of the node
+func (n *Node) ID() NodeID {
+	return n.id
+}
+
+// Addr returns the UDP address the node listens on
+func (n *Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Run answers queries and keeps the routing table fresh until the context is done, the state is saved on the way out
+func (n *Node) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		n.conn.Close()
+	}()
+	go n.maintain(ctx)
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		size, addr, err := n.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil && !errors.Is(err, net.ErrClosed) {
+				log.Printf("DHT read failed: %v", err)
+				continue
+			}
+			break
+		}
+
+		msg, err := decodeMessage(buf[:size])
+		if err != nil {
+			continue
+		}
+		n.handle(msg, addr)
+	}
+
+	if err := n.saveState(); err != nil {
+		log.Printf("Failed to save DHT state: %v", err)
+	}
+}
+
+// maintain bootstraps the routing table, pings nodes we have not heard from and rotates the token secret
+func (n *Node) maintain(ctx context.Context) {
+	n.bootstrap(ctx)
+
+	refresh := time.NewTicker(refreshInterval)
+	defer refresh.Stop()
+	rotate := time.NewTicker(secretRotation)
+	defer rotate.Stop()
+
+	for {
+		select {
+		case <-refresh.C:
+			for _, stale := range n.table.questionable() {
+				go n.ping(ctx, stale.addr)
+			}
+			if n.table.size() < minTableSize {
+				n.bootstrap(ctx)
+			}
+			n.expirePeers()
+		case <-rotate.C:
+			n.mu.Lock()
+			n.oldSecret = n.secret
+			rand.Read(n.secret[:])
+			n.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// bootstrap joins the DHT by looking up our own id, starting from the bootstrap nodes when the table is empty
+func (n *Node) bootstrap(ctx context.Context) {
+	var seeds []*net.UDPAddr
+	for _, host := range n.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", host)
+		if err != nil {
+			log.Printf("Skipping DHT bootstrap node %s: %v", host, err)
+			continue
+		}
+		seeds = append(seeds, addr)
+	}
+
+	n.lookup(ctx, n.id, methodFindNode, seeds)
+	log.Printf("DHT bootstrapped with %d nodes in the routing table", n.table.size())
+}
+
+// ping checks that a node is alive, the routing table is updated with the outcome
+func (n *Node) ping(ctx context.Context, addr *net.UDPAddr) error {
+	_, err := n.query(ctx, addr, methodPing, map[string]any{_keyID: string(n.id[:])})
+	return err
+}
+
+// query sends a query and waits for its response, the responding node is added to the routing table
+func (n *Node) query(ctx context.Context, addr *net.UDPAddr, method string, args map[string]any) (*message, error) {
+	n.mu.Lock()
+	n.transaction++
+	transaction := string(binary.BigEndian.AppendUint16(nil, n.transaction))
+	responses := make(chan *message, 1)
+	n.transactions[transaction] = responses
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.transactions, transaction)
+		n.mu.Unlock()
+	}()
+
+	packet, err := encodeQuery(transaction, method, args)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := n.conn.WriteToUDP(packet, addr); err != nil {
+		return nil, fmt.Errorf("error sending %s to %s: %w", method, addr, err)
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-responses:
+		if msg.kind == typeError {
+			return nil, fmt.Errorf("%s to %s failed with error %d: %s", method, addr, msg.errCode, msg.errMessage)
+		}
+		id, err := msg.nodeID()
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s response from %s: %w", method, addr, err)
+		}
+		n.table.seen(id, addr)
+		return msg, nil
+	case <-timer.C:
+		if id, ok := n.nodeAt(addr); ok {
+			n.table.failed(id)
+		}
+		return nil, fmt.Errorf("%s to %s timed out", method, addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// nodeAt finds the id of the routing table node at an address
+func (n *Node) nodeAt(addr *net.UDPAddr) (NodeID, bool) {
+	n.table.mu.Lock()
+	defer n.table.mu.Unlock()
+
+	for _, bucket := range n.table.buckets {
+		for _, node := range bucket {
+			if node.addr.IP.Equal(addr.IP) && node.addr.Port == addr.Port {
+				return node.id, true
+			}
+		}
+	}
+
+	return NodeID{}, false
+}
+
+// handle dispatches a received message, responses go to the query waiting for them
+func (n *Node) handle(msg *message, addr *net.UDPAddr) {
+	if msg.kind != typeQuery {
+		n.mu.Lock()
+		responses, ok := n.transactions[msg.transaction]
+		n.mu.Unlock()
+		if ok {
+			select {
+			case responses <- msg:
+			default:
+			}
+		}
+		return
+	}
+
+	id, err := msg.nodeID()
+	if err != nil {
+		n.reply(addr, msg.transaction, nil, errorProtocol, err.Error())
+		return
+	}
+
+	var values map[string]any
+	var code int
+	var text string
+	switch msg.method {
+	case methodPing:
+		values = map[string]any{}
+	case methodFindNode:
+		values, code, text = n.handleFindNode(msg)
+	case methodGetPeers:
+		values, code, text = n.handleGetPeers(msg, addr)
+	case methodAnnouncePeer:
+		values, code, text = n.handleAnnouncePeer(msg, addr)
+	default:
+		code, text = errorMethod, "method unknown"
+	}
+
+	n.table.seen(id, addr)
+	n.reply(addr, msg.transaction, values, code, text)
+}
+
+// reply sends the response to a query, or an error when code is set
+func (n *Node) reply(addr *net.UDPAddr, transaction string, values map[string]any, code int, text string) {
+	var packet []byte
+	var err error
+	if code != 0 {
+		packet, err = encodeError(transaction, code, text)
+	} else {
+		values[_keyID] = string(n.id[:])
+		packet, err = encodeResponse(transaction, values)
+	}
+	if err != nil {
+		log.Printf("Failed to encode DHT reply: %v", err)
+		return
+	}
+
+	n.conn.WriteToUDP(packet, addr)
+}
+
+// handleFindNode returns the nodes closest to the target
+func (n *Node) handleFindNode(msg *message) (map[string]any, int, string) {
+	target, err := idArg(msg.args, _keyTarget)
+	if err != nil {
+		return nil, errorProtocol, err.Error()
+	}
+
+	return map[string]any{_keyNodes: encodeNodes(n.table.closest(target, BucketSize))}, 0, ""
+}
+
+// handleGetPeers returns the peers announced for an infohash, or the closest nodes when there are none, along
+// with a token the querying node needs to announce itself
+func (n *Node) handleGetPeers(msg *message, addr *net.UDPAddr) (map[string]any, int, string) {
+	infoHash, err := idArg(msg.args, _keyInfoHash)
+	if err != nil {
+		return nil, errorProtocol, err.Error()
+	}
+
+	values := map[string]any{_keyToken: n.token(addr.IP, false)}
+
+	n.mu.Lock()
+	var peers []any
+	for peer, announced := range n.peers[infoHash] {
+		if time.Since(announced) < peerExpiry && len(peers) < maxPeersPerReply {
+			if peerAddr, err := net.ResolveUDPAddr("udp4", peer); err == nil {
+				peers = append(peers, encodePeer(peerAddr))
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	if len(peers) > 0 {
+		values[_keyValues] = peers
+	} else {
+		values[_keyNodes] = encodeNodes(n.table.closest(infoHash, BucketSize))
+	}
+
+	return values, 0, ""
+}
+
+// handleAnnouncePeer stores the querying node as a peer for an infohash when its token is valid
+func (n *Node) handleAnnouncePeer(msg *message, addr *net.UDPAddr) (map[string]any, int, string) {
+	infoHash, err := idArg(msg.args, _keyInfoHash)
+	if err != nil {
+		return nil, errorProtocol, err.Error()
+	}
+
+	token, _ := msg.args[_keyToken].(string)
+	if token != n.token(addr.IP, false) && token != n.token(addr.IP, true) {
+		return nil, errorProtocol, "bad token"
+	}
+
+	port, ok := msg.args[_keyPort].(int)
+	if implied, _ := msg.args[_keyImpliedPort].(int); implied == 1 {
+		port, ok = addr.Port, true
+	}
+	if !ok || port <= 0 || port > 65535 {
+		return nil, errorProtocol, "invalid port"
+	}
+
+	peer := (&net.UDPAddr{IP: addr.IP, Port: port}).String()
+	n.mu.Lock()
+	if n.peers[infoHash] == nil {
+		n.peers[infoHash] = make(map[string]time.Time)
+	}
+	n.peers[infoHash][peer] = time.Now()
+	n.mu.Unlock()
+
+	return map[string]any{}, 0, ""
+}
+
+// token returns the announce token for an IP, derived from the current or the previous secret
+func (n *Node) token(ip net.IP, old bool) string {
+	n.mu.Lock()
+	secret := n.secret
+	if old {
+		secret = n.oldSecret
+	}
+	n.mu.Unlock()
+
+	hash := sha1.Sum(append(secret[:], ip.To16()...))
+	return string(hash[:8])
+}
+
+// expirePeers forgets peers that have not announced themselves for a while
+func (n *Node) expirePeers() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for infoHash, peers := range n.peers {
+		for peer, announced := range peers {
+			if time.Since(announced) > peerExpiry {
+				delete(peers, peer)
+			}
+		}
+		if len(peers) == 0 {
+			delete(n.peers, infoHash)
+		}
+	}
+}
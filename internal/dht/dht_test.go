@@ -0,0 +1,152 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBucketIndex(t *testing.T) {
+	var own NodeID
+	tests := []struct {
+		name     string
+		id       NodeID
+		expected int
+	}{
+		{"own id", NodeID{}, -1},
+		{"first bit differs", NodeID{0x80}, 0},
+		{"eighth bit differs", NodeID{0x01}, 7},
+		{"last bit differs", NodeID{19: 0x01}, 159},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if result := bucketIndex(own, test.id); result != test.expected {
+				t.Errorf("expected bucket %d, got %d", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestRoutingTableClosest(t *testing.T) {
+	rt := newRoutingTable(NodeID{})
+	for i := 1; i <= 20; i++ {
+		rt.seen(NodeID{byte(i)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000 + i})
+	}
+
+	if size := rt.size(); size != 20 {
+		t.Errorf("expected 20 nodes in the table, got %d", size)
+	}
+
+	// Ids with the first bit set all land in bucket 0, which holds at most BucketSize nodes
+	for i := 0; i < 2*BucketSize; i++ {
+		rt.seen(NodeID{0x80 | byte(i)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000 + i})
+	}
+	if size := rt.size(); size != 20+BucketSize {
+		t.Errorf("expected %d nodes in the table, got %d", 20+BucketSize, size)
+	}
+
+	closest := rt.closest(NodeID{0x03}, 3)
+	expected := []byte{0x03, 0x02, 0x01}
+	for i, n := range closest {
+		if n.id[0] != expected[i] {
+			t.Errorf("expected node %x at %d, got %x", expected[i], i, n.id[0])
+		}
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []node{{id: NodeID{1, 2, 3}, addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}}}
+
+	decoded, err := decodeNodes(encodeNodes(nodes))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(decoded) != 1 || decoded[0].id != nodes[0].id || decoded[0].addr.String() != "10.0.0.1:6881" {
+		t.Errorf("expected %v, got %v", nodes, decoded)
+	}
+
+	if _, err := decodeNodes("short"); err == nil {
+		t.Errorf("expected an error for a truncated node list, but got none")
+	}
+}
+
+func TestDecodeMalformedMessage(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+	}{
+		{"negative string length", "d1:t-1:aa1:y1:qe"},
+		{"string length beyond the packet", "d1:t4294967296:aa1:y1:qe"},
+		{"truncated", "d1:t2:aa1:y1:q"},
+		{"not a dictionary", "4:spam"},
+		{"missing type", "d1:t2:aae"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodeMessage([]byte(test.packet)); err == nil {
+				t.Errorf("expected an error for packet %q, but got none", test.packet)
+			}
+		})
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var running sync.WaitGroup
+	defer running.Wait()
+	defer cancel()
+
+	start := func(bootstrap []string, state string) *Node {
+		n, err := New(Config{Addr: "127.0.0.1:0", BootstrapNodes: bootstrap, StatePath: state})
+		if err != nil {
+			t.Fatalf("unexpected error creating node: %v", err)
+		}
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			n.Run(ctx)
+		}()
+		return n
+	}
+
+	router := start(nil, "")
+	bootstrap := []string{router.Addr().String()}
+	statePath := filepath.Join(t.TempDir(), "dht.dat")
+	seeder := start(bootstrap, "")
+	leecher := start(bootstrap, statePath)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for router.table.size() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if size := router.table.size(); size < 2 {
+		t.Fatalf("expected both nodes to join the router, got %d nodes", size)
+	}
+
+	infoHash := bytes.Repeat([]byte{0xab}, IDLength)
+	if _, err := seeder.Announce(ctx, infoHash, 51413); err != nil {
+		t.Fatalf("unexpected error announcing: %v", err)
+	}
+
+	found, err := leecher.GetPeers(ctx, infoHash)
+	if err != nil {
+		t.Fatalf("unexpected error getting peers: %v", err)
+	}
+	if len(found) != 1 || found[0] != "127.0.0.1:51413" {
+		t.Errorf("expected the announced peer 127.0.0.1:51413, got %v", found)
+	}
+
+	// The node saves its state when it stops
+	cancel()
+	running.Wait()
+	id, nodes, err := loadState(statePath)
+	if err != nil || id != leecher.ID() || len(nodes) == 0 {
+		t.Errorf("expected the saved id %s with nodes, got %s with %d nodes (%v)", leecher.ID(), id, len(nodes), err)
+	}
+}
@@ -0,0 +1,218 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/ParamvirSran/GoTorrent/internal/bencode"
+)
+
+const (
+	_keyTransaction = "t"
+	_keyType        = "y"
+	_keyQuery       = "q"
+	_keyArgs        = "a"
+	_keyResponse    = "r"
+	_keyError       = "e"
+	_keyID          = "id"
+	_keyTarget      = "target"
+	_keyInfoHash    = "info_hash"
+	_keyNodes       = "nodes"
+	_keyValues      = "values"
+	_keyToken       = "token"
+	_keyPort        = "port"
+	_keyImpliedPort = "implied_port"
+
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+
+	methodPing         = "ping"
+	methodFindNode     = "find_node"
+	methodGetPeers     = "get_peers"
+	methodAnnouncePeer = "announce_peer"
+
+	errorGeneric  = 201
+	errorProtocol = 203
+	errorMethod   = 204
+
+	compactNodeLength = IDLength + 6
+	compactPeerLength = 6
+)
+
+// message is a decoded KRPC message, a query, a response or an error
+type message struct {
+	transaction string
+	kind        string
+	method      string         // Queries only
+	args        map[string]any // Arguments of a query or values of a response
+	errCode     int
+	errMessage  string
+}
+
+// encodeQuery builds a KRPC query
+func encodeQuery(transaction, method string, args map[string]any) ([]byte, error) {
+	return bencode.Encode(map[string]any{
+		_keyTransaction: transaction,
+		_keyType:        typeQuery,
+		_keyQuery:       method,
+		_keyArgs:        args,
+	})
+}
+
+// encodeResponse builds a KRPC response
+func encodeResponse(transaction string, values map[string]any) ([]byte, error) {
+	return bencode.Encode(map[string]any{
+		_keyTransaction: transaction,
+		_keyType:        typeResponse,
+		_keyResponse:    values,
+	})
+}
+
+// encodeError builds a KRPC error
+func encodeError(transaction string, code int, text string) ([]byte, error) {
+	return bencode.Encode(map[string]any{
+		_keyTransaction: transaction,
+		_keyType:        typeError,
+		_keyError:       []any{code, text},
+	})
+}
+
+// decodeMessage parses a KRPC message received over UDP
+func decodeMessage(packet []byte) (*message, error) {
+	data, err := bencode.Decode(bytes.NewReader(packet))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode message: %w", err)
+	}
+
+	dict, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid message: expected a dictionary but got %T", data)
+	}
+
+	msg := &message{}
+	transaction, transactionOk := dict[_keyTransaction].(string)
+	kind, kindOk := dict[_keyType].(string)
+	if !transactionOk || !kindOk {
+		return nil, fmt.Errorf("invalid message transaction: %t, type: %t", transactionOk, kindOk)
+	}
+	msg.transaction, msg.kind = transaction, kind
+
+	switch kind {
+	case typeQuery:
+		method, methodOk := dict[_keyQuery].(string)
+		args, argsOk := dict[_keyArgs].(map[string]any)
+		if !methodOk || !argsOk {
+			return nil, fmt.Errorf("invalid query method: %t, arguments: %t", methodOk, argsOk)
+		}
+		msg.method, msg.args = method, args
+	case typeResponse:
+		values, ok := dict[_keyResponse].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid response: %s field missing or not a dictionary", _keyResponse)
+		}
+		msg.args = values
+	case typeError:
+		list, ok := dict[_keyError].([]any)
+		if ok && len(list) == 2 {
+			msg.errCode, _ = list[0].(int)
+			msg.errMessage, _ = list[1].(string)
+		}
+	default:
+		return nil, fmt.Errorf("unknown message type %q", kind)
+	}
+
+	return msg, nil
+}
+
+// nodeID returns the id a message carries in its arguments or response values
+func (msg *message) nodeID() (NodeID, error) {
+	return idArg(msg.args, _keyID)
+}
+
+// idArg reads a 20 byte id from the arguments of a message
+func idArg(args map[string]any, key string) (NodeID, error) {
+	var id NodeID
+	value, ok := args[key].(string)
+	if !ok || len(value) != IDLength {
+		return id, fmt.Errorf("%s field missing or not %d bytes", key, IDLength)
+	}
+	copy(id[:], value)
+
+	return id, nil
+}
+
+// encodeNodes packs nodes in the compact node info format, 20 bytes of id followed by IPv4 address and port
+func encodeNodes(nodes []node) string {
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf.Write(n.id[:])
+		buf.Write(ip)
+		binary.Write(&buf, binary.BigEndian, uint16(n.addr.Port))
+	}
+
+	return buf.String()
+}
+
+// decodeNodes unpacks nodes in the compact node info format
+func decodeNodes(compact string) ([]node, error) {
+	if len(compact)%compactNodeLength != 0 {
+		return nil, fmt.Errorf("compact nodes length %d is not a multiple of %d", len(compact), compactNodeLength)
+	}
+
+	nodes := make([]node, 0, len(compact)/compactNodeLength)
+	for i := 0; i < len(compact); i += compactNodeLength {
+		var n node
+		copy(n.id[:], compact[i:i+IDLength])
+		n.addr = decodeAddr(compact[i+IDLength : i+compactNodeLength])
+		if n.addr.Port != 0 {
+			nodes = append(nodes, n)
+		}
+	}
+
+	return nodes, nil
+}
+
+// encodePeer packs a peer address in the compact peer format, an IPv4 address and port
+func encodePeer(addr *net.UDPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return ""
+	}
+
+	peer := make([]byte, compactPeerLength)
+	copy(peer, ip)
+	binary.BigEndian.PutUint16(peer[4:], uint16(addr.Port))
+
+	return string(peer)
+}
+
+// decodeAddr unpacks an IPv4 address and port
+func decodeAddr(compact string) *net.UDPAddr {
+	return &net.UDPAddr{
+		IP:   net.IPv4(compact[0], compact[1], compact[2], compact[3]),
+		Port: int(binary.BigEndian.Uint16([]byte(compact[4:6]))),
+	}
+}
+
+// decodeValues unpacks the peers of a get_peers response as host:port strings
+func decodeValues(values []any) []string {
+	var peers []string
+	for _, value := range values {
+		compact, ok := value.(string)
+		if !ok || len(compact) != compactPeerLength {
+			continue
+		}
+		if addr := decodeAddr(compact); addr.Port != 0 {
+			peers = append(peers, addr.String())
+		}
+	}
+
+	return peers
+}
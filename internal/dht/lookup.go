@@ -0,0 +1,195 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// candidate is a node found during a lookup, seeds from the configuration have no known id
+type candidate struct {
+	node
+	queried bool
+	token   string // Token returned by get_peers, needed to announce to the node
+}
+
+// lookupResult is what an iterative lookup found
+type lookupResult struct {
+	peers     []string    // Peers returned by get_peers
+	responded []candidate // Nodes that answered, closest first
+}
+
+// lookup runs an iterative Kademlia lookup for a target with find_node or get_peers, asking Alpha nodes at a time
+// for nodes closer to the target until the closest BucketSize nodes have all answered or failed. seeds are asked
+// first when given, e.g. the bootstrap nodes
+func (n *Node) lookup(ctx context.Context, target NodeID, method string, seeds []*net.UDPAddr) lookupResult {
+	var mu sync.Mutex
+	var result lookupResult
+	seenPeers := make(map[string]bool)
+	known := make(map[string]bool)
+	var shortlist []*candidate
+
+	add := func(found node) {
+		key := found.addr.String()
+		if known[key] || found.id == n.id {
+			return
+		}
+		known[key] = true
+		shortlist = append(shortlist, &candidate{node: found})
+	}
+	for _, seed := range seeds {
+		add(node{addr: seed})
+	}
+	for _, closest := range n.table.closest(target, BucketSize) {
+		add(closest)
+	}
+
+	args := map[string]any{_keyID: string(n.id[:])}
+	if method == methodGetPeers {
+		args[_keyInfoHash] = string(target[:])
+	} else {
+		args[_keyTarget] = string(target[:])
+	}
+
+	for round := 0; round < maxLookupRounds && ctx.Err() == nil; round++ {
+		mu.Lock()
+		nodes := make([]node, len(shortlist))
+		for i, c := range shortlist {
+			nodes[i] = c.node
+		}
+		byAddr := make(map[string]*candidate, len(shortlist))
+		for _, c := range shortlist {
+			byAddr[c.addr.String()] = c
+		}
+		sortByDistance(nodes, target)
+
+		// Seeds without an id go first, then the closest nodes that have not been asked yet
+		var batch []*candidate
+		for _, c := range shortlist {
+			if !c.queried && c.id == (NodeID{}) && len(batch) < Alpha {
+				batch = append(batch, c)
+			}
+		}
+		for i := 0; i < len(nodes) && i < BucketSize && len(batch) < Alpha; i++ {
+			if c := byAddr[nodes[i].addr.String()]; !c.queried && c.id != (NodeID{}) {
+				batch = append(batch, c)
+			}
+		}
+		for _, c := range batch {
+			c.queried = true
+		}
+		mu.Unlock()
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+
+				msg, err := n.query(ctx, c.addr, method, args)
+				if err != nil {
+					return
+				}
+				id, _ := msg.nodeID()
+				found, _ := decodeNodes(stringArg(msg.args, _keyNodes))
+				values, _ := msg.args[_keyValues].([]any)
+
+				mu.Lock()
+				defer mu.Unlock()
+				c.id = id
+				c.token = stringArg(msg.args, _keyToken)
+				result.responded = append(result.responded, *c)
+				for _, f := range found {
+					add(f)
+				}
+				for _, peer := range decodeValues(values) {
+					if !seenPeers[peer] {
+						seenPeers[peer] = true
+						result.peers = append(result.peers, peer)
+					}
+				}
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	responded := make([]node, len(result.responded))
+	tokens := make(map[NodeID]string, len(result.responded))
+	for i, c := range result.responded {
+		responded[i] = c.node
+		tokens[c.id] = c.token
+	}
+	sortByDistance(responded, target)
+	result.responded = result.responded[:0]
+	for _, r := range responded {
+		result.responded = append(result.responded, candidate{node: r, queried: true, token: tokens[r.id]})
+	}
+
+	return result
+}
+
+// GetPeers looks up peers for an infohash, they are returned as host:port
+func (n *Node) GetPeers(ctx context.Context, infoHash []byte) ([]string, error) {
+	target, err := targetID(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return n.lookup(ctx, target, methodGetPeers, nil).peers, nil
+}
+
+// Announce looks up peers for an infohash and announces that we download it on port to the closest nodes that
+// answered, the peers found on the way are returned
+func (n *Node) Announce(ctx context.Context, infoHash []byte, port int) ([]string, error) {
+	target, err := targetID(infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	result := n.lookup(ctx, target, methodGetPeers, nil)
+
+	announced := 0
+	for _, c := range result.responded {
+		if announced == BucketSize {
+			break
+		}
+		if c.token == "" {
+			continue
+		}
+		args := map[string]any{
+			_keyID:       string(n.id[:]),
+			_keyInfoHash: string(target[:]),
+			_keyPort:     port,
+			_keyToken:    c.token,
+		}
+		if _, err := n.query(ctx, c.addr, methodAnnouncePeer, args); err == nil {
+			announced++
+		}
+	}
+	log.Printf("DHT announce for %x found %d peers and reached %d nodes", infoHash, len(result.peers), announced)
+
+	return result.peers, nil
+}
+
+// targetID turns an infohash into an id of the DHT
+func targetID(infoHash []byte) (NodeID, error) {
+	var target NodeID
+	if len(infoHash) != IDLength {
+		return target, fmt.Errorf("infohash has %d bytes, expected %d", len(infoHash), IDLength)
+	}
+	copy(target[:], infoHash)
+
+	return target, nil
+}
+
+// stringArg reads a string from the arguments of a message, empty when it is missing
+func stringArg(args map[string]any, key string) string {
+	value, _ := args[key].(string)
+	return value
+}
@@ -0,0 +1,195 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	IDLength   = 20
+	BucketSize = 8 // K, the number of nodes kept per bucket and returned by lookups
+
+	maxFailures       = 2                // Unanswered queries before a node is replaced by a new one
+	questionableAfter = 15 * time.Minute // Nodes not heard from for this long are pinged
+)
+
+// NodeID identifies a DHT node, infohashes live in the same 160 bit space
+type NodeID [IDLength]byte
+
+// RandomNodeID generates a random node id
+func RandomNodeID() (NodeID, error) {
+	var id NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, fmt.Errorf("error generating node id: %w", err)
+	}
+
+	return id, nil
+}
+
+// String returns the id as hex
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// distance returns the XOR distance between two ids
+func distance(a, b NodeID) NodeID {
+	var d NodeID
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+
+	return d
+}
+
+// bucketIndex returns the bucket of an id relative to our own, the number of leading bits they share. Our own
+// id has no bucket and returns -1
+func bucketIndex(own, id NodeID) int {
+	d := distance(own, id)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+
+	return -1
+}
+
+// node is a remote DHT node in the routing table
+type node struct {
+	id       NodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// routingTable is a Kademlia routing table with one bucket of at most BucketSize nodes per shared prefix length
+type routingTable struct {
+	own NodeID
+
+	mu      sync.Mutex
+	buckets [IDLength * 8][]*node // Least recently seen first
+}
+
+// newRoutingTable creates an empty routing table around our own id
+func newRoutingTable(own NodeID) *routingTable {
+	return &routingTable{own: own}
+}
+
+// seen records that a node answered or queried us, it is added when its bucket has room or holds a bad node
+func (rt *routingTable) seen(id NodeID, addr *net.UDPAddr) {
+	index := bucketIndex(rt.own, id)
+	if index < 0 || addr == nil || addr.IP.To4() == nil || addr.Port == 0 {
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	bucket := rt.buckets[index]
+	for i, n := range bucket {
+		if n.id == id {
+			n.addr = addr
+			n.lastSeen = time.Now()
+			n.failures = 0
+			rt.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), n)
+			return
+		}
+	}
+
+	fresh := &node{id: id, addr: addr, lastSeen: time.Now()}
+	if len(bucket) < BucketSize {
+		rt.buckets[index] = append(bucket, fresh)
+		return
+	}
+
+	for i, n := range bucket {
+		if n.failures >= maxFailures {
+			rt.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), fresh)
+			return
+		}
+	}
+}
+
+// failed records a query a node did not answer
+func (rt *routingTable) failed(id NodeID) {
+	index := bucketIndex(rt.own, id)
+	if index < 0 {
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	for _, n := range rt.buckets[index] {
+		if n.id == id {
+			n.failures++
+			return
+		}
+	}
+}
+
+// closest returns up to count good nodes sorted by their distance to a target
+func (rt *routingTable) closest(target NodeID, count int) []node {
+	rt.mu.Lock()
+	var nodes []node
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			if n.failures < maxFailures {
+				nodes = append(nodes, *n)
+			}
+		}
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+
+	return nodes
+}
+
+// questionable returns the nodes that have not been heard from for a while
+func (rt *routingTable) questionable() []node {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var nodes []node
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			if time.Since(n.lastSeen) > questionableAfter {
+				nodes = append(nodes, *n)
+			}
+		}
+	}
+
+	return nodes
+}
+
+// size returns the number of nodes in the table
+func (rt *routingTable) size() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	total := 0
+	for _, bucket := range rt.buckets {
+		total += len(bucket)
+	}
+
+	return total
+}
+
+// sortByDistance sorts nodes by their distance to a target, closest first
+func sortByDistance(nodes []node, target NodeID) {
+	sort.Slice(nodes, func(i, j int) bool {
+		di, dj := distance(nodes[i].id, target), distance(nodes[j].id, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
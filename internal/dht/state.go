@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ParamvirSran/GoTorrent/internal/bencode"
+)
+
+// maxSavedNodes caps the routing table saved between runs
+const maxSavedNodes = 200
+
+// saveState writes the node id and the routing table so the next run does not need the bootstrap nodes
+func (n *Node) saveState() error {
+	if n.config.StatePath == "" {
+		return nil
+	}
+
+	encoded, err := bencode.Encode(map[string]any{
+		_keyID:    string(n.id[:]),
+		_keyNodes: encodeNodes(n.table.closest(n.id, maxSavedNodes)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode DHT state: %w", err)
+	}
+
+	tmpPath := n.config.StatePath + ".tmp"
+	if err := os.WriteFile(tmpPath, encoded, 0644); err != nil {
+		return fmt.Errorf("error writing DHT state: %w", err)
+	}
+	if err := os.Rename(tmpPath, n.config.StatePath); err != nil {
+		return fmt.Errorf("error replacing DHT state: %w", err)
+	}
+
+	return nil
+}
+
+// loadState reads the state saved by saveState, a missing file returns a zero id and no nodes
+func loadState(path string) (NodeID, []node, error) {
+	var id NodeID
+	if path == "" {
+		return id, nil, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return id, nil, nil
+		}
+		return id, nil, fmt.Errorf("error reading DHT state: %w", err)
+	}
+
+	data, err := bencode.Decode(bytes.NewReader(content))
+	if err != nil {
+		return id, nil, fmt.Errorf("failed to decode DHT state: %w", err)
+	}
+	dict, ok := data.(map[string]any)
+	if !ok {
+		return id, nil, fmt.Errorf("invalid DHT state format: expected a dictionary but got %T", data)
+	}
+
+	if id, err = idArg(dict, _keyID); err != nil {
+		return NodeID{}, nil, err
+	}
+	nodes, err := decodeNodes(stringArg(dict, _keyNodes))
+	if err != nil {
+		return id, nil, err
+	}
+
+	return id, nodes, nil
+}
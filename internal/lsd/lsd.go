@@ -0,0 +1,222 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Port             = 6771
+	IPv4Group        = "239.192.152.143"
+	IPv6Group        = "ff15::efc0:988f"
+	AnnounceInterval = 5 * time.Minute // Announces are repeated this often, BEP 14 allows at most one a minute
+
+	maxPacketSize = 1400
+
+	_headerHost     = "Host"
+	_headerPort     = "Port"
+	_headerInfohash = "Infohash"
+	_headerCookie   = "Cookie"
+)
+
+// announcement is a parsed BT-SEARCH message
+type announcement struct {
+	port       int
+	infoHashes []string // Hex encoded, lower case
+	cookie     string
+}
+
+// Service announces torrents to the local network with Local Service Discovery (BEP 14) and hands the peers other
+// clients on the network announce for them to the torrent they belong to
+type Service struct {
+	port   int    // Port peers connect to us on
+	cookie string // Tells our own announces apart from those of other clients
+
+	conns  []*net.UDPConn // One per multicast group we joined
+	groups []*net.UDPAddr // Group of each connection
+
+	mu       sync.Mutex
+	torrents map[string]func(address string) // Called with the address of every peer found, by hex infohash
+}
+
+// New joins the IPv4 and IPv6 LSD multicast groups, at least one of them has to work. port is the port peers
+// connect to us on
+func New(port int) (*Service, error) {
+	cookie := make([]byte, 8)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, fmt.Errorf("error generating LSD cookie: %w", err)
+	}
+
+	s := &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[string]func(string)),
+	}
+
+	var errs []error
+	for _, group := range []struct{ network, ip string }{{"udp4", IPv4Group}, {"udp6", IPv6Group}} {
+		addr := &net.UDPAddr{IP: net.ParseIP(group.ip), Port: Port}
+		conn, err := net.ListenMulticastUDP(group.network, nil, addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error joining %s: %w", addr, err))
+			continue
+		}
+		s.conns = append(s.conns, conn)
+		s.groups = append(s.groups, addr)
+	}
+	if len(s.conns) == 0 {
+		return nil, fmt.Errorf("no LSD multicast group could be joined: %v", errs)
+	}
+	for _, err := range errs {
+		log.Printf("LSD continuing without a group: %v", err)
+	}
+
+	return s, nil
+}
+
+// Add starts announcing a torrent, found is called with the host:port of every peer announcing it
+func (s *Service) Add(infoHash []byte, found func(address string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.torrents[hex.EncodeToString(infoHash)] = found
+}
+
+// Run announces the torrents right away and then every AnnounceInterval, and listens for the announces of other
+// clients until the context is done
+func (s *Service) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, conn := range s.conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			s.receive(conn)
+		}(conn)
+	}
+
+	ticker := time.NewTicker(AnnounceInterval)
+	defer ticker.Stop()
+	for {
+		s.announce()
+
+		select {
+		case <-ctx.Done():
+			for _, conn := range s.conns {
+				conn.Close()
+			}
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// announce sends one announce with every torrent to each group
+func (s *Service) announce() {
+	s.mu.Lock()
+	infoHashes := make([]string, 0, len(s.torrents))
+	for infoHash := range s.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		return
+	}
+
+	for i, conn := range s.conns {
+		packet := formatAnnouncement(s.groups[i], announcement{port: s.port, infoHashes: infoHashes, cookie: s.cookie})
+		if _, err := conn.WriteToUDP(packet, s.groups[i]); err != nil {
+			log.Printf("Failed to send LSD announce to %s: %v", s.groups[i], err)
+		}
+	}
+}
+
+// receive reads announces from a group until the connection is closed
+func (s *Service) receive(conn *net.UDPConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		msg, err := parseAnnouncement(buf[:n])
+		if err != nil {
+			log.Printf("Ignoring LSD packet from %s: %v", from, err)
+			continue
+		}
+		if msg.cookie == s.cookie {
+			continue
+		}
+
+		address := net.JoinHostPort(from.IP.String(), strconv.Itoa(msg.port))
+		for _, infoHash := range msg.infoHashes {
+			s.mu.Lock()
+			found, ok := s.torrents[infoHash]
+			s.mu.Unlock()
+
+			if ok {
+				log.Printf("LSD found peer %s for %s", address, infoHash)
+				found(address)
+			}
+		}
+	}
+}
+
+// formatAnnouncement builds a BT-SEARCH message for a group
+func formatAnnouncement(group *net.UDPAddr, msg announcement) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	fmt.Fprintf(&buf, "%s: %s\r\n", _headerHost, group)
+	fmt.Fprintf(&buf, "%s: %d\r\n", _headerPort, msg.port)
+	for _, infoHash := range msg.infoHashes {
+		fmt.Fprintf(&buf, "%s: %s\r\n", _headerInfohash, infoHash)
+	}
+	if msg.cookie != "" {
+		fmt.Fprintf(&buf, "%s: %s\r\n", _headerCookie, msg.cookie)
+	}
+	buf.WriteString("\r\n\r\n")
+
+	return buf.Bytes()
+}
+
+// parseAnnouncement parses a BT-SEARCH message, infohashes that are not 40 hex characters are dropped
+func parseAnnouncement(packet []byte) (announcement, error) {
+	request, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return announcement{}, fmt.Errorf("failed to parse announce: %w", err)
+	}
+	if request.Method != "BT-SEARCH" {
+		return announcement{}, fmt.Errorf("unexpected method %q", request.Method)
+	}
+
+	port, err := strconv.Atoi(request.Header.Get(_headerPort))
+	if err != nil || port <= 0 || port > 65535 {
+		return announcement{}, fmt.Errorf("invalid port %q", request.Header.Get(_headerPort))
+	}
+
+	msg := announcement{port: port, cookie: request.Header.Get(_headerCookie)}
+	for _, infoHash := range request.Header.Values(_headerInfohash) {
+		infoHash = strings.ToLower(strings.TrimSpace(infoHash))
+		if decoded, err := hex.DecodeString(infoHash); err == nil && len(decoded) == 20 {
+			msg.infoHashes = append(msg.infoHashes, infoHash)
+		}
+	}
+	if len(msg.infoHashes) == 0 {
+		return announcement{}, fmt.Errorf("no valid infohash")
+	}
+
+	return msg, nil
+}
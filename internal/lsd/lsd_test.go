@@ -0,0 +1,64 @@
+package lsd
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestAnnouncementRoundTrip(t *testing.T) {
+	group := &net.UDPAddr{IP: net.ParseIP(IPv6Group), Port: Port}
+	msg := announcement{
+		port:       6881,
+		infoHashes: []string{strings.Repeat("ab", 20), strings.Repeat("01", 20)},
+		cookie:     "c00k1e",
+	}
+
+	packet := formatAnnouncement(group, msg)
+	if !strings.Contains(string(packet), "Host: [ff15::efc0:988f]:6771\r\n") {
+		t.Errorf("expected the IPv6 group as host, got %q", packet)
+	}
+
+	parsed, err := parseAnnouncement(packet)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parsed.port != msg.port || parsed.cookie != msg.cookie || len(parsed.infoHashes) != 2 ||
+		parsed.infoHashes[0] != msg.infoHashes[0] || parsed.infoHashes[1] != msg.infoHashes[1] {
+		t.Errorf("expected %+v, got %+v", msg, parsed)
+	}
+}
+
+func TestParseAnnouncement(t *testing.T) {
+	infoHash := strings.Repeat("AB", 20)
+	tests := []struct {
+		name      string
+		packet    string
+		expectErr bool
+	}{
+		{"valid without cookie", "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n\r\n", false},
+		{"wrong method", "GET * HTTP/1.1\r\nPort: 6881\r\nInfohash: " + infoHash + "\r\n\r\n", true},
+		{"missing port", "BT-SEARCH * HTTP/1.1\r\nInfohash: " + infoHash + "\r\n\r\n", true},
+		{"port out of range", "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + infoHash + "\r\n\r\n", true},
+		{"short infohash", "BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abcd\r\n\r\n", true},
+		{"garbage", "garbage", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := parseAnnouncement([]byte(test.packet))
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected an error, but got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(msg.infoHashes) != 1 || msg.infoHashes[0] != strings.ToLower(infoHash) {
+				t.Errorf("expected the lower case infohash, got %v", msg.infoHashes)
+			}
+		})
+	}
+}
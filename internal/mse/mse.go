@@ -0,0 +1,391 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+// Policies for encrypting peer connections
+const (
+	PolicyDisabled = "disabled" // Plaintext only
+	PolicyPrefer   = "prefer"   // Encrypt when the peer supports it, plaintext connections are still made and accepted
+	PolicyRequire  = "require"  // Encrypted connections only
+)
+
+// Crypto methods a peer provides and selects, as bits of crypto_provide and crypto_select
+const (
+	CryptoPlaintext uint32 = 0x01 // Only the handshake is obfuscated
+	CryptoRC4       uint32 = 0x02 // The whole stream is RC4 encrypted
+)
+
+const (
+	HandshakeTimeout = 30 * time.Second
+
+	keyLength     = 96   // Bytes of a public key and the shared secret
+	maxPad        = 512  // Most bytes of random padding after a public key or in an encrypted message
+	discardLength = 1024 // Bytes of the RC4 key stream thrown away before use
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	verificationConstant = make([]byte, 8)
+	plaintextHandshake   = []byte("\x13BitTorrent protocol")
+)
+
+// Methods returns the crypto methods a policy allows
+func Methods(policy string) (uint32, error) {
+	switch policy {
+	case PolicyDisabled:
+		return CryptoPlaintext, nil
+	case PolicyPrefer:
+		return CryptoPlaintext | CryptoRC4, nil
+	case PolicyRequire:
+		return CryptoRC4, nil
+	default:
+		return 0, fmt.Errorf("unknown encryption policy %q", policy)
+	}
+}
+
+// Conn is a peer connection after the MSE handshake, reads and writes are RC4 encrypted when that method was
+// selected
+type Conn struct {
+	net.Conn
+	reader io.Reader // Holds data read ahead during the handshake
+
+	mu      sync.Mutex // Keeps the key stream in the order the writes go out
+	encrypt *rc4.Cipher
+	method  uint32
+}
+
+// Read reads decrypted data
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Write encrypts and writes data
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	encrypted := make([]byte, len(b))
+	c.encrypt.XORKeyStream(encrypted, b)
+	return c.Conn.Write(encrypted)
+}
+
+// Encrypted checks if the stream is RC4 encrypted
+func (c *Conn) Encrypted() bool {
+	return c.method == CryptoRC4
+}
+
+// NetConn returns the connection underneath
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Initiate runs the MSE handshake on a connection we opened for a torrent, offering the provided crypto methods.
+// The BitTorrent handshake is sent through the returned connection afterwards
+func Initiate(conn net.Conn, infoHash []byte, provide uint32) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+	pad, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(public, pad...)); err != nil {
+		return nil, fmt.Errorf("error sending public key: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	remote := make([]byte, keyLength)
+	if _, err := io.ReadFull(r, remote); err != nil {
+		return nil, fmt.Errorf("error reading public key: %w", err)
+	}
+	secret, err := sharedSecret(private, remote)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt, decrypt := newCipher("keyA", secret, infoHash), newCipher("keyB", secret, infoHash)
+
+	var msg bytes.Buffer
+	msg.Write(hash("req1", secret))
+	msg.Write(xor(hash("req2", infoHash), hash("req3", secret)))
+	var plain bytes.Buffer
+	plain.Write(verificationConstant)
+	binary.Write(&plain, binary.BigEndian, provide)
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // No PadC
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // No initial payload, the BitTorrent handshake follows
+	encrypted := make([]byte, plain.Len())
+	encrypt.XORKeyStream(encrypted, plain.Bytes())
+	msg.Write(encrypted)
+	if _, err := conn.Write(msg.Bytes()); err != nil {
+		return nil, fmt.Errorf("error sending crypto provide: %w", err)
+	}
+
+	// The answer starts with the encrypted verification constant somewhere after the padding of the remote
+	expected := make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(expected, verificationConstant)
+	if err := syncTo(r, expected, maxPad+len(expected)); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("error reading crypto select: %w", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header)
+	if err := skipPad(r, decrypt, int(binary.BigEndian.Uint16(header[4:]))); err != nil {
+		return nil, err
+	}
+	if selected&provide == 0 || (selected != CryptoPlaintext && selected != CryptoRC4) {
+		return nil, fmt.Errorf("peer selected crypto method %#x, we provided %#x", selected, provide)
+	}
+
+	c := &Conn{Conn: conn, reader: r, method: selected}
+	if selected == CryptoRC4 {
+		c.reader = cipher.StreamReader{S: decrypt, R: r}
+		c.encrypt = encrypt
+	}
+
+	return c, nil
+}
+
+// Accept runs the MSE handshake on a connection a peer opened, the infohash of the torrent the peer wants is found
+// among infoHashes and returned. Plaintext BitTorrent handshakes are let through when methods allow plaintext, the
+// infohash is then nil and the handshake is left for the caller to read
+func Accept(conn net.Conn, infoHashes [][]byte, methods uint32) (*Conn, []byte, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	head, err := r.Peek(len(plaintextHandshake))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading handshake: %w", err)
+	}
+	if bytes.Equal(head, plaintextHandshake) {
+		if methods&CryptoPlaintext == 0 {
+			return nil, nil, fmt.Errorf("refusing plaintext handshake, encryption is required")
+		}
+		return &Conn{Conn: conn, reader: r, method: CryptoPlaintext}, nil, nil
+	}
+
+	remote := make([]byte, keyLength)
+	if _, err := io.ReadFull(r, remote); err != nil {
+		return nil, nil, fmt.Errorf("error reading public key: %w", err)
+	}
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	pad, err := randomPad()
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := conn.Write(append(public, pad...)); err != nil {
+		return nil, nil, fmt.Errorf("error sending public key: %w", err)
+	}
+	secret, err := sharedSecret(private, remote)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := syncTo(r, hash("req1", secret), maxPad+sha1.Size); err != nil {
+		return nil, nil, err
+	}
+	skeyHash := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, skeyHash); err != nil {
+		return nil, nil, fmt.Errorf("error reading infohash: %w", err)
+	}
+	var infoHash []byte
+	req3 := hash("req3", secret)
+	for _, candidate := range infoHashes {
+		if bytes.Equal(xor(hash("req2", candidate), req3), skeyHash) {
+			infoHash = candidate
+			break
+		}
+	}
+	if infoHash == nil {
+		return nil, nil, fmt.Errorf("peer asked for an unknown torrent")
+	}
+
+	encrypt, decrypt := newCipher("keyB", secret, infoHash), newCipher("keyA", secret, infoHash)
+
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, fmt.Errorf("error reading crypto provide: %w", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], verificationConstant) {
+		return nil, nil, fmt.Errorf("invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(header[8:])
+	if err := skipPad(r, decrypt, int(binary.BigEndian.Uint16(header[12:]))); err != nil {
+		return nil, nil, err
+	}
+
+	initialLength := make([]byte, 2)
+	if _, err := io.ReadFull(r, initialLength); err != nil {
+		return nil, nil, fmt.Errorf("error reading initial payload length: %w", err)
+	}
+	decrypt.XORKeyStream(initialLength, initialLength)
+	initial := make([]byte, binary.BigEndian.Uint16(initialLength))
+	if _, err := io.ReadFull(r, initial); err != nil {
+		return nil, nil, fmt.Errorf("error reading initial payload: %w", err)
+	}
+	decrypt.XORKeyStream(initial, initial)
+
+	var selected uint32
+	switch {
+	case provide&methods&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&methods&CryptoPlaintext != 0:
+		selected = CryptoPlaintext
+	default:
+		return nil, nil, fmt.Errorf("no common crypto method, peer provided %#x and we allow %#x", provide, methods)
+	}
+
+	var plain bytes.Buffer
+	plain.Write(verificationConstant)
+	binary.Write(&plain, binary.BigEndian, selected)
+	binary.Write(&plain, binary.BigEndian, uint16(0)) // No PadD
+	answer := make([]byte, plain.Len())
+	encrypt.XORKeyStream(answer, plain.Bytes())
+	if _, err := conn.Write(answer); err != nil {
+		return nil, nil, fmt.Errorf("error sending crypto select: %w", err)
+	}
+
+	c := &Conn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initial), r), method: selected}
+	if selected == CryptoRC4 {
+		c.reader = io.MultiReader(bytes.NewReader(initial), cipher.StreamReader{S: decrypt, R: r})
+		c.encrypt = encrypt
+	}
+
+	return c, infoHash, nil
+}
+
+// newKeys generates a Diffie-Hellman key pair, the public key is padded to keyLength bytes
+func newKeys() (*big.Int, []byte, error) {
+	random := make([]byte, 20)
+	if _, err := rand.Read(random); err != nil {
+		return nil, nil, fmt.Errorf("error generating private key: %w", err)
+	}
+
+	private := new(big.Int).SetBytes(random)
+	public := new(big.Int).Exp(generator, private, prime)
+
+	return private, public.FillBytes(make([]byte, keyLength)), nil
+}
+
+// sharedSecret computes the secret both sides share from our private key and the public key of the remote
+func sharedSecret(private *big.Int, remote []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(remote)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(prime, big.NewInt(1))) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	return new(big.Int).Exp(y, private, prime).FillBytes(make([]byte, keyLength)), nil
+}
+
+// newCipher creates the RC4 cipher of one direction, the start of the key stream is discarded
+func newCipher(name string, secret, infoHash []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash(name, secret, infoHash))
+	discard := make([]byte, discardLength)
+	c.XORKeyStream(discard, discard)
+
+	return c
+}
+
+// hash returns the SHA-1 of a label followed by data
+func hash(label string, data ...[]byte) []byte {
+	h := sha1.New()
+	h.Write([]byte(label))
+	for _, d := range data {
+		h.Write(d)
+	}
+
+	return h.Sum(nil)
+}
+
+// xor returns a xor b, both have the same length
+func xor(a, b []byte) []byte {
+	result := make([]byte, len(a))
+	for i := range a {
+		result[i] = a[i] ^ b[i]
+	}
+
+	return result
+}
+
+// randomPad returns 0 to maxPad random bytes
+func randomPad() ([]byte, error) {
+	var length [2]byte
+	if _, err := rand.Read(length[:]); err != nil {
+		return nil, fmt.Errorf("error generating padding: %w", err)
+	}
+
+	pad := make([]byte, int(binary.BigEndian.Uint16(length[:]))%(maxPad+1))
+	if _, err := rand.Read(pad); err != nil {
+		return nil, fmt.Errorf("error generating padding: %w", err)
+	}
+
+	return pad, nil
+}
+
+// syncTo reads until just after pattern, giving up after limit bytes
+func syncTo(r *bufio.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, len(pattern)+1)
+	for read := 0; read < limit; read++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("error reading handshake: %w", err)
+		}
+
+		window = append(window, b)
+		if len(window) > len(pattern) {
+			window = window[1:]
+		}
+		if bytes.Equal(window, pattern) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("handshake synchronization not found within %d bytes", limit)
+}
+
+// skipPad reads and decrypts padding, its content is ignored
+func skipPad(r io.Reader, decrypt *rc4.Cipher, length int) error {
+	if length > maxPad {
+		return fmt.Errorf("padding of %d bytes is longer than %d", length, maxPad)
+	}
+
+	pad := make([]byte, length)
+	if _, err := io.ReadFull(r, pad); err != nil {
+		return fmt.Errorf("error reading padding: %w", err)
+	}
+	decrypt.XORKeyStream(pad, pad)
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHandshake(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+	other := bytes.Repeat([]byte{0xcd}, 20)
+
+	tests := []struct {
+		name      string
+		provide   uint32
+		allowed   uint32
+		known     [][]byte
+		encrypted bool
+		fails     bool
+	}{
+		{"rc4 preferred", CryptoPlaintext | CryptoRC4, CryptoPlaintext | CryptoRC4, [][]byte{other, infoHash}, true, false},
+		{"plaintext only", CryptoPlaintext, CryptoPlaintext | CryptoRC4, [][]byte{infoHash}, false, false},
+		{"rc4 required", CryptoRC4, CryptoRC4, [][]byte{infoHash}, true, false},
+		{"no common method", CryptoPlaintext, CryptoRC4, [][]byte{infoHash}, false, true},
+		{"unknown torrent", CryptoRC4, CryptoRC4, [][]byte{other}, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			initiator, receiver := connPair(t)
+
+			type accepted struct {
+				conn     *Conn
+				infoHash []byte
+				err      error
+			}
+			done := make(chan accepted, 1)
+			go func() {
+				conn, found, err := Accept(receiver, test.known, test.allowed)
+				if err != nil {
+					receiver.Close()
+				}
+				done <- accepted{conn, found, err}
+			}()
+
+			conn, err := Initiate(initiator, infoHash, test.provide)
+			result := <-done
+			if test.fails {
+				if err == nil && result.err == nil {
+					t.Errorf("expected an error, but got none")
+				}
+				return
+			}
+			if err != nil || result.err != nil {
+				t.Fatalf("unexpected errors: %v, %v", err, result.err)
+			}
+			if !bytes.Equal(result.infoHash, infoHash) {
+				t.Errorf("expected infohash %x, got %x", infoHash, result.infoHash)
+			}
+			if conn.Encrypted() != test.encrypted || result.conn.Encrypted() != test.encrypted {
+				t.Errorf("expected encrypted to be %t, got %t and %t", test.encrypted, conn.Encrypted(), result.conn.Encrypted())
+			}
+
+			exchange(t, conn, result.conn)
+		})
+	}
+}
+
+func TestAcceptPlaintextHandshake(t *testing.T) {
+	tests := []struct {
+		allowed uint32
+		fails   bool
+	}{
+		{CryptoPlaintext | CryptoRC4, false},
+		{CryptoRC4, true},
+	}
+
+	for _, test := range tests {
+		initiator, receiver := connPair(t)
+		handshake := append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+		go initiator.Write(handshake)
+
+		conn, infoHash, err := Accept(receiver, nil, test.allowed)
+		if test.fails {
+			if err == nil {
+				t.Errorf("expected an error accepting with methods %#x, but got none", test.allowed)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if infoHash != nil || conn.Encrypted() {
+			t.Errorf("expected a plaintext connection without infohash, got %x and encrypted %t", infoHash, conn.Encrypted())
+		}
+
+		// The peeked handshake is still there to read
+		received := make([]byte, len(handshake))
+		if _, err := io.ReadFull(conn, received); err != nil || !bytes.Equal(received, handshake) {
+			t.Errorf("expected the handshake to be read back, got %q (%v)", received, err)
+		}
+	}
+}
+
+// connPair returns both ends of a TCP connection on the loopback interface
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer listener.Close()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("unexpected error accepting: %v", err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+
+	return dialed, accepted
+}
+
+// exchange sends data both ways after the handshake
+func exchange(t *testing.T, a, b net.Conn) {
+	t.Helper()
+
+	for _, pair := range [][2]net.Conn{{a, b}, {b, a}} {
+		message := []byte("\x13BitTorrent protocol follows the handshake")
+		go pair[0].Write(message)
+
+		received := make([]byte, len(message))
+		if _, err := io.ReadFull(pair[1], received); err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if !bytes.Equal(received, message) {
+			t.Errorf("expected %q, got %q", message, received)
+		}
+	}
+}
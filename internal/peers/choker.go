@@ -0,0 +1,122 @@
+package peers
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	ChokeInterval          = 10 * time.Second
+	OptimisticRounds       = 3               // The optimistic unchoke rotates every third round, i.e. every 30 seconds
+	NewPeerPeriod          = 1 * time.Minute // Peers connected for less than this are favored for the optimistic unchoke
+	newPeerOptimisticBoost = 3
+)
+
+// chokeCandidate is a snapshot of a peer used to make choking decisions
+type chokeCandidate struct {
+	session    *session
+	interested bool
+	snubbed    bool
+	rate       float64
+	isNew      bool
+}
+
+// RunChoker periodically decides which peers we upload to, unchoking the peers with the best rates
+// plus one optimistic unchoke that rotates so new peers get a chance to prove themselves
+func (sw *Swarm) RunChoker(ctx context.Context) {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+
+	round := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			sw.chokeRound(round%OptimisticRounds == 0)
+			round++
+		case <-sw.rechoke:
+			sw.chokeRound(false)
+		}
+	}
+}
+
+// chokeRound ranks the peers by rate and sends CHOKE/UNCHOKE to the peers whose state changes, snubbed
+// peers are left out of the regular slots but can still get the optimistic unchoke
+func (sw *Swarm) chokeRound(rotateOptimistic bool) {
+	seeding := sw.pm.HasAllWantedPieces()
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	candidates := make([]chokeCandidate, 0, len(sw.sessions))
+	for _, s := range sw.sessions {
+		candidate := chokeCandidate{
+			session:    s,
+			interested: s.isPeerInterested(),
+			snubbed:    s.isSnubbed(),
+			rate:       s.download.Rate(),
+			isNew:      time.Since(s.connectedAt) < NewPeerPeriod,
+		}
+		// When seeding nobody uploads to us, so peers are ranked by how fast they take our data
+		if seeding {
+			candidate.rate = s.upload.Rate()
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].rate > candidates[j].rate })
+
+	unchoke := make(map[string]bool)
+	slots := sw.config.UploadSlots
+	for _, c := range candidates {
+		if slots == 0 {
+			break
+		}
+		if c.interested && !c.snubbed {
+			unchoke[c.session.peer.Address] = true
+			slots--
+		}
+	}
+
+	current, connected := sw.sessions[sw.optimistic]
+	if rotateOptimistic || !connected || !current.isPeerInterested() || unchoke[sw.optimistic] {
+		sw.optimistic = pickOptimistic(candidates, unchoke)
+		if sw.optimistic != "" {
+			log.Printf("Optimistic unchoke: %s", sw.optimistic)
+		}
+	}
+	if sw.optimistic != "" {
+		unchoke[sw.optimistic] = true
+	}
+
+	for _, c := range candidates {
+		c.session.setChoking(!unchoke[c.session.peer.Address])
+	}
+}
+
+// pickOptimistic picks a random interested peer that is not already unchoked, new peers are weighted higher
+func pickOptimistic(candidates []chokeCandidate, unchoke map[string]bool) string {
+	var pool []string
+	for _, c := range candidates {
+		if !c.interested || unchoke[c.session.peer.Address] {
+			continue
+		}
+		weight := 1
+		if c.isNew {
+			weight = newPeerOptimisticBoost
+		}
+		for range weight {
+			pool = append(pool, c.session.peer.Address)
+		}
+	}
+
+	if len(pool) == 0 {
+		return ""
+	}
+
+	return pool[rand.Intn(len(pool))]
+}
@@ -0,0 +1,118 @@
+package peers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/ParamvirSran/GoTorrent/internal/bencode"
+)
+
+const (
+	ExtendedHandshakeID = 0 // Extended message ID of the extension handshake
+
+	clientVersion = "GoTorrent"
+
+	_keyMessages     = "m"
+	_keyVersion      = "v"
+	_keyListenPort   = "p"
+	_keyMetadataSize = "metadata_size"
+	_keyUTPex        = "ut_pex"
+	_keyUTMetadata   = "ut_metadata"
+)
+
+// Extended message IDs we assign to the extensions we support, peers send them to us with these IDs
+const (
+	extPexID      = 1
+	extMetadataID = 2
+)
+
+// sendExtendedHandshake tells the peer which extensions we support and the message IDs it should use for them
+func (s *session) sendExtendedHandshake() error {
+	extensions := make(map[string]any)
+	if s.swarm.config.PeerExchange {
+		extensions[_keyUTPex] = extPexID
+	}
+
+	handshake := map[string]any{
+		_keyMessages: extensions,
+		_keyVersion:  clientVersion,
+	}
+	if s.swarm.metadata != nil {
+		extensions[_keyUTMetadata] = extMetadataID
+		handshake[_keyMetadataSize] = len(s.swarm.metadata)
+	}
+
+	payload, err := bencode.Encode(handshake)
+	if err != nil {
+		return fmt.Errorf("error encoding extension handshake: %v", err)
+	}
+
+	if _, err := s.conn.Write(ExtendedMessage(ExtendedHandshakeID, payload)); err != nil {
+		return fmt.Errorf("error sending extension handshake: %v", err)
+	}
+
+	return nil
+}
+
+// handleExtended handles an extension protocol message
+func (s *session) handleExtended(payload []byte) error {
+	if len(payload) < 1 {
+		return fmt.Errorf("invalid EXTENDED message length %d", len(payload))
+	}
+
+	switch payload[0] {
+	case ExtendedHandshakeID:
+		return s.handleExtendedHandshake(payload[1:])
+	case extPexID:
+		if !s.swarm.config.PeerExchange {
+			return nil
+		}
+		return s.handlePex(payload[1:])
+	case extMetadataID:
+		if s.swarm.metadata == nil {
+			return nil
+		}
+		return s.handleMetadata(payload[1:])
+	default:
+		log.Printf("%s - Received unknown extended message ID %d", s.peer.Address, payload[0])
+	}
+
+	return nil
+}
+
+// handleExtendedHandshake records the extended message IDs the peer assigned, a later handshake can change or
+// disable them with an ID of 0. The port the peer listens on is kept so it can be advertised with ut_pex
+func (s *session) handleExtendedHandshake(payload []byte) error {
+	data, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("invalid extension handshake: %v", err)
+	}
+
+	dict, ok := data.(map[string]any)
+	if !ok {
+		return fmt.Errorf("invalid extension handshake: expected a dictionary but got %T", data)
+	}
+
+	extensions, _ := dict[_keyMessages].(map[string]any)
+	for name, value := range extensions {
+		id, ok := value.(int)
+		if !ok || id < 0 || id > 255 {
+			continue
+		}
+		if id == 0 {
+			delete(s.extensions, name)
+		} else {
+			s.extensions[name] = id
+		}
+	}
+
+	if port, ok := dict[_keyListenPort].(int); ok && port > 0 && port <= 65535 {
+		s.setListenPort(port)
+	}
+
+	version, _ := dict[_keyVersion].(string)
+	log.Printf("%s - Received extension handshake from %q with extensions %v", s.peer.Address, version, s.extensions)
+
+	return nil
+}
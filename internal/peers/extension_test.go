@@ -0,0 +1,43 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestHandleExtendedHandshake(t *testing.T) {
+	s := &session{peer: &types.Peer{Address: "10.0.0.1:6881"}, extensions: map[string]int{_keyUTMetadata: 3}}
+
+	if err := s.handleExtendedHandshake([]byte("d1:md6:ut_pexi1e11:ut_metadatai0ee1:pi6882e1:v4:teste")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(s.extensions) != 1 || s.extensions[_keyUTPex] != 1 {
+		t.Errorf("expected only ut_pex with ID 1, got %v", s.extensions)
+	}
+	if s.listenPort != 6882 {
+		t.Errorf("expected listen port 6882, got %d", s.listenPort)
+	}
+}
+
+func TestHandleExtendedHandshakeInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"not bencoded", "garbage"},
+		{"not a dictionary", "li1ee"},
+		{"negative string length", "d1:md-1:xi1eee"},
+		{"string length beyond the payload", "d1:v4294967296:GoTorrente"},
+		{"truncated", "d1:md6:ut_pexi1e"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &session{peer: &types.Peer{Address: "10.0.0.1:6881"}, extensions: make(map[string]int)}
+			if err := s.handleExtendedHandshake([]byte(test.payload)); err == nil {
+				t.Errorf("expected an error, but got none")
+			}
+		})
+	}
+}
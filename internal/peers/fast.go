@@ -0,0 +1,128 @@
+package peers
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+const AllowedFastCount = 10 // Pieces in the allowed fast set we give every fast extension peer
+
+// AllowedFastSet generates the allowed fast set of a peer with the algorithm of BEP 6, the set only depends on the
+// /24 network of the peer so reconnecting does not get a peer more pieces. Only IPv4 peers have a set
+func AllowedFastSet(count int, ip net.IP, infoHash []byte, pieceCount int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || pieceCount <= 0 {
+		return nil
+	}
+	count = min(count, pieceCount)
+
+	x := append([]byte{ip4[0], ip4[1], ip4[2], 0}, infoHash...)
+	hash := sha1.Sum(x)
+
+	set := make([]int, 0, count)
+	seen := make(map[int]bool, count)
+	for len(set) < count {
+		for i := 0; i < sha1.Size/4 && len(set) < count; i++ {
+			index := int(binary.BigEndian.Uint32(hash[i*4:]) % uint32(pieceCount))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+		hash = sha1.Sum(hash[:])
+	}
+
+	return set
+}
+
+// sendAllowedFast gives the peer its allowed fast set, the pieces it may request from us while we choke it. No set
+// is given while superseeding, it would tell the peer about pieces that were not revealed to it
+func (s *session) sendAllowedFast() error {
+	if s.superseed {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(s.peer.Address)
+	if err != nil {
+		return nil
+	}
+
+	for _, index := range AllowedFastSet(AllowedFastCount, net.ParseIP(host), s.swarm.infoHash, s.pm.PieceCount) {
+		if _, err := s.conn.Write(AllowedFastMessage(uint32(index))); err != nil {
+			return fmt.Errorf("error sending ALLOWED FAST message for piece %d: %v", index, err)
+		}
+		s.allowedFast[index] = struct{}{}
+	}
+
+	return nil
+}
+
+// reject tells a fast extension peer that we will not serve one of its requests
+func (s *session) reject(index, begin, length int) error {
+	if !s.fast {
+		return nil
+	}
+
+	if _, err := s.conn.Write(RejectMessage(uint32(index), uint32(begin), uint32(length))); err != nil {
+		return fmt.Errorf("error sending REJECT message for piece %d, offset %d: %v", index, begin, err)
+	}
+
+	return nil
+}
+
+// handleFastMessage handles the messages of the fast extension, they end the connection when the extension was
+// not negotiated
+func (s *session) handleFastMessage(msg types.Message) error {
+	peer := s.peer
+	if !s.fast {
+		return fmt.Errorf("received fast extension message %d without negotiating the fast extension", *msg.ID)
+	}
+
+	switch *msg.ID {
+	case types.MsgHaveAll:
+		log.Printf("%s - Received HAVE ALL message", peer.Address)
+		peer.Bitfield.SetAll(s.pm.PieceCount)
+		s.setSeed(true)
+	case types.MsgHaveNone:
+		log.Printf("%s - Received HAVE NONE message", peer.Address)
+		clear(peer.Bitfield)
+		s.setSeed(false)
+	case types.MsgSuggest:
+		if len(msg.Payload) < 4 {
+			return fmt.Errorf("invalid SUGGEST PIECE message length %d", len(msg.Payload))
+		}
+		// Suggestions are only advisory, our own piece picking already favours what the swarm needs
+		log.Printf("%s - Received SUGGEST PIECE message for piece %d", peer.Address, binary.BigEndian.Uint32(msg.Payload))
+	case types.MsgReject:
+		if len(msg.Payload) < 12 {
+			return fmt.Errorf("invalid REJECT message length %d", len(msg.Payload))
+		}
+		request := types.BlockRequest{
+			Index:  int(binary.BigEndian.Uint32(msg.Payload[0:4])),
+			Begin:  int(binary.BigEndian.Uint32(msg.Payload[4:8])),
+			Length: int(binary.BigEndian.Uint32(msg.Payload[8:12])),
+		}
+		log.Printf("%s - Received REJECT message for index %d, begin %d, length %d", peer.Address, request.Index, request.Begin, request.Length)
+
+		// The block goes back to the pool right away instead of waiting for the snub timeout
+		if _, requested := s.outstanding[request]; requested {
+			delete(s.outstanding, request)
+			s.pm.ReleaseBlock(peer.Address, request)
+		}
+	case types.MsgAllowedFast:
+		if len(msg.Payload) < 4 {
+			return fmt.Errorf("invalid ALLOWED FAST message length %d", len(msg.Payload))
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload))
+		if index < s.pm.PieceCount {
+			s.peerAllowedFast[index] = struct{}{}
+		}
+	}
+
+	return nil
+}
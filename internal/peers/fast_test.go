@@ -0,0 +1,113 @@
+package peers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, 20)
+
+	// Example sets from BEP 6
+	tests := []struct {
+		name       string
+		count      int
+		ip         string
+		pieceCount int
+		expected   []int
+	}{
+		{"seven pieces", 7, "80.4.4.200", 1313, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"nine pieces", 9, "80.4.4.200", 1313, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}},
+		{"same /24 network", 7, "80.4.4.1", 1313, []int{1059, 431, 808, 1217, 287, 376, 1188}},
+		{"fewer pieces than the count", 10, "80.4.4.200", 3, nil},
+		{"IPv6 peer", 7, "2001:db8::1", 1313, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := AllowedFastSet(test.count, net.ParseIP(test.ip), infoHash, test.pieceCount)
+			if test.pieceCount < test.count {
+				sorted := slices.Sorted(slices.Values(result))
+				if !slices.Equal(sorted, []int{0, 1, 2}) {
+					t.Errorf("expected every piece once, got %v", result)
+				}
+				return
+			}
+			if !slices.Equal(result, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestSendAllowedFastSuperseeding(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	sw := NewSwarm(types.NewPieceManager(20, types.BlockSize, 20*types.BlockSize), bytes.Repeat([]byte{0xaa}, 20), nil, DefaultConfig())
+	s := &session{
+		conn:        local,
+		peer:        &types.Peer{Address: "80.4.4.200:6881"},
+		pm:          sw.pm,
+		swarm:       sw,
+		fast:        true,
+		allowedFast: make(map[int]struct{}),
+		superseed:   true,
+	}
+
+	// Nothing reads the other end of the pipe, so a message sent would block the test
+	if err := s.sendAllowedFast(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(s.allowedFast) != 0 {
+		t.Errorf("expected no allowed fast pieces while superseeding, got %v", s.allowedFast)
+	}
+}
+
+func TestChokeKeepsFastRequests(t *testing.T) {
+	for _, fast := range []bool{true, false} {
+		pm := types.NewPieceManager(1, 2*types.BlockSize, 2*types.BlockSize)
+		pm.AddPiece(0, make([]byte, 20))
+		bitfield := types.NewBitfield(1)
+		bitfield.SetPiece(0)
+
+		peer := &types.Peer{Address: "10.0.0.1:6881"}
+		s := &session{peer: peer, pm: pm, fast: fast, outstanding: make(map[types.BlockRequest]struct{})}
+		requests := pm.RequestBlocks(bitfield, peer.Address, 2)
+		for _, request := range requests {
+			s.outstanding[request] = struct{}{}
+		}
+
+		choke := types.MsgChoke
+		if err := s.handleMessage(types.NewMessage(&choke, nil)); err != nil {
+			t.Fatalf("fast %t: unexpected error: %v", fast, err)
+		}
+		if !fast {
+			if len(s.outstanding) != 0 {
+				t.Errorf("fast %t: expected every request to be released on choke, got %v", fast, s.outstanding)
+			}
+			continue
+		}
+
+		// A fast extension peer keeps the requests until it rejects them
+		if len(s.outstanding) != 2 {
+			t.Fatalf("fast %t: expected 2 outstanding requests after choke, got %v", fast, s.outstanding)
+		}
+		reject := types.MsgReject
+		payload := make([]byte, 12)
+		binary.BigEndian.PutUint32(payload[4:8], uint32(requests[0].Begin))
+		binary.BigEndian.PutUint32(payload[8:12], uint32(requests[0].Length))
+		if err := s.handleMessage(types.NewMessage(&reject, payload)); err != nil {
+			t.Fatalf("fast %t: unexpected error: %v", fast, err)
+		}
+		if _, ok := s.outstanding[requests[0]]; ok || len(s.outstanding) != 1 {
+			t.Errorf("fast %t: expected only the rejected request to be released, got %v", fast, s.outstanding)
+		}
+	}
+}
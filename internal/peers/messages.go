@@ -64,3 +64,42 @@ func PieceMessage(index, begin uint32, block []byte) []byte {
 	buf.Write(block)
 	return buf.Bytes()
 }
+
+// BitfieldMessage creates a BITFIELD message
+func BitfieldMessage(bitfield []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(1+len(bitfield)))
+	buf.WriteByte(byte(types.MsgBitfield))
+	buf.Write(bitfield)
+	return buf.Bytes()
+}
+
+// ExtendedMessage creates an extension protocol message with the extended message ID the receiver assigned
+func ExtendedMessage(extendedID byte, payload []byte) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(2+len(payload)))
+	buf.WriteByte(byte(types.MsgExtended))
+	buf.WriteByte(extendedID)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// RejectMessage creates a REJECT REQUEST message, the fast extension answer to a request we will not serve
+func RejectMessage(index, begin, length uint32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(13))
+	buf.WriteByte(byte(types.MsgReject))
+	binary.Write(buf, binary.BigEndian, index)
+	binary.Write(buf, binary.BigEndian, begin)
+	binary.Write(buf, binary.BigEndian, length)
+	return buf.Bytes()
+}
+
+// AllowedFastMessage creates an ALLOWED FAST message for a piece the peer may request while we choke it
+func AllowedFastMessage(pieceIndex uint32) []byte {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.BigEndian, uint32(5))
+	buf.WriteByte(byte(types.MsgAllowedFast))
+	binary.Write(buf, binary.BigEndian, pieceIndex)
+	return buf.Bytes()
+}
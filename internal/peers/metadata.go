@@ -0,0 +1,94 @@
+package peers
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/ParamvirSran/GoTorrent/internal/bencode"
+)
+
+const (
+	MetadataPieceSize = 16 << 10 // Bytes of the info dictionary in a ut_metadata piece, the last piece can be shorter
+
+	_keyMsgType   = "msg_type"
+	_keyPiece     = "piece"
+	_keyTotalSize = "total_size"
+)
+
+// Types of ut_metadata messages
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// metadataResponse builds the answer to a ut_metadata message, the requested piece of the metadata or a reject
+// for a piece it does not have. Messages other than requests need no answer and get nil
+func metadataResponse(metadata, payload []byte) ([]byte, error) {
+	data, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode ut_metadata message: %w", err)
+	}
+
+	dict, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid ut_metadata message: expected a dictionary but got %T", data)
+	}
+	msgType, ok := dict[_keyMsgType].(int)
+	if !ok {
+		return nil, fmt.Errorf("invalid ut_metadata message: %s missing or not an integer", _keyMsgType)
+	}
+	piece, ok := dict[_keyPiece].(int)
+	if !ok {
+		return nil, fmt.Errorf("invalid ut_metadata message: %s missing or not an integer", _keyPiece)
+	}
+	if msgType != metadataRequest {
+		return nil, nil
+	}
+
+	// The piece is checked before it is multiplied so a huge index can not overflow into a valid offset
+	if piece < 0 || piece >= (len(metadata)+MetadataPieceSize-1)/MetadataPieceSize {
+		return bencode.Encode(map[string]any{
+			_keyMsgType: metadataReject,
+			_keyPiece:   piece,
+		})
+	}
+	begin := piece * MetadataPieceSize
+	end := min(begin+MetadataPieceSize, len(metadata))
+
+	header, err := bencode.Encode(map[string]any{
+		_keyMsgType:   metadataData,
+		_keyPiece:     piece,
+		_keyTotalSize: len(metadata),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(header, metadata[begin:end]...), nil
+}
+
+// handleMetadata answers ut_metadata requests of the peer, we never request metadata so data and rejects are
+// only logged
+func (s *session) handleMetadata(payload []byte) error {
+	id, supported := s.extensions[_keyUTMetadata]
+	if !supported {
+		return nil
+	}
+
+	response, err := metadataResponse(s.swarm.metadata, payload)
+	if err != nil {
+		return fmt.Errorf("invalid ut_metadata message: %v", err)
+	}
+	if response == nil {
+		log.Printf("%s - Ignoring ut_metadata message that is not a request", s.peer.Address)
+		return nil
+	}
+
+	if _, err := s.conn.Write(ExtendedMessage(byte(id), response)); err != nil {
+		return fmt.Errorf("error sending ut_metadata message: %v", err)
+	}
+
+	return nil
+}
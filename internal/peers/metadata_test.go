@@ -0,0 +1,45 @@
+package peers
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetadataResponse(t *testing.T) {
+	metadata := bytes.Repeat([]byte{'x'}, MetadataPieceSize+100)
+
+	tests := []struct {
+		name     string
+		request  string
+		expected []byte
+		fails    bool
+	}{
+		{"first piece", "d8:msg_typei0e5:piecei0ee", append([]byte("d8:msg_typei1e5:piecei0e10:total_sizei16484ee"), metadata[:MetadataPieceSize]...), false},
+		{"last piece", "d8:msg_typei0e5:piecei1ee", append([]byte("d8:msg_typei1e5:piecei1e10:total_sizei16484ee"), metadata[MetadataPieceSize:]...), false},
+		{"missing piece", "d8:msg_typei0e5:piecei2ee", []byte("d8:msg_typei2e5:piecei2ee"), false},
+		{"overflowing piece", "d8:msg_typei0e5:piecei1125899906842623ee", []byte("d8:msg_typei2e5:piecei1125899906842623ee"), false},
+		{"negative piece", "d8:msg_typei0e5:piecei-1ee", []byte("d8:msg_typei2e5:piecei-1ee"), false},
+		{"reject", "d8:msg_typei2e5:piecei0ee", nil, false},
+		{"no piece", "d8:msg_typei0ee", nil, true},
+		{"not a dictionary", "i0e", nil, true},
+		{"negative string length", "d-1:msg_typei0e5:piecei0ee", nil, true},
+		{"string length beyond the payload", "d4294967296:msg_typei0e5:piecei0ee", nil, true},
+	}
+
+	for _, test := range tests {
+		result, err := metadataResponse(metadata, []byte(test.request))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error, but got none", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(result, test.expected) {
+			t.Errorf("%s: expected %.60q, got %.60q", test.name, test.expected, result)
+		}
+	}
+}
@@ -11,49 +11,36 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ParamvirSran/GoTorrent/internal/mse"
 	"github.com/ParamvirSran/GoTorrent/internal/types"
+	"github.com/ParamvirSran/GoTorrent/internal/utp"
 )
 
 const (
 	HandshakeResponseLength = 68
 	KeepAliveInterval       = 30 * time.Second
 	PeerTimeout             = 120 * time.Second
-	BlockSize               = 16384
+	BlockSize               = types.BlockSize
+	MaxBacklog              = 5                     // Maximum number of unanswered block requests we pipeline to a peer
+	MaxRequestLength        = 131072                // Largest block a peer may request from us
+	MaxMessageLength        = MaxRequestLength + 13 // Largest message other than a bitfield, a piece message of the largest block
+	SnubCheckInterval       = 5 * time.Second
+	UTPDialTimeout          = 5 * time.Second // How long a uTP connection may take before we try TCP instead
 )
 
-// HandlePeerConnection manages a single peer connection
-func HandlePeerConnection(pm *types.PieceManager, ctx context.Context, peerID string, infoHash, clientID []byte, peerAddress string) error {
-	peerContext, peerCancel := context.WithCancel(ctx)
-	defer peerCancel()
-
-	peer := createPeer(peerID, peerAddress)
-	handshake, err := types.NewHandshake(infoHash, clientID)
-	if err != nil {
-		return fmt.Errorf("error creating handshake: %v", err)
-	}
-
-	conn, err := connectToPeer(peerContext, peer.Address)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	if err := sendHandshake(conn, handshake); err != nil {
-		return err
-	}
-
-	if err := receiveHandshakeResponse(peerID, conn, infoHash); err != nil {
-		return err
+// connectToPeer establishes a connection to the peer, over uTP when the swarm has a uTP socket and over TCP when
+// that fails
+func (sw *Swarm) connectToPeer(ctx context.Context, address string) (net.Conn, error) {
+	if sw.utp != nil {
+		utpContext, cancel := context.WithTimeout(ctx, UTPDialTimeout)
+		conn, err := sw.utp.Dial(utpContext, address)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		log.Printf("%s - Falling back to TCP: %v", address, err)
 	}
 
-	stopKeepAlive := startKeepAlive(peerContext, conn)
-	defer stopKeepAlive()
-
-	return processMessages(peerContext, conn, peer, pm)
-}
-
-// connectToPeer establishes a connection to the peer
-func connectToPeer(ctx context.Context, address string) (net.Conn, error) {
 	var d net.Dialer
 	conn, err := d.DialContext(ctx, "tcp", address)
 	if err != nil {
@@ -70,19 +57,21 @@ func sendHandshake(conn net.Conn, handshake []byte) error {
 	return nil
 }
 
-// receiveHandshakeResponse reads and validates the handshake response from the peer
-func receiveHandshakeResponse(peerID string, conn net.Conn, infoHash []byte) error {
+// receiveHandshakeResponse reads and validates the handshake response from the peer, it returns the reserved
+// bytes and the peer ID of the peer. The whole handshake is read since extension messages can follow it right away
+func receiveHandshakeResponse(conn net.Conn, infoHash []byte) ([8]byte, string, error) {
 	response := make([]byte, HandshakeResponseLength)
 	conn.SetReadDeadline(time.Now().Add(PeerTimeout))
-	n, err := conn.Read(response)
+	n, err := io.ReadFull(conn, response)
 	if err != nil {
-		return fmt.Errorf("failed to read handshake response: %v", err)
+		return [8]byte{}, "", fmt.Errorf("failed to read handshake response: %v", err)
 	}
 
-	if err := types.ValidateHandshakeResponse(response[:n], [20]byte(infoHash)); err != nil {
-		return fmt.Errorf("invalid handshake response: %v", err)
+	reserved, err := types.ValidateHandshakeResponse(response[:n], [20]byte(infoHash))
+	if err != nil {
+		return [8]byte{}, "", fmt.Errorf("invalid handshake response: %v", err)
 	}
-	return nil
+	return reserved, string(response[48:68]), nil
 }
 
 // startKeepAlive starts a goroutine to send keep-alive messages to the peer
@@ -108,174 +97,548 @@ func startKeepAlive(ctx context.Context, conn net.Conn) func() {
 	return func() { once.Do(cancel) }
 }
 
+// session holds the state of a single connected peer
+type session struct {
+	ctx         context.Context
+	conn        net.Conn
+	peer        *types.Peer
+	pm          *types.PieceManager
+	swarm       *Swarm
+	connectedAt time.Time
+	outstanding map[types.BlockRequest]struct{} // Blocks requested from the peer and not yet received
+	chokes      chan bool                       // Choking decisions from the choker
+	haves       chan int                        // Pieces we finished that the peer has to be told about
+
+	download    rateMeter // Bytes of blocks received from the peer
+	upload      rateMeter // Bytes of blocks sent to the peer
+	lastBlockAt time.Time // When the peer last delivered a block or started owing us one
+	uselessAt   time.Time // When the peer stopped being useful, zero while it is useful
+
+	incoming  bool // The peer connected to us
+	overUTP   bool // The connection runs over uTP instead of TCP
+	encrypted bool // The connection is RC4 encrypted with MSE
+
+	fast            bool             // Both sides support the fast extension
+	allowedFast     map[int]struct{} // Pieces the peer may request while we choke it
+	peerAllowedFast map[int]struct{} // Pieces we may request while the peer chokes us
+
+	extended      bool            // The peer supports the extension protocol
+	extensions    map[string]int  // Extended message IDs the peer assigned in its extension handshake, by name
+	pexSent       map[string]byte // Peers we told the peer about with ut_pex and their flags
+	pexReceivedAt time.Time       // When the peer last sent us a ut_pex message
+
+	superseed bool             // We hide our pieces and reveal them to the peer one at a time (BEP 16)
+	revealed  map[int]struct{} // Pieces revealed to the peer while superseeding
+	counted   types.Bitfield   // Pieces of the peer counted in the availability of the swarm while superseeding
+	reveal    chan struct{}    // Signals that the piece offered to the peer was seen at another peer
+
+	mu         sync.Mutex // Guards the state below which the choker and swarm read from their own goroutines
+	snubbed    bool
+	seed       bool // The peer has every piece
+	listenPort int  // Port the peer accepts connections on from its extension handshake, 0 when unknown
+}
+
 // processMessages processes incoming messages from the peer
-func processMessages(ctx context.Context, conn net.Conn, peer *types.Peer, pm *types.PieceManager) error {
-	lastActivity := time.Now()
+func (sw *Swarm) processMessages(ctx context.Context, conn net.Conn, peer *types.Peer, reserved [8]byte, incoming bool) error {
+	pm := sw.pm
+	s := &session{
+		ctx:             ctx,
+		conn:            conn,
+		peer:            peer,
+		pm:              pm,
+		swarm:           sw,
+		connectedAt:     time.Now(),
+		outstanding:     make(map[types.BlockRequest]struct{}),
+		chokes:          make(chan bool, 1),
+		haves:           make(chan int, pm.PieceCount),
+		incoming:        incoming,
+		overUTP:         isUTP(conn),
+		encrypted:       isEncrypted(conn),
+		fast:            types.SupportsFast(reserved),
+		allowedFast:     make(map[int]struct{}),
+		peerAllowedFast: make(map[int]struct{}),
+		extended:        types.SupportsExtensions(reserved),
+		extensions:      make(map[string]int),
+		pexSent:         make(map[string]byte),
+		superseed:       sw.superseeding(),
+		revealed:        make(map[int]struct{}),
+		counted:         types.NewBitfield(pm.PieceCount),
+		reveal:          make(chan struct{}, 1),
+	}
+	if err := sw.addSession(s); err != nil {
+		return err
+	}
+	defer sw.removeSession(s)
+
+	cancels := pm.RegisterPeer(peer.Address)
+	defer pm.UnregisterPeer(peer.Address)
+
+	if err := s.sendBitfield(); err != nil {
+		return err
+	}
+	if s.fast {
+		if err := s.sendAllowedFast(); err != nil {
+			return err
+		}
+	}
+	if s.extended {
+		if err := s.sendExtendedHandshake(); err != nil {
+			return err
+		}
+	}
+	if s.superseed {
+		if err := s.offerPiece(); err != nil {
+			return err
+		}
+	}
+
+	snubTicker := time.NewTicker(SnubCheckInterval)
+	defer snubTicker.Stop()
+	pexTicker := time.NewTicker(PexInterval)
+	defer pexTicker.Stop()
+
+	messages, readErrors := readMessages(ctx, conn, maxMessageLength(s.pm.PieceCount))
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("Disconnecting from peer: %s", peer.Address)
 			return nil
-		default:
-			conn.SetReadDeadline(time.Now().Add(PeerTimeout))
-			msg, err := ReadMessage(conn)
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					continue
+		case <-snubTicker.C:
+			if err := s.checkSnubbed(); err != nil {
+				return err
+			}
+		case <-pexTicker.C:
+			if err := s.sendPex(); err != nil {
+				return err
+			}
+		case err := <-readErrors:
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("peer %s closed the connection", peer.Address)
+			}
+			return fmt.Errorf("error reading message: %v", err)
+		case request := <-cancels:
+			if err := s.cancelRequest(request); err != nil {
+				return err
+			}
+		case <-s.reveal:
+			if err := s.offerPiece(); err != nil {
+				return err
+			}
+		case choking := <-s.chokes:
+			if err := s.applyChoke(choking); err != nil {
+				return err
+			}
+		case index := <-s.haves:
+			if _, err := conn.Write(HaveMessage(uint32(index))); err != nil {
+				return fmt.Errorf("error sending HAVE message for piece %d: %v", index, err)
+			}
+			if err := s.requestBlocks(); err != nil {
+				return err
+			}
+		case msg := <-messages:
+			if msg.ID == nil {
+				continue
+			}
+			if err := s.handleMessage(msg); err != nil {
+				return err
+			}
+			if s.superseed {
+				if err := s.updatePieces(*msg.ID); err != nil {
+					return err
 				}
-				return fmt.Errorf("error reading message: %v", err)
 			}
+			if err := s.requestBlocks(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readMessages reads messages from the connection on its own goroutine until a read fails or the context ends
+func readMessages(ctx context.Context, conn net.Conn, maxLength uint32) (<-chan types.Message, <-chan error) {
+	messages := make(chan types.Message)
+	readErrors := make(chan error, 1)
 
-			if msg.ID != nil {
-				handleMessage(conn, ctx, pm, peer, msg)
-				lastActivity = time.Now()
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(PeerTimeout))
+			msg, err := ReadMessage(conn, maxLength)
+			if err != nil {
+				readErrors <- err
+				return
 			}
 
-			if time.Since(lastActivity) > PeerTimeout {
-				return fmt.Errorf("peer %s timed out", peer.Address)
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
 			}
 		}
-	}
+	}()
+
+	return messages, readErrors
 }
 
 // handleMessage handles a received message
-func handleMessage(conn net.Conn, ctx context.Context, pm *types.PieceManager, peer *types.Peer, msg types.Message) {
+func (s *session) handleMessage(msg types.Message) error {
+	peer := s.peer
+
 	switch *msg.ID {
 	case types.MsgChoke:
+		// A choking peer discards our requests so they are released for other peers. Fast extension peers send a
+		// REJECT for every request they discard (BEP 6), so their requests are kept until it arrives
 		peer.PeerState.PeerChoking = true
+		if !s.fast {
+			s.pm.ReleaseRequests(peer.Address)
+			clear(s.outstanding)
+		}
 	case types.MsgUnchoke:
 		peer.PeerState.PeerChoking = false
-	case types.MsgInterested:
-		peer.PeerState.PeerInterested = true
-	case types.MsgNotInterested:
-		peer.PeerState.PeerInterested = false
+		s.lastBlockAt = time.Now()
+	case types.MsgInterested, types.MsgNotInterested:
+		s.mu.Lock()
+		changed := peer.PeerState.PeerInterested != (*msg.ID == types.MsgInterested)
+		peer.PeerState.PeerInterested = *msg.ID == types.MsgInterested
+		s.mu.Unlock()
+
+		// An upload slot may open up or be wanted, so the choker reconsiders right away
+		if changed {
+			s.swarm.requestRechoke()
+		}
 	case types.MsgHave:
+		if len(msg.Payload) < 4 {
+			return fmt.Errorf("invalid HAVE message length %d", len(msg.Payload))
+		}
 		pieceIndex := binary.BigEndian.Uint32(msg.Payload)
 		log.Printf("%s - Received HAVE message for piece %d", peer.Address, pieceIndex)
-		if pm.ClaimPiece(int(pieceIndex)) {
-			worker(peer, ctx, pm, pieceIndex, conn)
-		}
+		peer.Bitfield.SetPiece(int(pieceIndex))
+		s.setSeed(peer.Bitfield.IsComplete(s.pm.PieceCount))
 	case types.MsgBitfield:
 		log.Printf("%s - Received BITFIELD message: %x", peer.Address, msg.Payload)
+		copy(peer.Bitfield, msg.Payload)
+		s.setSeed(peer.Bitfield.IsComplete(s.pm.PieceCount))
 	case types.MsgRequest:
+		if len(msg.Payload) < 12 {
+			return fmt.Errorf("invalid REQUEST message length %d", len(msg.Payload))
+		}
 		index := binary.BigEndian.Uint32(msg.Payload[0:4])
 		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
 		length := binary.BigEndian.Uint32(msg.Payload[8:12])
 		log.Printf("%s - Received REQUEST message for index %d, begin %d, length %d", peer.Address, index, begin, length)
+		return s.serveRequest(int(index), int(begin), int(length))
 	case types.MsgPiece:
+		if len(msg.Payload) < 8 {
+			return fmt.Errorf("invalid PIECE message length %d", len(msg.Payload))
+		}
 		index := binary.BigEndian.Uint32(msg.Payload[0:4])
 		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
-		block := msg.Payload[8:]
-		log.Printf("%s - Received PIECE message for index %d, begin %d, block length %d", peer.Address, index, begin, len(block))
+		s.handleBlock(int(index), int(begin), msg.Payload[8:])
 	case types.MsgCancel:
+		if len(msg.Payload) < 12 {
+			return fmt.Errorf("invalid CANCEL message length %d", len(msg.Payload))
+		}
 		index := binary.BigEndian.Uint32(msg.Payload[0:4])
 		begin := binary.BigEndian.Uint32(msg.Payload[4:8])
 		length := binary.BigEndian.Uint32(msg.Payload[8:12])
 		log.Printf("%s - Received CANCEL message for index %d, begin %d, length %d", peer.Address, index, begin, length)
 	case types.MsgPort:
+		if len(msg.Payload) < 2 {
+			return fmt.Errorf("invalid PORT message length %d", len(msg.Payload))
+		}
 		port := binary.BigEndian.Uint16(msg.Payload)
 		log.Printf("%s - Received PORT message with port %d", peer.Address, port)
+	case types.MsgExtended:
+		return s.handleExtended(msg.Payload)
+	case types.MsgSuggest, types.MsgHaveAll, types.MsgHaveNone, types.MsgReject, types.MsgAllowedFast:
+		return s.handleFastMessage(msg)
 	default:
 		log.Printf("%s - Received unknown message ID %d", peer.Address, *msg.ID)
 	}
-}
 
-// worker downloads a piece from the peer
-func worker(peer *types.Peer, ctx context.Context, pm *types.PieceManager, index uint32, conn net.Conn) {
-	var offset uint32 = 0
-	piece := make([]byte, pm.PieceSize)
+	return nil
+}
 
-	// Send INTERESTED message to the peer
-	if _, err := conn.Write(FixedLengthMessage(types.MsgInterested)); err != nil {
-		log.Printf("worker: Error sending INTERESTED message: %v", err)
+// handleBlock stores a received block and verifies the piece once its last block has arrived
+func (s *session) handleBlock(index, begin int, block []byte) {
+	request := types.BlockRequest{Index: index, Begin: begin, Length: len(block)}
+	if _, requested := s.outstanding[request]; !requested {
+		// Blocks we cancelled in endgame can still arrive, those are ignored
+		log.Printf("%s - Ignoring unrequested block: index %d, offset %d", s.peer.Address, index, begin)
 		return
 	}
-	peer.PeerState.AmInterested = true
+	delete(s.outstanding, request)
+
+	s.download.Add(len(block))
+	s.swarm.downloaded.Add(int64(len(block)))
+	s.lastBlockAt = time.Now()
+	if s.isSnubbed() {
+		log.Printf("%s - Peer is no longer snubbing us", s.peer.Address)
+		s.setSnubbed(false)
+	}
 
-	// Wait for UNCHOKE message from the peer
-	for {
-		msg, err := ReadMessage(conn)
-		if err != nil {
-			log.Printf("worker: Error reading UNCHOKE message: %v", err)
-			return
+	// Only queues the block, the piece is hashed in the background and Swarm.PieceVerified announces it
+	if err := s.pm.BlockReceived(s.peer.Address, index, begin, block); err != nil {
+		log.Printf("%s - Error storing block: %v", s.peer.Address, err)
+	}
+}
+
+// serveRequest uploads a block to the peer, requests made while we are choking the peer are dropped unless they
+// are for an allowed fast piece. While superseeding only revealed pieces are served. Fast extension peers are told
+// about the requests we do not serve
+func (s *session) serveRequest(index, begin, length int) error {
+	if _, revealed := s.revealed[index]; s.superseed && !revealed {
+		return s.reject(index, begin, length)
+	}
+	if s.peer.PeerState.AmChoking {
+		if _, allowed := s.allowedFast[index]; !s.fast || !allowed {
+			return s.reject(index, begin, length)
+		}
+	}
+	if length <= 0 || length > MaxRequestLength {
+		return fmt.Errorf("invalid REQUEST length %d", length)
+	}
+
+	block, err := s.pm.ReadBlock(index, begin, length)
+	if err != nil {
+		log.Printf("%s - Unable to serve request for index %d, begin %d: %v", s.peer.Address, index, begin, err)
+		return s.reject(index, begin, length)
+	}
+
+	if _, err := s.conn.Write(PieceMessage(uint32(index), uint32(begin), block)); err != nil {
+		return fmt.Errorf("error sending PIECE message for piece %d, offset %d: %v", index, begin, err)
+	}
+
+	s.upload.Add(len(block))
+	s.swarm.uploaded.Add(int64(len(block)))
+
+	return nil
+}
+
+// sendBitfield tells the peer which pieces we have, nothing is sent while we have no pieces or superseed. Fast
+// extension peers get HAVE ALL or HAVE NONE instead when they fit
+func (s *session) sendBitfield() error {
+	if s.superseed {
+		if s.fast {
+			return s.sendFixed(types.MsgHaveNone)
 		}
+		return nil
+	}
 
-		if msg.ID != nil && *msg.ID == types.MsgUnchoke {
-			peer.PeerState.PeerChoking = false
-			break
-		} else if msg.ID != nil && *msg.ID == types.MsgChoke {
-			log.Printf("worker: Peer choked, stopping download of piece %d from peer %s", index, conn.RemoteAddr())
-			return
+	bitfield := s.pm.Bitfield()
+	if s.fast {
+		switch {
+		case len(bitfield) == 0 || s.pm.DownloadedPieces() == 0:
+			return s.sendFixed(types.MsgHaveNone)
+		case bitfield.IsComplete(s.pm.PieceCount):
+			return s.sendFixed(types.MsgHaveAll)
 		}
 	}
+	if len(bitfield) == 0 || s.pm.DownloadedPieces() == 0 {
+		return nil
+	}
 
-	// Download the piece in blocks
-	for offset < uint32(pm.PieceSize) {
-		select {
-		case <-ctx.Done():
-			log.Printf("worker: Context canceled, stopping download of piece %d from peer %s", index, conn.RemoteAddr())
-			return
-		default:
-			// Calculate the block size (usually 16 KB, but smaller for the last block)
-			blockSize := uint32(BlockSize)
-			if offset+blockSize > uint32(pm.PieceSize) {
-				blockSize = uint32(pm.PieceSize) - offset
-			}
+	if _, err := s.conn.Write(BitfieldMessage(bitfield)); err != nil {
+		return fmt.Errorf("error sending BITFIELD message: %v", err)
+	}
 
-			// Send a REQUEST message for the block
-			request := RequestMessage(index, offset, blockSize)
-			if _, err := conn.Write(request); err != nil {
-				log.Printf("worker: Error sending REQUEST message for piece %d, offset %d: %v", index, offset, err)
-				return
-			}
+	return nil
+}
 
-			// Read the PIECE message response
-			msg, err := ReadMessage(conn)
-			if err != nil {
-				log.Printf("worker: Error reading PIECE message for piece %d, offset %d: %v", index, offset, err)
-				return
+// sendFixed sends a message without a payload
+func (s *session) sendFixed(id types.MessageID) error {
+	if _, err := s.conn.Write(FixedLengthMessage(id)); err != nil {
+		return fmt.Errorf("error sending message %d: %v", id, err)
+	}
+
+	return nil
+}
+
+// applyChoke sends CHOKE or UNCHOKE to the peer when the choker changed its mind
+func (s *session) applyChoke(choking bool) error {
+	if s.peer.PeerState.AmChoking == choking {
+		return nil
+	}
+
+	id := types.MsgUnchoke
+	if choking {
+		id = types.MsgChoke
+	}
+	if _, err := s.conn.Write(FixedLengthMessage(id)); err != nil {
+		return fmt.Errorf("error sending choke state to peer: %v", err)
+	}
+	s.peer.PeerState.AmChoking = choking
+	log.Printf("%s - Choking: %t", s.peer.Address, choking)
+
+	return nil
+}
+
+// setChoking hands a choking decision to the session, only the latest decision is kept
+func (s *session) setChoking(choking bool) {
+	select {
+	case <-s.chokes:
+	default:
+	}
+	s.chokes <- choking
+}
+
+// isPeerInterested checks if the peer wants to download from us
+func (s *session) isPeerInterested() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.peer.PeerState.PeerInterested
+}
+
+// isSnubbed checks if the peer has stopped sending us the blocks we requested
+func (s *session) isSnubbed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.snubbed
+}
+
+// isSeed checks if the peer has every piece
+func (s *session) isSeed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.seed
+}
+
+// setSeed updates whether the peer has every piece
+func (s *session) setSeed(seed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seed = seed
+}
+
+// setListenPort records the port the peer accepts connections on
+func (s *session) setListenPort(port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.listenPort = port
+}
+
+// setSnubbed updates the snubbed state of the peer
+func (s *session) setSnubbed(snubbed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snubbed = snubbed
+}
+
+// checkSnubbed marks the peer as snubbed when it unchoked us but has not delivered a requested block for
+// the snub timeout, its outstanding requests are cancelled and handed to other peers. A peer that stays
+// useless to us for the useless peer timeout is disconnected so another peer can take its slot
+func (s *session) checkSnubbed() error {
+	config := s.swarm.config
+	peer := s.peer
+
+	if !peer.PeerState.PeerChoking && len(s.outstanding) > 0 && !s.isSnubbed() && time.Since(s.lastBlockAt) > config.SnubTimeout {
+		log.Printf("%s - Peer snubbed us, reassigning %d outstanding requests", peer.Address, len(s.outstanding))
+		s.setSnubbed(true)
+
+		for request := range s.outstanding {
+			if _, err := s.conn.Write(CancelMessage(uint32(request.Index), uint32(request.Begin), uint32(request.Length))); err != nil {
+				return fmt.Errorf("error sending CANCEL message for piece %d, offset %d: %v", request.Index, request.Begin, err)
 			}
+		}
+		s.pm.ReleaseRequests(peer.Address)
+		clear(s.outstanding)
+		s.lastBlockAt = time.Now()
+	}
 
-			// Handle the PIECE message
-			if msg.ID != nil && *msg.ID == types.MsgPiece {
-				receivedIndex := binary.BigEndian.Uint32(msg.Payload[0:4])
-				receivedBegin := binary.BigEndian.Uint32(msg.Payload[4:8])
-				block := msg.Payload[8:]
+	// Useful peers either give us data or want ours
+	useful := !s.isSnubbed() && (peer.PeerState.AmInterested || s.isPeerInterested())
+	if useful {
+		s.uselessAt = time.Time{}
+		return nil
+	}
+	if s.uselessAt.IsZero() {
+		s.uselessAt = time.Now()
+	}
+	if time.Since(s.uselessAt) > config.UselessPeerTimeout {
+		return fmt.Errorf("peer %s has been useless for %s", peer.Address, config.UselessPeerTimeout)
+	}
 
-				// Verify the block
-				if receivedIndex != index || receivedBegin != offset {
-					log.Printf("worker: Mismatch in received block: expected index %d, offset %d; got index %d, offset %d",
-						index, offset, receivedIndex, receivedBegin)
-					return
-				}
+	return nil
+}
 
-				// Copy the block into the piece
-				copy(piece[offset:offset+blockSize], block)
-				offset += blockSize
-			} else if msg.ID != nil && *msg.ID == types.MsgChoke {
-				// Handle peer choking
-				peer.PeerState.PeerChoking = true
-				log.Printf("worker: Peer choked, stopping download of piece %d from peer %s", index, conn.RemoteAddr())
-				return
-			} else {
-				log.Printf("worker: Unexpected message ID %d", *msg.ID)
-				return
+// requestBlocks declares interest in the peer when it has pieces we need and keeps up to MaxBacklog block requests in flight
+func (s *session) requestBlocks() error {
+	peer := s.peer
+
+	if !peer.PeerState.AmInterested {
+		if !s.pm.IsInteresting(peer.Bitfield) {
+			return nil
+		}
+		if _, err := s.conn.Write(FixedLengthMessage(types.MsgInterested)); err != nil {
+			return fmt.Errorf("error sending INTERESTED message: %v", err)
+		}
+		peer.PeerState.AmInterested = true
+	}
+
+	// A snubbed peer only gets a single request to prove it is sending again
+	backlog := MaxBacklog
+	if s.isSnubbed() {
+		backlog = 1
+	}
+	if len(s.outstanding) >= backlog {
+		return nil
+	}
+
+	// A choking fast extension peer still serves the pieces it allowed us to request
+	available := peer.Bitfield
+	if peer.PeerState.PeerChoking {
+		if !s.fast || len(s.peerAllowedFast) == 0 {
+			return nil
+		}
+		available = types.NewBitfield(s.pm.PieceCount)
+		for index := range s.peerAllowedFast {
+			if peer.Bitfield.HasPiece(index) {
+				available.SetPiece(index)
 			}
 		}
 	}
 
-	// Mark the piece as downloaded and verify it
-	pm.MarkPieceDownloaded(int(index), piece)
-	if err := pm.VerifyPiece(int(index)); err != nil {
-		log.Printf("worker: Verification failed for piece %d: %v", index, err)
-		pm.RequeuePiece(int(index))
-	} else {
-		log.Printf("worker: Successfully downloaded and verified piece %d from peer %s", index, conn.RemoteAddr())
+	if len(s.outstanding) == 0 {
+		s.lastBlockAt = time.Now()
+	}
+	for _, request := range s.pm.RequestBlocks(available, peer.Address, backlog-len(s.outstanding)) {
+		if _, err := s.conn.Write(RequestMessage(uint32(request.Index), uint32(request.Begin), uint32(request.Length))); err != nil {
+			return fmt.Errorf("error sending REQUEST message for piece %d, offset %d: %v", request.Index, request.Begin, err)
+		}
+		s.outstanding[request] = struct{}{}
 	}
+
+	return nil
 }
 
-// ReadMessage reads a message from a connection
-func ReadMessage(conn net.Conn) (types.Message, error) {
+// cancelRequest sends a CANCEL message for a block that another peer delivered first
+func (s *session) cancelRequest(request types.BlockRequest) error {
+	if _, requested := s.outstanding[request]; !requested {
+		return nil
+	}
+	delete(s.outstanding, request)
+
+	if _, err := s.conn.Write(CancelMessage(uint32(request.Index), uint32(request.Begin), uint32(request.Length))); err != nil {
+		return fmt.Errorf("error sending CANCEL message for piece %d, offset %d: %v", request.Index, request.Begin, err)
+	}
+
+	return s.requestBlocks()
+}
+
+// maxMessageLength returns the longest message a peer may send for a torrent with pieceCount pieces, the larger of
+// a piece message with the largest block and a bitfield message
+func maxMessageLength(pieceCount int) uint32 {
+	return uint32(max(MaxMessageLength, 1+(pieceCount+7)/8))
+}
+
+// ReadMessage reads a message from a connection, a length prefix above maxLength fails before anything is
+// allocated for the message
+func ReadMessage(conn net.Conn, maxLength uint32) (types.Message, error) {
 	var length uint32
 	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
 		return types.Message{}, err
@@ -284,6 +647,9 @@ func ReadMessage(conn net.Conn) (types.Message, error) {
 	if length == 0 {
 		return types.Message{ID: nil, Payload: nil}, nil // Keep-alive message
 	}
+	if length > maxLength {
+		return types.Message{}, fmt.Errorf("message length %d exceeds the maximum of %d", length, maxLength)
+	}
 
 	buf := make([]byte, length)
 	if _, err := io.ReadFull(conn, buf); err != nil {
@@ -301,16 +667,22 @@ func ReadMessage(conn net.Conn) (types.Message, error) {
 	}, nil
 }
 
-// createPeer initializes a new peer object
-func createPeer(peerID, address string) *types.Peer {
-	return &types.Peer{
-		PeerID:  peerID,
-		Address: address,
-		PeerState: types.PeerState{
-			AmChoking:      true,
-			AmInterested:   false,
-			PeerChoking:    true,
-			PeerInterested: false,
-		},
+// isUTP checks if a connection runs over uTP, also underneath MSE
+func isUTP(conn net.Conn) bool {
+	if c, ok := conn.(*mse.Conn); ok {
+		conn = c.NetConn()
 	}
+	_, ok := conn.(*utp.Conn)
+	return ok
+}
+
+// isEncrypted checks if a connection is RC4 encrypted with MSE
+func isEncrypted(conn net.Conn) bool {
+	c, ok := conn.(*mse.Conn)
+	return ok && c.Encrypted()
+}
+
+// createPeer initializes a new peer object
+func createPeer(peerID, address string, pieceCount int) *types.Peer {
+	return types.NewPeer(peerID, address, types.NewPeerState(), pieceCount)
 }
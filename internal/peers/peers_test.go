@@ -0,0 +1,106 @@
+package peers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestReadMessageLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		length uint32
+		fails  bool
+	}{
+		{"keep-alive", 0, false},
+		{"largest piece message", MaxMessageLength, false},
+		{"too long", MaxMessageLength + 1, true},
+		{"huge", 1<<32 - 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+
+			message := binary.BigEndian.AppendUint32(nil, test.length)
+			if !test.fails && test.length > 0 {
+				message = append(message, byte(types.MsgPiece))
+				message = append(message, bytes.Repeat([]byte{0}, int(test.length)-1)...)
+			}
+			go remote.Write(message)
+
+			_, err := ReadMessage(local, maxMessageLength(4))
+			if test.fails && err == nil {
+				t.Errorf("expected an error, but got none")
+			}
+			if !test.fails && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestMaxMessageLength(t *testing.T) {
+	if length := maxMessageLength(4); length != MaxMessageLength {
+		t.Errorf("expected %d for a small torrent, got %d", MaxMessageLength, length)
+	}
+	if length := maxMessageLength(8 * MaxMessageLength); length != MaxMessageLength+1 {
+		t.Errorf("expected the bitfield length %d, got %d", MaxMessageLength+1, length)
+	}
+}
+
+func TestAddSessionDuplicates(t *testing.T) {
+	sw := NewSwarm(types.NewPieceManager(4, types.BlockSize, 4*types.BlockSize), nil, nil, DefaultConfig())
+	newSession := func(peerID, address string) *session {
+		return &session{peer: &types.Peer{PeerID: peerID, Address: address}}
+	}
+
+	if err := sw.addSession(newSession("peer-a", "10.0.0.1:6881")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		peerID   string
+		address  string
+		rejected bool
+	}{
+		{"same peer connecting from another port", "peer-a", "10.0.0.1:51234", true},
+		{"same address", "peer-b", "10.0.0.1:6881", true},
+		{"other peer", "peer-b", "10.0.0.2:6881", false},
+	}
+	for _, test := range tests {
+		err := sw.addSession(newSession(test.peerID, test.address))
+		if test.rejected && err == nil {
+			t.Errorf("%s: expected an error, but got none", test.name)
+		}
+		if !test.rejected && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+
+	// Connections of the same peer racing each other get a single session
+	var added atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sw.addSession(newSession("peer-c", fmt.Sprintf("10.0.0.3:%d", 50000+i))) == nil {
+				added.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := added.Load(); n != 1 {
+		t.Errorf("expected a single session for racing connections, got %d", n)
+	}
+}
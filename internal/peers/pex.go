@@ -0,0 +1,274 @@
+package peers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/bencode"
+)
+
+const (
+	PexInterval           = time.Minute      // ut_pex messages are sent at most this often to a peer
+	pexMinReceiveInterval = 45 * time.Second // ut_pex messages a peer sends sooner than this after the last are ignored
+	maxPexPeers           = 50               // Most added and most dropped peers in a single ut_pex message
+
+	_keyAdded       = "added"
+	_keyAddedFlags  = "added.f"
+	_keyDropped     = "dropped"
+	_keyAdded6      = "added6"
+	_keyAdded6Flags = "added6.f"
+	_keyDropped6    = "dropped6"
+)
+
+// Flags of a peer in a ut_pex message
+const (
+	PexEncryption byte = 0x01 // Prefers encrypted connections
+	PexSeed       byte = 0x02 // Has every piece
+	PexUTP        byte = 0x04 // Supports uTP
+	PexReachable  byte = 0x10 // Accepts incoming connections
+)
+
+// pexPeer is a peer in a ut_pex message
+type pexPeer struct {
+	address string
+	flags   byte
+}
+
+// encodePex builds the payload of a ut_pex message, IPv4 and IPv6 peers go to their own keys and addresses that
+// do not parse are left out
+func encodePex(added []pexPeer, dropped []string) ([]byte, error) {
+	var added4, added6, flags4, flags6, dropped4, dropped6 bytes.Buffer
+	for _, peer := range added {
+		addrPort, err := netip.ParseAddrPort(peer.address)
+		if err != nil {
+			continue
+		}
+		if compact, ok := compactAddr4(addrPort); ok {
+			added4.Write(compact)
+			flags4.WriteByte(peer.flags)
+		} else {
+			added6.Write(compactAddr6(addrPort))
+			flags6.WriteByte(peer.flags)
+		}
+	}
+	for _, address := range dropped {
+		addrPort, err := netip.ParseAddrPort(address)
+		if err != nil {
+			continue
+		}
+		if compact, ok := compactAddr4(addrPort); ok {
+			dropped4.Write(compact)
+		} else {
+			dropped6.Write(compactAddr6(addrPort))
+		}
+	}
+
+	return bencode.Encode(map[string]any{
+		_keyAdded:       added4.String(),
+		_keyAddedFlags:  flags4.String(),
+		_keyDropped:     dropped4.String(),
+		_keyAdded6:      added6.String(),
+		_keyAdded6Flags: flags6.String(),
+		_keyDropped6:    dropped6.String(),
+	})
+}
+
+// decodePex parses the payload of a ut_pex message, peers without flags get none
+func decodePex(payload []byte) ([]pexPeer, []string, error) {
+	data, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode ut_pex message: %w", err)
+	}
+
+	dict, ok := data.(map[string]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid ut_pex message: expected a dictionary but got %T", data)
+	}
+
+	var added []pexPeer
+	var dropped []string
+	for _, family := range []struct {
+		added, flags, dropped string
+		length                int
+	}{
+		{_keyAdded, _keyAddedFlags, _keyDropped, 6},
+		{_keyAdded6, _keyAdded6Flags, _keyDropped6, 18},
+	} {
+		addresses, err := parseCompactAddrs(dict, family.added, family.length)
+		if err != nil {
+			return nil, nil, err
+		}
+		flags, _ := dict[family.flags].(string)
+		for i, address := range addresses {
+			peer := pexPeer{address: address}
+			if i < len(flags) {
+				peer.flags = flags[i]
+			}
+			added = append(added, peer)
+		}
+
+		addresses, err = parseCompactAddrs(dict, family.dropped, family.length)
+		if err != nil {
+			return nil, nil, err
+		}
+		dropped = append(dropped, addresses...)
+	}
+
+	return added, dropped, nil
+}
+
+// parseCompactAddrs parses the compact addresses of a ut_pex key as host:port, a missing key has none
+func parseCompactAddrs(dict map[string]any, key string, length int) ([]string, error) {
+	compact, _ := dict[key].(string)
+	if len(compact)%length != 0 {
+		return nil, fmt.Errorf("invalid ut_pex %s length %d, expected a multiple of %d", key, len(compact), length)
+	}
+
+	var addresses []string
+	for i := 0; i < len(compact); i += length {
+		entry := []byte(compact[i : i+length])
+		ip, _ := netip.AddrFromSlice(entry[:length-2])
+		port := binary.BigEndian.Uint16(entry[length-2:])
+		if port != 0 {
+			addresses = append(addresses, netip.AddrPortFrom(ip, port).String())
+		}
+	}
+
+	return addresses, nil
+}
+
+// compactAddr4 packs an IPv4 address and port in 6 bytes, it fails for IPv6 addresses
+func compactAddr4(addrPort netip.AddrPort) ([]byte, bool) {
+	ip := addrPort.Addr().Unmap()
+	if !ip.Is4() {
+		return nil, false
+	}
+
+	as4 := ip.As4()
+	return binary.BigEndian.AppendUint16(as4[:], addrPort.Port()), true
+}
+
+// compactAddr6 packs an IPv6 address and port in 18 bytes
+func compactAddr6(addrPort netip.AddrPort) []byte {
+	as16 := addrPort.Addr().As16()
+	return binary.BigEndian.AppendUint16(as16[:], addrPort.Port())
+}
+
+// pexFlags returns the ut_pex flags of the peer, peers we dialed are reachable and peers we talk RC4 with
+// prefer encryption
+func (s *session) pexFlags() byte {
+	var flags byte
+	if !s.incoming {
+		flags |= PexReachable
+	}
+	if s.overUTP {
+		flags |= PexUTP
+	}
+	if s.encrypted {
+		flags |= PexEncryption
+	}
+	if s.isSeed() {
+		flags |= PexSeed
+	}
+
+	return flags
+}
+
+// pexAddress returns the address other peers can reach the peer at. Peers that connected to us came from an
+// ephemeral port, so they are only advertised once their extension handshake told us the port they listen on
+func (s *session) pexAddress() (string, bool) {
+	if !s.incoming {
+		return s.peer.Address, true
+	}
+
+	s.mu.Lock()
+	port := s.listenPort
+	s.mu.Unlock()
+	if port == 0 {
+		return "", false
+	}
+
+	host, _, err := net.SplitHostPort(s.peer.Address)
+	if err != nil {
+		return "", false
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), true
+}
+
+// sendPex tells the peer which peers connected and disconnected since the last ut_pex message, nothing is sent
+// when the peer does not support ut_pex or nothing changed
+func (s *session) sendPex() error {
+	id, supported := s.extensions[_keyUTPex]
+	if !supported || !s.swarm.config.PeerExchange {
+		return nil
+	}
+
+	current := s.swarm.pexPeers(s.peer.Address)
+	var added []pexPeer
+	var dropped []string
+	for address, flags := range current {
+		if _, sent := s.pexSent[address]; !sent && len(added) < maxPexPeers {
+			added = append(added, pexPeer{address: address, flags: flags})
+		}
+	}
+	for address := range s.pexSent {
+		if _, connected := current[address]; !connected && len(dropped) < maxPexPeers {
+			dropped = append(dropped, address)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	payload, err := encodePex(added, dropped)
+	if err != nil {
+		return fmt.Errorf("error encoding ut_pex message: %v", err)
+	}
+	if _, err := s.conn.Write(ExtendedMessage(byte(id), payload)); err != nil {
+		return fmt.Errorf("error sending ut_pex message: %v", err)
+	}
+
+	for _, peer := range added {
+		s.pexSent[peer.address] = peer.flags
+	}
+	for _, address := range dropped {
+		delete(s.pexSent, address)
+	}
+
+	return nil
+}
+
+// handlePex hands the peers a ut_pex message added to the swarm, seeds are left out once we have every wanted
+// piece. Peers sending more than maxPexPeers or too often only get the first ones or nothing used
+func (s *session) handlePex(payload []byte) error {
+	if !s.pexReceivedAt.IsZero() && time.Since(s.pexReceivedAt) < pexMinReceiveInterval {
+		log.Printf("%s - Ignoring ut_pex message sent too soon after the last", s.peer.Address)
+		return nil
+	}
+	s.pexReceivedAt = time.Now()
+
+	added, dropped, err := decodePex(payload)
+	if err != nil {
+		return fmt.Errorf("invalid ut_pex message: %v", err)
+	}
+	log.Printf("%s - Received ut_pex message with %d added and %d dropped peers", s.peer.Address, len(added), len(dropped))
+	if len(added) > maxPexPeers {
+		added = added[:maxPexPeers]
+	}
+
+	complete := s.pm.HasAllWantedPieces()
+	for _, peer := range added {
+		if complete && peer.flags&PexSeed != 0 {
+			continue
+		}
+		s.swarm.AddPeer(peer.address)
+	}
+
+	return nil
+}
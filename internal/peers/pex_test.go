@@ -0,0 +1,78 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestPexRoundTrip(t *testing.T) {
+	added := []pexPeer{
+		{address: "10.0.0.1:6881", flags: PexSeed | PexReachable},
+		{address: "[2001:db8::1]:51413", flags: PexUTP},
+		{address: "not an address", flags: PexSeed},
+	}
+	dropped := []string{"10.0.0.2:6882", "[2001:db8::2]:6881"}
+
+	payload, err := encodePex(added, dropped)
+	if err != nil {
+		t.Fatalf("unexpected error encoding: %v", err)
+	}
+
+	decodedAdded, decodedDropped, err := decodePex(payload)
+	if err != nil {
+		t.Fatalf("unexpected error decoding: %v", err)
+	}
+
+	if len(decodedAdded) != 2 || decodedAdded[0] != added[0] || decodedAdded[1] != added[1] {
+		t.Errorf("expected added peers %v, got %v", added[:2], decodedAdded)
+	}
+	if len(decodedDropped) != 2 || decodedDropped[0] != dropped[0] || decodedDropped[1] != dropped[1] {
+		t.Errorf("expected dropped peers %v, got %v", dropped, decodedDropped)
+	}
+}
+
+func TestDecodePexInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"not bencoded", "garbage"},
+		{"not a dictionary", "li1ee"},
+		{"truncated added", "d5:added5:abcdee"},
+		{"truncated dropped6", "d8:dropped67:abcdefge"},
+		{"negative string length", "d5:added-1:abcdefe"},
+		{"string length beyond the payload", "d5:added4294967296:abcdefe"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := decodePex([]byte(test.payload)); err == nil {
+				t.Errorf("expected an error, but got none")
+			}
+		})
+	}
+}
+
+func TestPexPeersAddresses(t *testing.T) {
+	sw := NewSwarm(types.NewPieceManager(4, types.BlockSize, 4*types.BlockSize), nil, nil, DefaultConfig())
+	for _, s := range []*session{
+		{peer: &types.Peer{Address: "10.0.0.1:6881"}},
+		{peer: &types.Peer{Address: "10.0.0.2:51234"}, incoming: true},
+		{peer: &types.Peer{Address: "10.0.0.3:51235"}, incoming: true, listenPort: 6882},
+		{peer: &types.Peer{Address: "10.0.0.4:6883"}},
+	} {
+		sw.sessions[s.peer.Address] = s
+	}
+
+	expected := map[string]byte{"10.0.0.1:6881": PexReachable, "10.0.0.3:6882": 0}
+	result := sw.pexPeers("10.0.0.4:6883")
+	if len(result) != len(expected) {
+		t.Errorf("expected peers %v, got %v", expected, result)
+	}
+	for address, flags := range expected {
+		if got, advertised := result[address]; !advertised || got != flags {
+			t.Errorf("expected %s advertised with flags %#x, got %v", address, flags, result)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package peers
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	rateWindow = 20 // Seconds of history a rate is averaged over
+)
+
+// rateMeter measures a transfer rate over a sliding window of one second buckets
+type rateMeter struct {
+	mu      sync.Mutex
+	buckets [rateWindow]int64
+	newest  int64 // Unix second of the newest bucket
+	started int64 // Unix second of the first measurement so young meters are not averaged over the full window
+}
+
+// Add records n bytes transferred now
+func (r *rateMeter) Add(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().Unix()
+	r.advance(now)
+	r.buckets[now%rateWindow] += int64(n)
+}
+
+// Rate returns the average bytes per second over the window
+func (r *rateMeter) Rate() float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().Unix()
+	r.advance(now)
+
+	var sum int64
+	for _, bucket := range r.buckets {
+		sum += bucket
+	}
+
+	seconds := min(now-r.started+1, rateWindow)
+	return float64(sum) / float64(seconds)
+}
+
+// advance clears the buckets that fell out of the window, the caller must hold the lock
+func (r *rateMeter) advance(now int64) {
+	if r.started == 0 {
+		r.started = now
+		r.newest = now
+		return
+	}
+
+	for second := r.newest + 1; second <= now && second <= r.newest+rateWindow; second++ {
+		r.buckets[second%rateWindow] = 0
+	}
+	if now > r.newest {
+		r.newest = now
+	}
+}
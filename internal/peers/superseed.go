@@ -0,0 +1,119 @@
+package peers
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+// superseeding checks if new sessions should superseed (BEP 16), which needs every piece
+func (sw *Swarm) superseeding() bool {
+	return sw.config.SuperSeed && sw.pm.Bitfield().IsComplete(sw.pm.PieceCount)
+}
+
+// countPieces updates the availability of pieces with the ones a peer gained or lost. A gained piece that was
+// offered to another peer has propagated from it, so that peer is signalled to get a new one. The caller must
+// hold the lock
+func (sw *Swarm) countPieces(address string, before, after types.Bitfield) {
+	if sw.availability == nil {
+		sw.availability = make([]int, sw.pm.PieceCount)
+	}
+
+	for index := range sw.availability {
+		had, has := before.HasPiece(index), after.HasPiece(index)
+		switch {
+		case has && !had:
+			sw.availability[index]++
+			for other, offered := range sw.offered {
+				if offered != index || other == address {
+					continue
+				}
+				delete(sw.offered, other)
+				if s, connected := sw.sessions[other]; connected {
+					select {
+					case s.reveal <- struct{}{}:
+					default:
+					}
+				}
+			}
+		case had && !has:
+			sw.availability[index]--
+		}
+	}
+}
+
+// rarestPiece picks the piece to offer a peer, the one fewest connected peers have and then fewest peers were
+// offered, among those the peer does not have and was not shown yet. It returns -1 when there is none
+func rarestPiece(has types.Bitfield, revealed map[int]struct{}, availability []int, offers map[int]int, pieceCount int) int {
+	available := func(index int) int {
+		if index < len(availability) {
+			return availability[index]
+		}
+		return 0
+	}
+
+	best := -1
+	for index := 0; index < pieceCount; index++ {
+		if _, shown := revealed[index]; shown || has.HasPiece(index) {
+			continue
+		}
+		if best == -1 || available(index) < available(best) || (available(index) == available(best) && offers[index] < offers[best]) {
+			best = index
+		}
+	}
+
+	return best
+}
+
+// updatePieces counts the pieces the peer gained or lost with a HAVE, BITFIELD, HAVE ALL or HAVE NONE message.
+// After the bulk messages the offer is checked since the peer may turn out to already have it
+func (s *session) updatePieces(id types.MessageID) error {
+	switch id {
+	case types.MsgHave, types.MsgBitfield, types.MsgHaveAll, types.MsgHaveNone:
+	default:
+		return nil
+	}
+
+	s.swarm.mu.Lock()
+	s.swarm.countPieces(s.peer.Address, s.counted, s.peer.Bitfield)
+	s.swarm.mu.Unlock()
+	s.counted = append(s.counted[:0], s.peer.Bitfield...)
+
+	if id == types.MsgHave {
+		return nil
+	}
+	return s.offerPiece()
+}
+
+// offerPiece reveals the rarest piece to the peer with HAVE, unless its current offer is one it still needs. The
+// next piece is only offered once this one is seen at another peer
+func (s *session) offerPiece() error {
+	sw := s.swarm
+	sw.mu.Lock()
+	if offered, exists := sw.offered[s.peer.Address]; exists && !s.peer.Bitfield.HasPiece(offered) {
+		sw.mu.Unlock()
+		return nil
+	}
+
+	offers := make(map[int]int, len(sw.offered))
+	for _, offered := range sw.offered {
+		offers[offered]++
+	}
+	index := rarestPiece(s.peer.Bitfield, s.revealed, sw.availability, offers, s.pm.PieceCount)
+	if index == -1 {
+		delete(sw.offered, s.peer.Address)
+		sw.mu.Unlock()
+		return nil
+	}
+	sw.offered[s.peer.Address] = index
+	sw.mu.Unlock()
+
+	log.Printf("%s - Superseeding, revealing piece %d", s.peer.Address, index)
+	s.revealed[index] = struct{}{}
+	if _, err := s.conn.Write(HaveMessage(uint32(index))); err != nil {
+		return fmt.Errorf("error sending HAVE message for piece %d: %v", index, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestRarestPiece(t *testing.T) {
+	has := types.NewBitfield(4)
+	has.SetPiece(0)
+
+	tests := []struct {
+		name         string
+		revealed     map[int]struct{}
+		availability []int
+		offers       map[int]int
+		expected     int
+	}{
+		{"nothing counted", nil, nil, nil, 1},
+		{"rarest", nil, []int{0, 3, 1, 2}, nil, 2},
+		{"fewest offers", nil, []int{0, 1, 1, 1}, map[int]int{1: 2, 2: 1}, 3},
+		{"revealed skipped", map[int]struct{}{2: {}}, []int{0, 3, 1, 2}, nil, 3},
+		{"none left", map[int]struct{}{1: {}, 2: {}, 3: {}}, nil, nil, -1},
+	}
+
+	for _, test := range tests {
+		if result := rarestPiece(has, test.revealed, test.availability, test.offers, 4); result != test.expected {
+			t.Errorf("%s: expected piece %d, got %d", test.name, test.expected, result)
+		}
+	}
+}
+
+func TestCountPiecesPropagation(t *testing.T) {
+	sw := NewSwarm(types.NewPieceManager(4, types.BlockSize, 4*types.BlockSize), nil, nil, DefaultConfig())
+	offeredTo := &session{peer: &types.Peer{Address: "offered"}, reveal: make(chan struct{}, 1)}
+	sw.sessions[offeredTo.peer.Address] = offeredTo
+	sw.offered[offeredTo.peer.Address] = 2
+
+	before, after := types.NewBitfield(4), types.NewBitfield(4)
+	after.SetPiece(1)
+	after.SetPiece(2)
+
+	// The peer that was offered piece 2 getting it does not reveal more
+	sw.countPieces("offered", before, after)
+	if len(offeredTo.reveal) != 0 {
+		t.Errorf("expected no reveal when the offered peer itself gets the piece")
+	}
+
+	// Another peer getting it does
+	sw.countPieces("other", before, after)
+	if len(offeredTo.reveal) != 1 {
+		t.Errorf("expected a reveal once another peer has the offered piece")
+	}
+	if _, offered := sw.offered["offered"]; offered {
+		t.Errorf("expected the propagated offer to be cleared")
+	}
+	if sw.availability[1] != 2 || sw.availability[2] != 2 || sw.availability[0] != 0 {
+		t.Errorf("expected availability [0 2 2 0], got %v", sw.availability)
+	}
+
+	sw.countPieces("other", after, nil)
+	if sw.availability[1] != 1 || sw.availability[2] != 1 {
+		t.Errorf("expected availability [0 1 1 0] after a peer left, got %v", sw.availability)
+	}
+}
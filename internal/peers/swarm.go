@@ -0,0 +1,318 @@
+package peers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/mse"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+	"github.com/ParamvirSran/GoTorrent/internal/utp"
+)
+
+const (
+	DefaultUploadSlots        = 4
+	DefaultSnubTimeout        = 60 * time.Second
+	DefaultUselessPeerTimeout = 3 * time.Minute
+
+	discoveredQueueSize = 256
+)
+
+// Config holds the settings shared by every peer connection of a torrent
+type Config struct {
+	UploadSlots        int           // Number of peers unchoked for their rate, the optimistic unchoke comes on top of these
+	SnubTimeout        time.Duration // How long an unchoking peer may go without sending a requested block before it is snubbed
+	UselessPeerTimeout time.Duration // How long a snubbed or uninterested peer is kept before it is disconnected
+	PeerExchange       bool          // Exchange peer lists with ut_pex, must be off for private torrents
+	Encryption         string        // MSE policy for peer connections, one of the mse.Policy values
+	SuperSeed          bool          // Reveal pieces to each peer one at a time (BEP 16) while we have every piece
+}
+
+// DefaultConfig returns the default peer connection settings
+func DefaultConfig() Config {
+	return Config{
+		UploadSlots:        DefaultUploadSlots,
+		SnubTimeout:        DefaultSnubTimeout,
+		UselessPeerTimeout: DefaultUselessPeerTimeout,
+		PeerExchange:       true,
+		Encryption:         mse.PolicyPrefer,
+	}
+}
+
+// Swarm tracks the peers we are connected to for a single torrent
+type Swarm struct {
+	pm       *types.PieceManager
+	infoHash []byte
+	clientID []byte
+	config   Config
+	utp      *utp.Socket // Peers are dialed over uTP first when set
+	metadata []byte      // Bencoded info dictionary served with ut_metadata, nil when not served
+
+	downloaded atomic.Int64 // Bytes of blocks received from all peers
+	uploaded   atomic.Int64 // Bytes of blocks sent to all peers
+
+	mu         sync.Mutex
+	sessions   map[string]*session
+	optimistic string        // Address of the current optimistic unchoke
+	rechoke    chan struct{} // Signals the choker to run early, e.g. after a peer became interested
+
+	discovered chan string // Addresses of peers found after startup, e.g. by the DHT
+
+	availability []int          // Connected peers having each piece, only counted by superseeding sessions
+	offered      map[string]int // Piece each superseeding session waits to see propagate, by address
+}
+
+// NewSwarm creates a swarm for a torrent and returns a pointer to it
+func NewSwarm(pm *types.PieceManager, infoHash, clientID []byte, config Config) *Swarm {
+	return &Swarm{
+		pm:       pm,
+		infoHash: infoHash,
+		clientID: clientID,
+		config:   config,
+
+		sessions: make(map[string]*session),
+		rechoke:  make(chan struct{}, 1),
+		offered:  make(map[string]int),
+
+		discovered: make(chan string, discoveredQueueSize),
+	}
+}
+
+// HandlePeerConnection manages a single peer connection
+func (sw *Swarm) HandlePeerConnection(ctx context.Context, peerID, peerAddress string) error {
+	peerContext, peerCancel := context.WithCancel(ctx)
+	defer peerCancel()
+
+	peer := createPeer(peerID, peerAddress, sw.pm.PieceCount)
+	handshake, err := types.NewHandshake(sw.infoHash, sw.clientID)
+	if err != nil {
+		return fmt.Errorf("error creating handshake: %v", err)
+	}
+
+	conn, err := sw.connectToPeer(peerContext, peer.Address)
+	if err != nil {
+		return err
+	}
+	conn, err = sw.encrypt(peerContext, conn, peer.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := sendHandshake(conn, handshake); err != nil {
+		return err
+	}
+
+	reserved, remoteID, err := receiveHandshakeResponse(conn, sw.infoHash)
+	if err != nil {
+		return err
+	}
+	peer.PeerID = remoteID
+
+	stopKeepAlive := startKeepAlive(peerContext, conn)
+	defer stopKeepAlive()
+
+	return sw.processMessages(peerContext, conn, peer, reserved, false)
+}
+
+// HandleIncomingConnection manages a connection a peer opened to us, the peer sends its handshake first
+func (sw *Swarm) HandleIncomingConnection(ctx context.Context, conn net.Conn) error {
+	peerContext, peerCancel := context.WithCancel(ctx)
+	defer peerCancel()
+	defer conn.Close()
+
+	// The address of an incoming peer has the port it connected from, so the peer ID from its handshake is what
+	// tells whether we are already connected to it
+	peerAddress := conn.RemoteAddr().String()
+
+	if sw.config.Encryption != mse.PolicyDisabled {
+		methods, err := mse.Methods(sw.config.Encryption)
+		if err != nil {
+			return err
+		}
+		encrypted, _, err := mse.Accept(conn, [][]byte{sw.infoHash}, methods)
+		if err != nil {
+			return fmt.Errorf("error in encryption handshake with %s: %v", peerAddress, err)
+		}
+		conn = encrypted
+	}
+
+	reserved, remoteID, err := receiveHandshakeResponse(conn, sw.infoHash)
+	if err != nil {
+		return err
+	}
+
+	handshake, err := types.NewHandshake(sw.infoHash, sw.clientID)
+	if err != nil {
+		return fmt.Errorf("error creating handshake: %v", err)
+	}
+	if err := sendHandshake(conn, handshake); err != nil {
+		return err
+	}
+
+	stopKeepAlive := startKeepAlive(peerContext, conn)
+	defer stopKeepAlive()
+
+	peer := createPeer(remoteID, peerAddress, sw.pm.PieceCount)
+	return sw.processMessages(peerContext, conn, peer, reserved, true)
+}
+
+// encrypt runs the MSE handshake on a connection we opened, unless encryption is disabled. When the peer does not
+// complete it and the policy allows plaintext, the peer is dialed again without encryption
+func (sw *Swarm) encrypt(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	if sw.config.Encryption == mse.PolicyDisabled {
+		return conn, nil
+	}
+
+	methods, err := mse.Methods(sw.config.Encryption)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	encrypted, err := mse.Initiate(conn, sw.infoHash, methods)
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+
+	if methods&mse.CryptoPlaintext == 0 {
+		return nil, fmt.Errorf("error in encryption handshake with %s: %v", address, err)
+	}
+	log.Printf("%s - Retrying without encryption: %v", address, err)
+	return sw.connectToPeer(ctx, address)
+}
+
+// SetUTP makes the swarm dial peers over a uTP socket before falling back to TCP, it must be called before
+// connecting to peers
+func (sw *Swarm) SetUTP(socket *utp.Socket) {
+	sw.utp = socket
+}
+
+// SetMetadata makes the swarm serve the bencoded info dictionary to peers with ut_metadata, it must be called before
+// connecting to peers. Metadata that does not hash to the infohash is not served since peers would reject it
+func (sw *Swarm) SetMetadata(infoBytes []byte) {
+	if hash := sha1.Sum(infoBytes); !bytes.Equal(hash[:], sw.infoHash) {
+		log.Printf("Not serving metadata, it hashes to %x instead of the infohash %x", hash, sw.infoHash)
+		return
+	}
+
+	sw.metadata = infoBytes
+}
+
+// AddPeer queues the address of a peer found by another source than the trackers, it is dropped when the queue
+// is full
+func (sw *Swarm) AddPeer(address string) {
+	select {
+	case sw.discovered <- address:
+	default:
+	}
+}
+
+// DiscoveredPeers returns the addresses queued by AddPeer
+func (sw *Swarm) DiscoveredPeers() <-chan string {
+	return sw.discovered
+}
+
+// addSession registers a connected peer with the swarm, it fails when we already have a session with the same
+// address or peer ID, e.g. when the peer connected to us while we connected to it
+func (sw *Swarm) addSession(s *session) error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if _, connected := sw.sessions[s.peer.Address]; connected {
+		return fmt.Errorf("already connected to peer %s", s.peer.Address)
+	}
+	for address, other := range sw.sessions {
+		if other.peer.PeerID == s.peer.PeerID {
+			return fmt.Errorf("already connected to peer %s with peer ID %q at %s", s.peer.Address, s.peer.PeerID, address)
+		}
+	}
+	sw.sessions[s.peer.Address] = s
+
+	return nil
+}
+
+// removeSession removes a disconnected peer from the swarm
+func (sw *Swarm) removeSession(s *session) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	delete(sw.sessions, s.peer.Address)
+	if sw.optimistic == s.peer.Address {
+		sw.optimistic = ""
+	}
+	if s.superseed {
+		sw.countPieces(s.peer.Address, s.counted, nil)
+		delete(sw.offered, s.peer.Address)
+	}
+}
+
+// BroadcastHave tells every connected peer that we have a new piece
+func (sw *Swarm) BroadcastHave(index int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	for _, s := range sw.sessions {
+		select {
+		case s.haves <- index:
+		default:
+			log.Printf("%s - HAVE queue full, dropping HAVE for piece %d", s.peer.Address, index)
+		}
+	}
+}
+
+// PieceVerified handles the result of hashing a piece, it is passed to PieceManager.Start. Verified pieces are
+// announced to every peer
+func (sw *Swarm) PieceVerified(result types.PieceResult) {
+	if result.Err != nil {
+		log.Printf("Verification failed for piece %d: %v", result.Index, result.Err)
+		return
+	}
+
+	log.Printf("Successfully downloaded and verified piece %d", result.Index)
+	sw.BroadcastHave(result.Index)
+}
+
+// TransferTotals returns the bytes downloaded from and uploaded to peers, including totals added from resume data
+func (sw *Swarm) TransferTotals() (int64, int64) {
+	return sw.downloaded.Load(), sw.uploaded.Load()
+}
+
+// AddTransferTotals adds bytes transferred in an earlier run, e.g. from resume data
+func (sw *Swarm) AddTransferTotals(downloaded, uploaded int64) {
+	sw.downloaded.Add(downloaded)
+	sw.uploaded.Add(uploaded)
+}
+
+// pexPeers returns the connected peers to tell a peer about with ut_pex by the address they accept connections on,
+// with their flags. The peer itself is left out
+func (sw *Swarm) pexPeers(exclude string) map[string]byte {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	peers := make(map[string]byte, len(sw.sessions))
+	for address, s := range sw.sessions {
+		if address == exclude {
+			continue
+		}
+		if advertised, ok := s.pexAddress(); ok {
+			peers[advertised] = s.pexFlags()
+		}
+	}
+
+	return peers
+}
+
+// requestRechoke asks the choker to reconsider its unchokes without waiting for the next round
+func (sw *Swarm) requestRechoke() {
+	select {
+	case sw.rechoke <- struct{}{}:
+	default:
+	}
+}
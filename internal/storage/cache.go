@@ -0,0 +1,423 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"sync"
+)
+
+const (
+	CacheBlockSize     = 16384    // Cached data is kept in blocks of the size peers request
+	DefaultCacheSize   = 64 << 20 // Memory budget of the read cache
+	DefaultWriteBuffer = 4 << 20  // Written data held back per storage so adjacent blocks are flushed together
+)
+
+// CacheStats are the counters of a cache, shared by every storage using it
+type CacheStats struct {
+	Hits      int64 // Blocks read from memory
+	Misses    int64 // Blocks that had to be read from the storage underneath
+	Evictions int64 // Blocks dropped to stay within the budget
+	Size      int64 // Bytes cached right now
+	Budget    int64
+
+	BlocksWritten int64 // Blocks written by peers
+	Flushes       int64 // Writes to the storage underneath, fewer than blocks when adjacent blocks are coalesced
+}
+
+// HitRate returns the share of blocks read from memory, 0 before anything was read
+func (s CacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// Cache is a least recently used cache of blocks with a memory budget, one cache can be shared by the storage
+// of many torrents
+type Cache struct {
+	mu      sync.Mutex
+	budget  int64
+	lru     *list.List // Front is the most recently used
+	entries map[cacheKey]*list.Element
+	owners  int
+	stats   CacheStats
+}
+
+// cacheKey identifies a block of a piece of one storage
+type cacheKey struct {
+	owner, piece, block int
+}
+
+// cacheEntry is a cached block
+type cacheEntry struct {
+	key  cacheKey
+	data []byte
+}
+
+// NewCache creates a cache that holds at most budget bytes
+func NewCache(budget int64) *Cache {
+	return &Cache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+		stats:   CacheStats{Budget: budget},
+	}
+}
+
+// Stats returns a snapshot of the counters
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.stats
+}
+
+// register returns a new owner id for a storage using the cache
+func (c *Cache) register() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.owners++
+	return c.owners
+}
+
+// get returns a cached block and marks it as recently used
+func (c *Cache) get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(element)
+
+	return element.Value.(*cacheEntry).data, true
+}
+
+// put caches a block, evicting the least recently used blocks when the budget is exceeded
+func (c *Cache) put(key cacheKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if int64(len(data)) > c.budget {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, data: data})
+	c.stats.Size += int64(len(data))
+
+	for c.stats.Size > c.budget {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops a block, e.g. because it is being overwritten
+func (c *Cache) remove(key cacheKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.removeElement(element)
+	}
+}
+
+// removeOwner drops every block of a storage that is closed
+func (c *Cache) removeOwner(owner int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, element := range c.entries {
+		if key.owner == owner {
+			c.removeElement(element)
+		}
+	}
+}
+
+// removeElement drops a block, the caller must hold the lock
+func (c *Cache) removeElement(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Size -= int64(len(entry.data))
+}
+
+// recordWrites counts written blocks and the writes they were coalesced into
+func (c *Cache) recordWrites(blocks, flushes int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.BlocksWritten += int64(blocks)
+	c.stats.Flushes += int64(flushes)
+}
+
+// CachedStorage puts a read cache and a write buffer in front of another storage. A read that misses loads the
+// whole piece so the next blocks peers ask for are already in memory, and written blocks are held back until the
+// piece is complete, read or the buffer is full so adjacent blocks reach the storage underneath as one write
+type CachedStorage struct {
+	inner       Storage
+	cache       *Cache
+	owner       int
+	layout      Layout
+	writeBuffer int64
+
+	mu          sync.Mutex
+	dirty       map[int]map[int64][]byte // Written data per piece by offset that is not flushed yet
+	dirtyOrder  []int                    // Pieces in the order they were first written to
+	dirtySize   int64
+	generations map[int]int   // Bumped on every write so reads never cache data that was overwritten meanwhile
+	failed      map[int]error // Errors flushing pieces to make room for other writes, reported on their next read or completion
+}
+
+// NewCachedStorage wraps a storage with a cache, writeBuffer is the number of written bytes held back at most
+func NewCachedStorage(inner Storage, cache *Cache, layout Layout, writeBuffer int64) *CachedStorage {
+	return &CachedStorage{
+		inner:       inner,
+		cache:       cache,
+		owner:       cache.register(),
+		layout:      layout,
+		writeBuffer: writeBuffer,
+
+		dirty:       make(map[int]map[int64][]byte),
+		generations: make(map[int]int),
+		failed:      make(map[int]error),
+	}
+}
+
+// ReadAt reads from the cache, loading the whole piece from the storage underneath when a block is missing
+func (cs *CachedStorage) ReadAt(piece int, p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	cs.mu.Lock()
+	err := cs.flushOwn(piece)
+	generation := cs.generations[piece]
+	cs.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	first, last := int(off/CacheBlockSize), int((off+int64(len(p))-1)/CacheBlockSize)
+	if cs.copyCached(piece, p, off, first, last) {
+		return len(p), nil
+	}
+
+	// Read-ahead of the whole piece, a piece that is not fully written yet is read as asked
+	data := make([]byte, cs.layout.PieceSize(piece))
+	if _, err := cs.inner.ReadAt(piece, data, 0); err != nil {
+		return cs.inner.ReadAt(piece, p, off)
+	}
+	if off+int64(len(p)) > int64(len(data)) {
+		return 0, errors.New("read past the end of the piece")
+	}
+
+	cs.mu.Lock()
+	if cs.generations[piece] == generation {
+		for block := 0; block*CacheBlockSize < len(data); block++ {
+			end := min((block+1)*CacheBlockSize, len(data))
+			cs.cache.put(cacheKey{cs.owner, piece, block}, data[block*CacheBlockSize:end:end])
+		}
+	}
+	cs.mu.Unlock()
+
+	return copy(p, data[off:]), nil
+}
+
+// copyCached copies blocks first to last from the cache into p, it reports false when any of them is missing
+func (cs *CachedStorage) copyCached(piece int, p []byte, off int64, first, last int) bool {
+	blocks := make([][]byte, 0, last-first+1)
+	for block := first; block <= last; block++ {
+		data, ok := cs.cache.get(cacheKey{cs.owner, piece, block})
+		if !ok {
+			return false
+		}
+		blocks = append(blocks, data)
+	}
+
+	n := 0
+	for i, data := range blocks {
+		start := int64(0)
+		if i == 0 {
+			start = off - int64(first)*CacheBlockSize
+		}
+		if start >= int64(len(data)) {
+			return false
+		}
+		n += copy(p[n:], data[start:])
+	}
+
+	return n == len(p)
+}
+
+// WriteAt buffers written data, the piece is flushed once all of it is written or the buffer is full. Errors
+// of flushing other pieces to make room are kept for those pieces and reported on their next read or completion
+func (cs *CachedStorage) WriteAt(piece int, p []byte, off int64) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.generations[piece]++
+	for block := off / CacheBlockSize; block*CacheBlockSize < off+int64(len(p)); block++ {
+		cs.cache.remove(cacheKey{cs.owner, piece, int(block)})
+	}
+
+	blocks, ok := cs.dirty[piece]
+	if !ok {
+		blocks = make(map[int64][]byte)
+		cs.dirty[piece] = blocks
+		cs.dirtyOrder = append(cs.dirtyOrder, piece)
+	}
+	if previous, ok := blocks[off]; ok {
+		cs.dirtySize -= int64(len(previous))
+	}
+	blocks[off] = append([]byte(nil), p...)
+	cs.dirtySize += int64(len(p))
+
+	var buffered int
+	for _, data := range blocks {
+		buffered += len(data)
+	}
+	if buffered >= cs.layout.PieceSize(piece) {
+		if err := cs.flush(piece); err != nil {
+			return 0, err
+		}
+	}
+
+	for cs.dirtySize > cs.writeBuffer && len(cs.dirtyOrder) > 0 {
+		other := cs.dirtyOrder[0]
+		if err := cs.flush(other); err != nil {
+			if other == piece {
+				return 0, err
+			}
+			cs.failed[other] = err
+		}
+	}
+
+	return len(p), nil
+}
+
+// flushOwn flushes a piece and returns its error, including one left from flushing it for another write. The
+// caller must hold the lock
+func (cs *CachedStorage) flushOwn(piece int) error {
+	err := cs.flush(piece)
+	if failed, ok := cs.failed[piece]; ok {
+		delete(cs.failed, piece)
+		return failed
+	}
+
+	return err
+}
+
+// flush writes the buffered data of a piece, adjacent blocks are joined into one write. The caller must hold
+// the lock
+func (cs *CachedStorage) flush(piece int) error {
+	blocks, ok := cs.dirty[piece]
+	if !ok {
+		return nil
+	}
+	delete(cs.dirty, piece)
+	for i, dirty := range cs.dirtyOrder {
+		if dirty == piece {
+			cs.dirtyOrder = append(cs.dirtyOrder[:i], cs.dirtyOrder[i+1:]...)
+			break
+		}
+	}
+
+	offsets := make([]int64, 0, len(blocks))
+	for off, data := range blocks {
+		offsets = append(offsets, off)
+		cs.dirtySize -= int64(len(data))
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	flushes := 0
+	for i := 0; i < len(offsets); {
+		start := offsets[i]
+		run := blocks[start]
+		for i++; i < len(offsets) && offsets[i] == start+int64(len(run)); i++ {
+			run = append(run, blocks[offsets[i]]...)
+		}
+		if _, err := cs.inner.WriteAt(piece, run, start); err != nil {
+			return err
+		}
+		flushes++
+	}
+	cs.cache.recordWrites(len(offsets), flushes)
+
+	return nil
+}
+
+// MarkComplete flushes the piece before passing it on
+func (cs *CachedStorage) MarkComplete(piece int) error {
+	cs.mu.Lock()
+	err := cs.flushOwn(piece)
+	cs.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return cs.inner.MarkComplete(piece)
+}
+
+// Flush writes everything that is buffered to the storage underneath. Errors are also kept for their pieces and
+// reported on their next read or completion
+func (cs *CachedStorage) Flush() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var errs []error
+	for len(cs.dirtyOrder) > 0 {
+		piece := cs.dirtyOrder[0]
+		if err := cs.flush(piece); err != nil {
+			cs.failed[piece] = err
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// SetWanted flushes everything that is buffered so it reaches the right place and passes the change on to the
+// storage underneath
+func (cs *CachedStorage) SetWanted(file int, wanted bool) error {
+	selector, ok := cs.inner.(FileSelector)
+	if !ok {
+		return nil
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for len(cs.dirtyOrder) > 0 {
+		piece := cs.dirtyOrder[0]
+		if err := cs.flush(piece); err != nil {
+			cs.failed[piece] = err
+		}
+	}
+
+	return selector.SetWanted(file, wanted)
+}
+
+// Close flushes everything that is buffered, drops the cached blocks and closes the storage underneath
+func (cs *CachedStorage) Close() error {
+	cs.mu.Lock()
+	var errs []error
+	for len(cs.dirtyOrder) > 0 {
+		if err := cs.flush(cs.dirtyOrder[0]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	cs.mu.Unlock()
+
+	cs.cache.removeOwner(cs.owner)
+	errs = append(errs, cs.inner.Close())
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+// countingStorage counts the calls made to the storage underneath a cache
+type countingStorage struct {
+	Storage
+	reads, writes atomic.Int64
+}
+
+func (cs *countingStorage) ReadAt(piece int, p []byte, off int64) (int, error) {
+	cs.reads.Add(1)
+	return cs.Storage.ReadAt(piece, p, off)
+}
+
+func (cs *countingStorage) WriteAt(piece int, p []byte, off int64) (int, error) {
+	cs.writes.Add(1)
+	return cs.Storage.WriteAt(piece, p, off)
+}
+
+// failingStorage fails every write to one piece
+type failingStorage struct {
+	Storage
+	piece int
+}
+
+func (fs *failingStorage) WriteAt(piece int, p []byte, off int64) (int, error) {
+	if piece == fs.piece {
+		return 0, errors.New("disk full")
+	}
+	return fs.Storage.WriteAt(piece, p, off)
+}
+
+func TestCachedStorageFlushError(t *testing.T) {
+	pieceLength := 4 * CacheBlockSize
+	layout := NewLayout([]File{{Path: []string{"a"}, Length: int64(2 * pieceLength)}}, pieceLength)
+	cs := NewCachedStorage(&failingStorage{Storage: NewMemoryStorage(layout), piece: 0}, NewCache(DefaultCacheSize), layout, CacheBlockSize)
+
+	// Piece 0 is flushed to make room for piece 1, its error must not be blamed on piece 1
+	block := make([]byte, CacheBlockSize)
+	if _, err := cs.WriteAt(0, block, 0); err != nil {
+		t.Fatalf("unexpected error writing piece 0: %v", err)
+	}
+	if _, err := cs.WriteAt(1, block, 0); err != nil {
+		t.Errorf("expected no error writing piece 1, got %v", err)
+	}
+
+	if err := cs.MarkComplete(0); err == nil {
+		t.Errorf("expected the flush error of piece 0 on its completion, but got none")
+	}
+	if _, err := cs.WriteAt(1, block, CacheBlockSize); err != nil {
+		t.Errorf("expected no error writing piece 1, got %v", err)
+	}
+	if err := cs.MarkComplete(1); err != nil {
+		t.Errorf("expected piece 1 to complete, got %v", err)
+	}
+}
+
+func TestCachedStorage(t *testing.T) {
+	pieceLength := 4 * CacheBlockSize
+	layout := NewLayout([]File{{Path: []string{"a"}, Length: int64(2 * pieceLength)}}, pieceLength)
+	inner := &countingStorage{Storage: NewMemoryStorage(layout)}
+	cache := NewCache(DefaultCacheSize)
+	cs := NewCachedStorage(inner, cache, layout, DefaultWriteBuffer)
+
+	piece := make([]byte, pieceLength)
+	for i := range piece {
+		piece[i] = byte(i % 253)
+	}
+
+	// Blocks arrive out of order and are written as one run once the piece is complete
+	for _, block := range []int{2, 0, 3, 1} {
+		data := piece[block*CacheBlockSize : (block+1)*CacheBlockSize]
+		if _, err := cs.WriteAt(0, data, int64(block*CacheBlockSize)); err != nil {
+			t.Fatalf("unexpected error writing block %d: %v", block, err)
+		}
+	}
+	if writes := inner.writes.Load(); writes != 1 {
+		t.Errorf("expected 1 coalesced write, got %d", writes)
+	}
+
+	// The first read loads the whole piece, the rest come from memory
+	for block := range 4 {
+		p := make([]byte, CacheBlockSize)
+		if _, err := cs.ReadAt(0, p, int64(block*CacheBlockSize)); err != nil {
+			t.Fatalf("unexpected error reading block %d: %v", block, err)
+		}
+		if !bytes.Equal(p, piece[block*CacheBlockSize:(block+1)*CacheBlockSize]) {
+			t.Errorf("unexpected data for block %d", block)
+		}
+	}
+	if reads := inner.reads.Load(); reads != 1 {
+		t.Errorf("expected 1 read of the whole piece, got %d", reads)
+	}
+
+	stats := cache.Stats()
+	if stats.Misses != 1 || stats.Hits != 3 || stats.Size != int64(pieceLength) {
+		t.Errorf("expected 1 miss, 3 hits and %d bytes cached, got %+v", pieceLength, stats)
+	}
+	if stats.BlocksWritten != 4 || stats.Flushes != 1 {
+		t.Errorf("expected 4 blocks written in 1 flush, got %+v", stats)
+	}
+
+	// Overwriting a block drops it from the cache so the new data is read back
+	changed := bytes.Repeat([]byte{0xee}, CacheBlockSize)
+	if _, err := cs.WriteAt(0, changed, CacheBlockSize); err != nil {
+		t.Fatalf("unexpected error overwriting block: %v", err)
+	}
+	p := make([]byte, CacheBlockSize)
+	if _, err := cs.ReadAt(0, p, CacheBlockSize); err != nil || !bytes.Equal(p, changed) {
+		t.Errorf("expected the overwritten block to read back, got error %v", err)
+	}
+
+	if err := cs.Close(); err != nil {
+		t.Errorf("unexpected error closing: %v", err)
+	}
+	if size := cache.Stats().Size; size != 0 {
+		t.Errorf("expected an empty cache after closing, got %d bytes", size)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := NewCache(2 * CacheBlockSize)
+	for block := range 3 {
+		cache.put(cacheKey{1, 0, block}, make([]byte, CacheBlockSize))
+	}
+
+	if _, ok := cache.get(cacheKey{1, 0, 0}); ok {
+		t.Errorf("expected the least recently used block to be evicted")
+	}
+	if _, ok := cache.get(cacheKey{1, 0, 2}); !ok {
+		t.Errorf("expected the newest block to be cached")
+	}
+	if stats := cache.Stats(); stats.Evictions != 1 || stats.Size != 2*CacheBlockSize {
+		t.Errorf("expected 1 eviction and %d bytes cached, got %+v", 2*CacheBlockSize, stats)
+	}
+}
+
+func TestCachedStorageFlush(t *testing.T) {
+	pieceLength := 4 * CacheBlockSize
+	layout := NewLayout([]File{{Path: []string{"a"}, Length: int64(2 * pieceLength)}}, pieceLength)
+	inner := NewMemoryStorage(layout)
+	cs := NewCachedStorage(&failingStorage{Storage: inner, piece: 1}, NewCache(DefaultCacheSize), layout, DefaultWriteBuffer)
+
+	block := bytes.Repeat([]byte{0x5a}, CacheBlockSize)
+	for piece := range 2 {
+		if _, err := cs.WriteAt(piece, block, 0); err != nil {
+			t.Fatalf("unexpected error writing piece %d: %v", piece, err)
+		}
+	}
+
+	if err := cs.Flush(); err == nil {
+		t.Errorf("expected the flush error of piece 1, but got none")
+	}
+	data := make([]byte, CacheBlockSize)
+	if _, err := inner.ReadAt(0, data, 0); err != nil || !bytes.Equal(data, block) {
+		t.Errorf("expected the block of piece 0 in the storage underneath, got %v", err)
+	}
+	if err := cs.MarkComplete(1); err == nil {
+		t.Errorf("expected the flush error of piece 1 on its completion, but got none")
+	}
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage stores the torrent content as regular files inside a download directory
+type FileStorage struct {
+	dir     string
+	layout  Layout
+	skipped []bool       // Files that are not downloaded, they are never created
+	parts   *partFile    // Bytes of skipped files in pieces shared with wanted files
+	skipMu  sync.RWMutex // Held for writing while a file is skipped or wanted again
+
+	mu      sync.Mutex
+	handles map[int]*os.File
+}
+
+// NewFileStorage creates the storage for a torrent in a download directory, empty files are created right away
+// since no piece ever writes to them. wanted tells which files are downloaded, nil means all of them, files that
+// are not wanted are never created and the bytes of pieces shared with wanted files go to a part file instead. Those
+// bytes move into a file that is wanted again and out of a file that is skipped since the last run
+func NewFileStorage(dir string, layout Layout, wanted []bool) (*FileStorage, error) {
+	if err := layout.validate(); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStorage{
+		dir:     dir,
+		layout:  layout,
+		skipped: make([]bool, len(layout.Files)),
+		parts:   newPartFile(dir, layout),
+
+		handles: make(map[int]*os.File),
+	}
+
+	for i, file := range layout.Files {
+		fs.skipped[i] = wanted != nil && !wanted[i]
+		if !fs.skipped[i] && file.Length == 0 {
+			if _, err := fs.open(i); err != nil {
+				return nil, err
+			}
+		}
+		if err := fs.syncPart(i); err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+
+	return fs, nil
+}
+
+// SetWanted skips a file or downloads it again, the bytes it shares with other files move between the file and
+// the part file
+func (fs *FileStorage) SetWanted(file int, wanted bool) error {
+	if file < 0 || file >= len(fs.skipped) {
+		return fmt.Errorf("file %d does not exist, the torrent has %d files", file, len(fs.skipped))
+	}
+
+	fs.skipMu.Lock()
+	defer fs.skipMu.Unlock()
+
+	if fs.skipped[file] != wanted {
+		return nil
+	}
+	fs.skipped[file] = !wanted
+	if wanted && fs.layout.Files[file].Length == 0 {
+		if _, err := fs.open(file); err != nil {
+			return err
+		}
+	}
+
+	return fs.syncPart(file)
+}
+
+// syncPart moves the bytes a file shares with other files between the file and the part file, the caller must
+// hold the skip lock or be the constructor
+func (fs *FileStorage) syncPart(i int) error {
+	readFile := func(p []byte, off int64) error {
+		return readFileAt(filepath.Join(fs.dir, fs.layout.Files[i].RelativePath()), p, off)
+	}
+	writeFile := func(p []byte, off int64) error {
+		f, err := fs.open(i)
+		if err != nil {
+			return err
+		}
+		if _, err := f.WriteAt(p, off); err != nil {
+			return fmt.Errorf("error writing %s: %w", fs.layout.Files[i].RelativePath(), err)
+		}
+		return nil
+	}
+
+	return fs.parts.sync(fs.layout, i, fs.skipped[i], readFile, writeFile)
+}
+
+// WriteAt writes data into a piece, spreading it over the files it covers, bytes of skipped files go to the part
+// file
+func (fs *FileStorage) WriteAt(piece int, p []byte, off int64) (int, error) {
+	parts, err := fs.layout.spans(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	fs.skipMu.RLock()
+	defer fs.skipMu.RUnlock()
+
+	written := 0
+	for _, part := range parts {
+		if fs.skipped[part.file] {
+			if err := fs.parts.WriteAt(p[part.bufOffset:part.bufOffset+part.length], fs.layout.Files[part.file].Offset+part.fileOffset); err != nil {
+				return written, err
+			}
+			written += part.length
+			continue
+		}
+		f, err := fs.open(part.file)
+		if err != nil {
+			return written, err
+		}
+		n, err := f.WriteAt(p[part.bufOffset:part.bufOffset+part.length], part.fileOffset)
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("error writing %s: %w", fs.layout.Files[part.file].RelativePath(), err)
+		}
+	}
+
+	return written, nil
+}
+
+// ReadAt reads data of a piece from the files it covers, bytes of skipped files come from the part file
+func (fs *FileStorage) ReadAt(piece int, p []byte, off int64) (int, error) {
+	parts, err := fs.layout.spans(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	fs.skipMu.RLock()
+	defer fs.skipMu.RUnlock()
+
+	read := 0
+	for _, part := range parts {
+		if fs.skipped[part.file] {
+			if err := fs.parts.ReadAt(p[part.bufOffset:part.bufOffset+part.length], fs.layout.Files[part.file].Offset+part.fileOffset); err != nil {
+				return read, err
+			}
+			read += part.length
+			continue
+		}
+		f, err := fs.open(part.file)
+		if err != nil {
+			return read, err
+		}
+		n, err := f.ReadAt(p[part.bufOffset:part.bufOffset+part.length], part.fileOffset)
+		read += n
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return read, io.ErrUnexpectedEOF
+			}
+			return read, fmt.Errorf("error reading %s: %w", fs.layout.Files[part.file].RelativePath(), err)
+		}
+	}
+
+	return read, nil
+}
+
+// MarkComplete does nothing for files, the data of a verified piece is already where it belongs
+func (fs *FileStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+// Close closes every open file
+func (fs *FileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var errs []error
+	if err := fs.parts.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	for i, f := range fs.handles {
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		delete(fs.handles, i)
+	}
+
+	return errors.Join(errs...)
+}
+
+// open returns the handle of a file, creating the file and its directories on first use
+func (fs *FileStorage) open(index int) (*os.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if f, ok := fs.handles[index]; ok {
+		return f, nil
+	}
+
+	path := filepath.Join(fs.dir, fs.layout.Files[index].RelativePath())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory for %s: %w", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	fs.handles[index] = f
+
+	return f, nil
+}
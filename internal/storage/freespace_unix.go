@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to us on the file system of a directory
+func freeSpace(dir string) (uint64, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, false, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true, nil
+}
+
+// allocatedSize returns the disk space a file takes, which is less than its size when it is sparse
+func allocatedSize(info os.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+
+	return info.Size()
+}
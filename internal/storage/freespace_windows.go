@@ -0,0 +1,31 @@
+//go:build windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the bytes available to us on the volume of a directory
+func freeSpace(dir string) (uint64, bool, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, false, err
+	}
+
+	var available uint64
+	if ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&available)), 0, 0); ok == 0 {
+		return 0, false, err
+	}
+
+	return available, true, nil
+}
+
+// allocatedSize returns the size of a file, sparse files are not told apart on Windows
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"fmt"
+	"sync"
+)
+
+// MemoryStorage keeps the torrent content in memory, it is meant for tests and small torrents
+type MemoryStorage struct {
+	layout Layout
+
+	mu     sync.RWMutex
+	pieces map[int][]byte
+}
+
+// NewMemoryStorage creates an in-memory storage for a torrent
+func NewMemoryStorage(layout Layout) *MemoryStorage {
+	return &MemoryStorage{
+		layout: layout,
+		pieces: make(map[int][]byte),
+	}
+}
+
+// WriteAt writes data into a piece, the piece buffer is allocated on the first write
+func (ms *MemoryStorage) WriteAt(piece int, p []byte, off int64) (int, error) {
+	if _, err := ms.layout.spans(piece, off, len(p)); err != nil {
+		return 0, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	data, ok := ms.pieces[piece]
+	if !ok {
+		data = make([]byte, ms.layout.PieceSize(piece))
+		ms.pieces[piece] = data
+	}
+
+	return copy(data[off:], p), nil
+}
+
+// ReadAt reads data of a piece, parts that were never written read as zeros
+func (ms *MemoryStorage) ReadAt(piece int, p []byte, off int64) (int, error) {
+	if _, err := ms.layout.spans(piece, off, len(p)); err != nil {
+		return 0, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	data, ok := ms.pieces[piece]
+	if !ok {
+		clear(p)
+		return len(p), nil
+	}
+
+	return copy(p, data[off:]), nil
+}
+
+// MarkComplete checks that the piece was written
+func (ms *MemoryStorage) MarkComplete(piece int) error {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if _, ok := ms.pieces[piece]; !ok {
+		return fmt.Errorf("piece %d was never written", piece)
+	}
+
+	return nil
+}
+
+// Close releases the stored pieces
+func (ms *MemoryStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	clear(ms.pieces)
+
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package storage
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const mmapSupported = false
+
+// MmapStorage is not available on this platform
+type MmapStorage struct{}
+
+// NewMmapStorage always fails on platforms without mmap support
+func NewMmapStorage(dir string, layout Layout, wanted []bool) (*MmapStorage, error) {
+	return nil, fmt.Errorf("mmap storage is not supported on %s", runtime.GOOS)
+}
+
+// WriteAt is never reached since NewMmapStorage fails
+func (ms *MmapStorage) WriteAt(piece int, p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("mmap storage is not supported on %s", runtime.GOOS)
+}
+
+// ReadAt is never reached since NewMmapStorage fails
+func (ms *MmapStorage) ReadAt(piece int, p []byte, off int64) (int, error) {
+	return 0, fmt.Errorf("mmap storage is not supported on %s", runtime.GOOS)
+}
+
+// MarkComplete is never reached since NewMmapStorage fails
+func (ms *MmapStorage) MarkComplete(piece int) error {
+	return fmt.Errorf("mmap storage is not supported on %s", runtime.GOOS)
+}
+
+// SetWanted is never reached since NewMmapStorage fails
+func (ms *MmapStorage) SetWanted(file int, wanted bool) error {
+	return fmt.Errorf("mmap storage is not supported on %s", runtime.GOOS)
+}
+
+// Close does nothing
+func (ms *MmapStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,260 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+const mmapSupported = true
+
+// MmapStorage stores the torrent content in files that are memory mapped for reading and writing
+type MmapStorage struct {
+	dir    string
+	layout Layout
+
+	skipped []bool    // Files that are not downloaded, they are never created
+	parts   *partFile // Bytes of skipped files in pieces shared with wanted files
+
+	mu       sync.RWMutex
+	files    []*os.File // nil for skipped files
+	mappings [][]byte   // One shared mapping per file, nil for empty and skipped files
+	closed   bool
+}
+
+// NewMmapStorage creates the files of a torrent in a download directory at their full size and maps them into
+// memory. wanted tells which files are downloaded, nil means all of them, files that are not wanted are never
+// created and the bytes of pieces shared with wanted files go to a part file instead. Those bytes move into a file
+// that is wanted again and out of a file that is skipped since the last run
+func NewMmapStorage(dir string, layout Layout, wanted []bool) (*MmapStorage, error) {
+	if err := layout.validate(); err != nil {
+		return nil, err
+	}
+
+	ms := &MmapStorage{
+		dir:      dir,
+		layout:   layout,
+		skipped:  make([]bool, len(layout.Files)),
+		parts:    newPartFile(dir, layout),
+		files:    make([]*os.File, len(layout.Files)),
+		mappings: make([][]byte, len(layout.Files)),
+	}
+
+	for i := range layout.Files {
+		ms.skipped[i] = wanted != nil && !wanted[i]
+		if !ms.skipped[i] {
+			if err := ms.mapFile(i); err != nil {
+				ms.Close()
+				return nil, err
+			}
+		}
+		if err := ms.syncPart(i); err != nil {
+			ms.Close()
+			return nil, err
+		}
+	}
+
+	return ms, nil
+}
+
+// SetWanted skips a file or downloads it again, the bytes it shares with other files move between the mapping and
+// the part file. A file that is wanted again is mapped and the mapping of a skipped file is released
+func (ms *MmapStorage) SetWanted(file int, wanted bool) error {
+	if file < 0 || file >= len(ms.skipped) {
+		return fmt.Errorf("file %d does not exist, the torrent has %d files", file, len(ms.skipped))
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.closed {
+		return fmt.Errorf("mmap storage is closed")
+	}
+	if ms.skipped[file] != wanted {
+		return nil
+	}
+
+	if wanted {
+		if err := ms.mapFile(file); err != nil {
+			return err
+		}
+		ms.skipped[file] = false
+		return ms.syncPart(file)
+	}
+
+	ms.skipped[file] = true
+	if err := ms.syncPart(file); err != nil {
+		return err
+	}
+	return ms.unmapFile(file)
+}
+
+// syncPart moves the bytes a file shares with other files between its mapping and the part file, the caller must
+// hold the lock or be the constructor
+func (ms *MmapStorage) syncPart(i int) error {
+	readFile := func(p []byte, off int64) error {
+		if ms.mappings[i] == nil {
+			return readFileAt(filepath.Join(ms.dir, ms.layout.Files[i].RelativePath()), p, off)
+		}
+		copy(p, ms.mappings[i][off:])
+		return nil
+	}
+	writeFile := func(p []byte, off int64) error {
+		if ms.mappings[i] == nil {
+			return fmt.Errorf("%s is not mapped", ms.layout.Files[i].RelativePath())
+		}
+		copy(ms.mappings[i][off:], p)
+		return nil
+	}
+
+	return ms.parts.sync(ms.layout, i, ms.skipped[i], readFile, writeFile)
+}
+
+// unmapFile releases the mapping of a file and closes it, the caller must hold the lock
+func (ms *MmapStorage) unmapFile(i int) error {
+	var errs []error
+	if ms.mappings[i] != nil {
+		if err := syscall.Munmap(ms.mappings[i]); err != nil {
+			errs = append(errs, err)
+		}
+		ms.mappings[i] = nil
+	}
+	if ms.files[i] != nil {
+		if err := ms.files[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+		ms.files[i] = nil
+	}
+
+	return errors.Join(errs...)
+}
+
+// mapFile creates a file at its full size and maps it into memory, the caller must hold the lock or be the
+// constructor, which has the storage to itself
+func (ms *MmapStorage) mapFile(i int) error {
+	file := ms.layout.Files[i]
+	path := filepath.Join(ms.dir, file.RelativePath())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %s: %w", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", path, err)
+	}
+	ms.files[i] = f
+
+	if file.Length == 0 {
+		return nil
+	}
+
+	// A file has to cover the whole mapping, extending it keeps it sparse
+	if info, err := f.Stat(); err != nil || info.Size() < file.Length {
+		if err := f.Truncate(file.Length); err != nil {
+			return fmt.Errorf("error sizing %s: %w", path, err)
+		}
+	}
+
+	mapping, err := syscall.Mmap(int(f.Fd()), 0, int(file.Length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("error mapping %s: %w", path, err)
+	}
+	ms.mappings[i] = mapping
+
+	return nil
+}
+
+// WriteAt copies data of a piece into the mappings of the files it covers, bytes of skipped files go to the part
+// file
+func (ms *MmapStorage) WriteAt(piece int, p []byte, off int64) (int, error) {
+	parts, err := ms.layout.spans(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.closed {
+		return 0, fmt.Errorf("mmap storage is closed")
+	}
+	written := 0
+	for _, part := range parts {
+		data := p[part.bufOffset : part.bufOffset+part.length]
+		if ms.skipped[part.file] {
+			if err := ms.parts.WriteAt(data, ms.layout.Files[part.file].Offset+part.fileOffset); err != nil {
+				return written, err
+			}
+			written += part.length
+			continue
+		}
+		if ms.mappings[part.file] == nil {
+			return written, fmt.Errorf("%s is not mapped", ms.layout.Files[part.file].RelativePath())
+		}
+		written += copy(ms.mappings[part.file][part.fileOffset:], data)
+	}
+
+	return written, nil
+}
+
+// ReadAt copies data of a piece out of the mappings of the files it covers, bytes of skipped files come from the
+// part file
+func (ms *MmapStorage) ReadAt(piece int, p []byte, off int64) (int, error) {
+	parts, err := ms.layout.spans(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if ms.closed {
+		return 0, fmt.Errorf("mmap storage is closed")
+	}
+	read := 0
+	for _, part := range parts {
+		data := p[part.bufOffset : part.bufOffset+part.length]
+		if ms.skipped[part.file] {
+			if err := ms.parts.ReadAt(data, ms.layout.Files[part.file].Offset+part.fileOffset); err != nil {
+				return read, err
+			}
+			read += part.length
+			continue
+		}
+		if ms.mappings[part.file] == nil {
+			return read, fmt.Errorf("%s is not mapped", ms.layout.Files[part.file].RelativePath())
+		}
+		read += copy(data, ms.mappings[part.file][part.fileOffset:])
+	}
+
+	return read, nil
+}
+
+// MarkComplete does nothing, the kernel writes the shared mappings back to the files
+func (ms *MmapStorage) MarkComplete(piece int) error {
+	return nil
+}
+
+// Close unmaps and closes every file
+func (ms *MmapStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.closed = true
+	var errs []error
+	if err := ms.parts.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	for i := range ms.files {
+		if err := ms.unmapFile(i); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
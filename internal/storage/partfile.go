@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// partFile keeps the bytes of skipped files that pieces shared with wanted files carry, so the skipped files are
+// never created and those pieces still read back whole. The bytes sit at their offset within the torrent content
+// in a sparse file next to the content, which is only created once a shared piece is written
+type partFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// newPartFile returns the part file of a torrent in a download directory, named after the top level file or
+// directory of the torrent
+func newPartFile(dir string, layout Layout) *partFile {
+	name := "torrent"
+	if len(layout.Files) > 0 && len(layout.Files[0].Path) > 0 {
+		name = layout.Files[0].Path[0]
+	}
+
+	return &partFile{path: filepath.Join(dir, "."+name+".parts")}
+}
+
+// WriteAt writes p at offset off of the torrent content
+func (pf *partFile) WriteAt(p []byte, off int64) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.f == nil {
+		f, err := os.OpenFile(pf.path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening %s: %w", pf.path, err)
+		}
+		pf.f = f
+	}
+
+	if _, err := pf.f.WriteAt(p, off); err != nil {
+		return fmt.Errorf("error writing %s: %w", pf.path, err)
+	}
+
+	return nil
+}
+
+// ReadAt reads len(p) bytes at offset off of the torrent content, bytes that were never written read as zeros
+func (pf *partFile) ReadAt(p []byte, off int64) error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.f == nil {
+		f, err := os.OpenFile(pf.path, os.O_RDWR, 0644)
+		if errors.Is(err, fs.ErrNotExist) {
+			clear(p)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error opening %s: %w", pf.path, err)
+		}
+		pf.f = f
+	}
+
+	n, err := pf.f.ReadAt(p, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading %s: %w", pf.path, err)
+	}
+	clear(p[n:])
+
+	return nil
+}
+
+// Close closes the part file if it was opened
+func (pf *partFile) Close() error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.f == nil {
+		return nil
+	}
+	err := pf.f.Close()
+	pf.f = nil
+	return err
+}
+
+// boundaries returns the ranges of a file that share a piece with other files as offsets within the file, they are
+// the only bytes of a skipped file that are ever written
+func (l Layout) boundaries(i int) [][2]int64 {
+	file := l.Files[i]
+	if file.Length == 0 || l.PieceLength <= 0 {
+		return nil
+	}
+
+	pieceLength := int64(l.PieceLength)
+	start, end := file.Offset, file.Offset+file.Length
+	var ranges [][2]int64
+	if start%pieceLength != 0 {
+		ranges = append(ranges, [2]int64{0, min(end, (start/pieceLength+1)*pieceLength) - start})
+	}
+	// The last piece of the file is shared when the next file starts in it, and the range is new unless the file
+	// ends in the piece it starts in
+	if tail := end / pieceLength * pieceLength; end%pieceLength != 0 && end < l.TotalLength && (len(ranges) == 0 || tail-start >= ranges[0][1]) {
+		ranges = append(ranges, [2]int64{max(tail, start) - start, file.Length})
+	}
+
+	return ranges
+}
+
+// sync moves the bytes a file shares with other files between the file and the part file. A skipped file takes
+// the bytes of the file where the part file has none, a wanted file takes the bytes of the part file which are
+// cleared there, so the part file only ever holds bytes written while the file was skipped
+func (pf *partFile) sync(layout Layout, i int, skipped bool, readFile, writeFile func(p []byte, off int64) error) error {
+	offset := layout.Files[i].Offset
+	for _, r := range layout.boundaries(i) {
+		parked := make([]byte, r[1]-r[0])
+		if err := pf.ReadAt(parked, offset+r[0]); err != nil {
+			return err
+		}
+
+		if skipped {
+			if !isZero(parked) {
+				continue
+			}
+			if err := readFile(parked, r[0]); err != nil {
+				return err
+			}
+			if isZero(parked) {
+				continue
+			}
+			if err := pf.WriteAt(parked, offset+r[0]); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if isZero(parked) {
+			continue
+		}
+		if err := writeFile(parked, r[0]); err != nil {
+			return err
+		}
+		if err := pf.WriteAt(make([]byte, len(parked)), offset+r[0]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readFileAt reads len(p) bytes at offset off of a file that is not open, a missing file and bytes past its end
+// read as zeros
+func readFileAt(path string, p []byte, off int64) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		clear(p)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	n, err := f.ReadAt(p, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	clear(p[n:])
+
+	return nil
+}
+
+// isZero reports whether every byte of p is zero
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	MaxComponentLength = 255  // Longest file or directory name most filesystems accept
+	MaxPathLength      = 4096 // Longest relative path we are willing to create
+)
+
+// reservedNames are file names Windows refuses regardless of their extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// SanitizePath checks the path components of a torrent file so the file can not end up outside the download
+// directory. Empty and "." components are dropped and components that are only unsafe on some filesystems are
+// rewritten, while traversal, separators and overlong names are rejected. A rewritten name is cut back to
+// MaxComponentLength
+func SanitizePath(components []string) ([]string, error) {
+	var clean []string
+	total := 0
+
+	for _, component := range components {
+		if component == "" || component == "." {
+			continue
+		}
+		if component == ".." {
+			return nil, fmt.Errorf("path component %q traverses out of the download directory", component)
+		}
+		if strings.ContainsAny(component, "/\\\x00") {
+			return nil, fmt.Errorf("path component %q contains a path separator or NUL byte", component)
+		}
+		if len(component) > MaxComponentLength {
+			return nil, fmt.Errorf("path component of %d bytes is longer than %d", len(component), MaxComponentLength)
+		}
+
+		component = rewriteComponent(component)
+		clean = append(clean, component)
+		total += len(component) + 1
+	}
+
+	if len(clean) == 0 {
+		return nil, fmt.Errorf("path is empty")
+	}
+	if total-1 > MaxPathLength {
+		return nil, fmt.Errorf("path of %d bytes is longer than %d", total-1, MaxPathLength)
+	}
+
+	return clean, nil
+}
+
+// rewriteComponent replaces the characters and names some filesystems can not store, e.g. drive letters,
+// control characters, trailing dots and reserved device names
+func rewriteComponent(component string) string {
+	rewritten := []byte(component)
+	for i, c := range rewritten {
+		if c < 0x20 || strings.IndexByte(`<>:"|?*`, c) >= 0 {
+			rewritten[i] = '_'
+		}
+	}
+
+	if last := len(rewritten) - 1; rewritten[last] == '.' || rewritten[last] == ' ' {
+		rewritten[last] = '_'
+	}
+
+	base, _, _ := strings.Cut(string(rewritten), ".")
+	if reservedNames[strings.ToUpper(base)] {
+		name := "_" + string(rewritten)
+		// The extension is kept unless the rest of the name is only the prefixed reserved name
+		ext := filepath.Ext(name)
+		if len(name)-len(ext) <= len(base)+1 {
+			ext = ""
+		}
+		return fitComponent(strings.TrimSuffix(name, ext), ext)
+	}
+
+	return string(rewritten)
+}
+
+// fitComponent joins stem and suffix into a name of at most MaxComponentLength bytes, cutting the end of the stem
+// at a character boundary when the name is too long. A suffix that leaves no room for the stem is cut as well
+func fitComponent(stem, suffix string) string {
+	if len(suffix) >= MaxComponentLength {
+		stem, suffix = stem+suffix, ""
+	}
+	if limit := MaxComponentLength - len(suffix); len(stem) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(stem[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = limit // Not UTF-8, the bytes are cut wherever they have to be
+		}
+		stem = stem[:cut]
+	}
+
+	name := []byte(stem + suffix)
+	if last := len(name) - 1; name[last] == '.' || name[last] == ' ' {
+		name[last] = '_'
+	}
+	return string(name)
+}
+
+// SanitizeFiles sanitizes the path of every file of a torrent. Files whose paths collide once normalized are
+// renamed with a numbered suffix, and a file whose path is also the directory of another file is rejected.
+// Errors name the offending file
+func SanitizeFiles(files []File) ([]File, error) {
+	sanitized := make([]File, len(files))
+	taken := make(map[string]bool)
+	directories := make(map[string]int)
+
+	for i, file := range files {
+		path, err := SanitizePath(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("file %d (%s) rejected: %w", i, strings.Join(file.Path, "/"), err)
+		}
+
+		// Compare case insensitively since the download directory may be on a case insensitive filesystem
+		key := strings.ToLower(strings.Join(path, "/"))
+		last := len(path) - 1
+		name := path[last]
+		ext := filepath.Ext(name)
+		for n := 1; taken[key]; n++ {
+			path[last] = fitComponent(strings.TrimSuffix(name, ext), "."+strconv.Itoa(n)+ext)
+			key = strings.ToLower(strings.Join(path, "/"))
+		}
+		taken[key] = true
+		if len(key) > MaxPathLength {
+			return nil, fmt.Errorf("file %d (%s) rejected: renamed path of %d bytes is longer than %d", i, strings.Join(file.Path, "/"), len(key), MaxPathLength)
+		}
+
+		for depth := 1; depth < len(path); depth++ {
+			directories[strings.ToLower(strings.Join(path[:depth], "/"))] = i
+		}
+
+		sanitized[i] = file
+		sanitized[i].Path = path
+	}
+
+	for i, file := range sanitized {
+		if other, ok := directories[strings.ToLower(strings.Join(file.Path, "/"))]; ok {
+			return nil, fmt.Errorf("file %d (%s) rejected: it is also the directory of file %d", i, file.RelativePath(), other)
+		}
+	}
+
+	return sanitized, nil
+}
+
+// validate checks that every file of the layout stays inside the download directory
+func (l Layout) validate() error {
+	for i, file := range l.Files {
+		if path := file.RelativePath(); !filepath.IsLocal(path) {
+			return fmt.Errorf("file %d (%s) is not inside the download directory", i, path)
+		}
+	}
+
+	return nil
+}
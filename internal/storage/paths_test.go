@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	tests := []struct {
+		input    []string
+		expected string
+		hasError bool
+	}{
+		{[]string{"dir", "file.txt"}, "dir/file.txt", false},
+		{[]string{"", "dir", ".", "file.txt"}, "dir/file.txt", false}, // Empty and "." components are dropped
+		{[]string{"..", "etc", "passwd"}, "", true},                   // Traversal
+		{[]string{"dir", "..", "..", "x"}, "", true},                  // Traversal in the middle
+		{[]string{"/etc", "passwd"}, "", true},                        // Absolute path
+		{[]string{"dir\\..\\x"}, "", true},                            // Windows separators
+		{[]string{"a\x00b"}, "", true},                                // NUL byte
+		{[]string{"", "."}, "", true},                                 // Nothing left
+		{[]string{strings.Repeat("a", 256)}, "", true},                // Component too long
+		{[]string{"C:", "file"}, "C_/file", false},                    // Drive letter
+		{[]string{"CON"}, "_CON", false},                              // Reserved name
+		{[]string{"nul.txt"}, "_nul.txt", false},                      // Reserved name with extension
+		{[]string{"trailing."}, "trailing_", false},                   // Trailing dot
+		{[]string{"a?b*c"}, "a_b_c", false},                           // Invalid characters
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.input, "/"), func(t *testing.T) {
+			result, err := SanitizePath(test.input)
+			if test.hasError {
+				if err == nil {
+					t.Errorf("expected error for input %q, but got %q", test.input, result)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("unexpected error for input %q: %v", test.input, err)
+				} else if strings.Join(result, "/") != test.expected {
+					t.Errorf("expected %s, got %s for input %q", test.expected, strings.Join(result, "/"), test.input)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizePathComponentLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"longest name", strings.Repeat("a", 255), strings.Repeat("a", 255)},
+		{"longest reserved name", "CON." + strings.Repeat("a", 247) + ".txt", "_CON." + strings.Repeat("a", 246) + ".txt"},
+		{"longest reserved name ending in a dot", "CON." + strings.Repeat("a", 250) + ".", "_CON." + strings.Repeat("a", 250)},
+		{"reserved name with a long extension", "CON." + strings.Repeat("a", 251), "_CON." + strings.Repeat("a", 250)},
+		{"reserved name cut in a character", "AUX." + strings.Repeat("é", 125) + "x", "_AUX." + strings.Repeat("é", 125)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := SanitizePath([]string{test.input})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(result[0]) > MaxComponentLength {
+				t.Errorf("expected at most %d bytes, got %d", MaxComponentLength, len(result[0]))
+			}
+			if result[0] != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, result[0])
+			}
+		})
+	}
+}
+
+func TestSanitizePathTotalLength(t *testing.T) {
+	var components []string
+	for range 20 {
+		components = append(components, strings.Repeat("a", 250))
+	}
+
+	if _, err := SanitizePath(components); err == nil {
+		t.Errorf("expected an error for a path longer than %d bytes, but got none", MaxPathLength)
+	}
+}
+
+func TestSanitizeFiles(t *testing.T) {
+	files := []File{
+		{Path: []string{"t", "a.txt"}},
+		{Path: []string{"t", "A.txt"}},
+		{Path: []string{"t", ".", "a.txt"}},
+		{Path: []string{"t", "dir", "b"}},
+	}
+
+	sanitized, err := SanitizeFiles(files)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"t/a.txt", "t/A.1.txt", "t/a.2.txt", "t/dir/b"}
+	for i, file := range sanitized {
+		if path := strings.Join(file.Path, "/"); path != expected[i] {
+			t.Errorf("expected %s, got %s for file %d", expected[i], path, i)
+		}
+	}
+
+	long := strings.Repeat("a", 251) + ".txt"
+	sanitized, err = SanitizeFiles([]File{{Path: []string{long}}, {Path: []string{long}}, {Path: []string{"." + strings.Repeat("b", 254)}}, {Path: []string{"." + strings.Repeat("B", 254)}}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected = []string{long, strings.Repeat("a", 249) + ".1.txt", "." + strings.Repeat("b", 254), ".1." + strings.Repeat("B", 252)}
+	for i, file := range sanitized {
+		if path := strings.Join(file.Path, "/"); path != expected[i] || len(path) > MaxComponentLength {
+			t.Errorf("expected %s, got %s for file %d", expected[i], path, i)
+		}
+	}
+
+	_, err = SanitizeFiles([]File{{Path: []string{"t", "dir"}}, {Path: []string{"t", "dir", "b"}}})
+	if err == nil || !strings.Contains(err.Error(), "file 0") {
+		t.Errorf("expected an error naming file 0 for a file that is also a directory, got %v", err)
+	}
+
+	_, err = SanitizeFiles([]File{{Path: []string{"t", "ok"}}, {Path: []string{"t", "..", "x"}}})
+	if err == nil || !strings.Contains(err.Error(), "file 1") {
+		t.Errorf("expected an error naming file 1 for a traversal path, got %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	PreallocNone   = "none"   // Files are created and grow as pieces are written to them
+	PreallocSparse = "sparse" // Files are created at their full size up front without allocating disk space
+	PreallocFull   = "full"   // Disk space for the files is allocated up front, which keeps them from fragmenting
+
+	zeroChunkSize = 1 << 20
+)
+
+// errFallocateUnsupported means the platform can not allocate disk space without writing to it
+var errFallocateUnsupported = errors.New("fallocate is not supported")
+
+// Preallocate creates the files of a torrent in a download directory according to a preallocation mode. wanted
+// tells which files are downloaded, nil means all of them, files that are not wanted are left alone
+func Preallocate(dir string, layout Layout, mode string, wanted []bool) error {
+	switch mode {
+	case PreallocNone:
+		return nil
+	case PreallocSparse, PreallocFull:
+	default:
+		return fmt.Errorf("unknown preallocation mode %q, expected %s, %s or %s", mode, PreallocNone, PreallocSparse, PreallocFull)
+	}
+
+	if err := layout.validate(); err != nil {
+		return err
+	}
+
+	for i, file := range layout.Files {
+		if wanted != nil && !wanted[i] {
+			continue
+		}
+		if err := preallocateFile(filepath.Join(dir, file.RelativePath()), file.Length, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// preallocateFile sizes a single file, data already in the file is never overwritten
+func preallocateFile(path string, length int64, mode string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating directory for %s: %w", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	if mode == PreallocFull {
+		err := fallocate(f, length)
+		if errors.Is(err, errFallocateUnsupported) {
+			// Writing zeros allocates the space everywhere, only past the end so existing data survives
+			err = writeZeros(f, info.Size(), length)
+		}
+		if err != nil {
+			return fmt.Errorf("error allocating %d bytes for %s: %w", length, path, err)
+		}
+		return nil
+	}
+
+	if info.Size() < length {
+		if err := f.Truncate(length); err != nil {
+			return fmt.Errorf("error sizing %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// writeZeros fills a file with zeros from an offset up to a length
+func writeZeros(f *os.File, from, length int64) error {
+	zeros := make([]byte, zeroChunkSize)
+	for off := from; off < length; off += zeroChunkSize {
+		n := min(int64(zeroChunkSize), length-off)
+		if _, err := f.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckFreeSpace fails when the file system of the download directory does not have room for the wanted files
+// of a torrent, disk space already taken by the files counts as available. Platforms that can not report free
+// space pass the check
+func CheckFreeSpace(dir string, layout Layout, wanted []bool) error {
+	var needed int64
+	for i, file := range layout.Files {
+		if wanted != nil && !wanted[i] {
+			continue
+		}
+		needed += file.Length
+		if info, err := os.Stat(filepath.Join(dir, file.RelativePath())); err == nil {
+			needed -= min(allocatedSize(info), file.Length)
+		}
+	}
+	if needed <= 0 {
+		return nil
+	}
+
+	available, ok, err := freeSpace(existingParent(dir))
+	if err != nil {
+		return fmt.Errorf("error checking free space in %s: %w", dir, err)
+	}
+	if ok && uint64(needed) > available {
+		return fmt.Errorf("not enough free space in %s: the torrent needs %d more bytes but only %d are available", dir, needed, available)
+	}
+
+	return nil
+}
+
+// existingParent returns the directory itself or its closest parent that exists, the download directory is only
+// created once the first file is
+func existingParent(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
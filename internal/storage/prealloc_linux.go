@@ -0,0 +1,22 @@
+//go:build linux
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocate allocates disk space for a file up to a length without changing data already in it
+func fallocate(f *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return errFallocateUnsupported
+	}
+
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// fallocate is only available on Linux, elsewhere space is allocated by writing zeros
+func fallocate(f *os.File, length int64) error {
+	return errFallocateUnsupported
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreallocate(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected int64 // Size of the wanted file afterwards, -1 when it is not created
+		hasError bool
+	}{
+		{PreallocNone, -1, false},
+		{PreallocSparse, 3000, false},
+		{PreallocFull, 3000, false},
+		{"bogus", -1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			dir := t.TempDir()
+			layout := NewLayout([]File{{Path: []string{"t", "a"}, Length: 3000}, {Path: []string{"t", "b"}, Length: 1000}}, 1024)
+
+			err := Preallocate(dir, layout, test.mode, []bool{true, false})
+			if test.hasError {
+				if err == nil {
+					t.Errorf("expected an error for mode %s, but got none", test.mode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			info, err := os.Stat(filepath.Join(dir, "t", "a"))
+			if test.expected < 0 {
+				if err == nil {
+					t.Errorf("expected no file for mode %s, got one of %d bytes", test.mode, info.Size())
+				}
+			} else if err != nil || info.Size() != test.expected {
+				t.Errorf("expected a file of %d bytes, got %v (%v)", test.expected, info, err)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "t", "b")); err == nil {
+				t.Errorf("expected the unwanted file not to be created")
+			}
+		})
+	}
+}
+
+func TestPreallocateKeepsData(t *testing.T) {
+	dir := t.TempDir()
+	layout := NewLayout([]File{{Path: []string{"a"}, Length: 2048}}, 1024)
+	data := bytes.Repeat([]byte{0xab}, 1024)
+
+	if err := os.WriteFile(filepath.Join(dir, "a"), data, 0644); err != nil {
+		t.Fatalf("unexpected error writing file: %v", err)
+	}
+	if err := Preallocate(dir, layout, PreallocFull, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatalf("unexpected error reading file: %v", err)
+	}
+	if len(content) != 2048 || !bytes.Equal(content[:1024], data) {
+		t.Errorf("expected 2048 bytes starting with the existing data, got %d bytes", len(content))
+	}
+}
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+
+	small := NewLayout([]File{{Path: []string{"a"}, Length: 1024}}, 1024)
+	if err := CheckFreeSpace(filepath.Join(dir, "missing", "dir"), small, nil); err != nil {
+		t.Errorf("unexpected error for a small torrent: %v", err)
+	}
+
+	available, ok, err := freeSpace(dir)
+	if err != nil || !ok {
+		t.Skipf("free space is not reported here: %v", err)
+	}
+
+	huge := NewLayout([]File{{Path: []string{"a"}, Length: int64(available/2) + 1}, {Path: []string{"b"}, Length: int64(available/2) + 1}}, 1<<20)
+	if err := CheckFreeSpace(dir, huge, nil); err == nil {
+		t.Errorf("expected an error for a torrent larger than the free space, but got none")
+	}
+	if err := CheckFreeSpace(dir, huge, []bool{true, false}); err != nil {
+		t.Errorf("unexpected error when only half of the torrent is wanted: %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+const (
+	BackendFile   = "file"
+	BackendMemory = "memory"
+	BackendMmap   = "mmap"
+)
+
+// Storage stores the content of a torrent piece by piece, offsets are relative to the start of the piece.
+// Implementations must be safe for concurrent use
+type Storage interface {
+	// ReadAt reads len(p) bytes of a piece starting at off
+	ReadAt(piece int, p []byte, off int64) (int, error)
+	// WriteAt writes p into a piece starting at off, pieces are written block by block before they are verified
+	WriteAt(piece int, p []byte, off int64) (int, error)
+	// MarkComplete is called once a piece has been fully written and its hash verified
+	MarkComplete(piece int) error
+	// Close flushes and releases the resources of the storage
+	Close() error
+}
+
+// Flusher is a storage that holds written data back, Flush writes everything held back to the storage underneath
+type Flusher interface {
+	Flush() error
+}
+
+// FileSelector is a storage that leaves skipped files alone, SetWanted tells it a file is skipped or wanted again
+// once the storage exists
+type FileSelector interface {
+	SetWanted(file int, wanted bool) error
+}
+
+// New creates a storage backend by name for a torrent, dir is ignored by the memory backend. wanted tells which
+// files are downloaded, nil means all of them, the file and mmap backends never create the others
+func New(backend, dir string, layout Layout, wanted []bool) (Storage, error) {
+	switch backend {
+	case BackendFile:
+		fs, err := NewFileStorage(dir, layout, wanted)
+		if err != nil {
+			return nil, err
+		}
+		return fs, nil
+	case BackendMemory:
+		return NewMemoryStorage(layout), nil
+	case BackendMmap:
+		ms, err := NewMmapStorage(dir, layout, wanted)
+		if err != nil {
+			return nil, err
+		}
+		return ms, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, expected %s, %s or %s", backend, BackendFile, BackendMemory, BackendMmap)
+	}
+}
+
+// File is a file of the torrent content, files are laid out back to back in the order of the torrent
+type File struct {
+	Path   []string // Path components relative to the download directory
+	Length int64
+	Offset int64 // Offset of the first byte of the file within the torrent content
+}
+
+// RelativePath returns the path of the file relative to the download directory
+func (f File) RelativePath() string {
+	return filepath.Join(f.Path...)
+}
+
+// Layout describes how the pieces of a torrent map onto its files
+type Layout struct {
+	Files       []File
+	PieceLength int
+	TotalLength int64
+}
+
+// NewLayout assigns each file its offset within the torrent content and returns the layout
+func NewLayout(files []File, pieceLength int) Layout {
+	layout := Layout{
+		Files:       make([]File, len(files)),
+		PieceLength: pieceLength,
+	}
+	for i, file := range files {
+		layout.Files[i] = file
+		layout.Files[i].Offset = layout.TotalLength
+		layout.TotalLength += file.Length
+	}
+
+	return layout
+}
+
+// PieceCount returns the number of pieces of the torrent
+func (l Layout) PieceCount() int {
+	if l.PieceLength <= 0 {
+		return 0
+	}
+
+	return int((l.TotalLength + int64(l.PieceLength) - 1) / int64(l.PieceLength))
+}
+
+// PieceSize returns the exact length of a piece, the last piece is usually shorter than the rest
+func (l Layout) PieceSize(piece int) int {
+	if piece < 0 || piece >= l.PieceCount() {
+		return 0
+	}
+
+	return int(min(int64(l.PieceLength), l.TotalLength-int64(piece)*int64(l.PieceLength)))
+}
+
+// PieceFiles returns the indexes of the files a piece covers
+func (l Layout) PieceFiles(piece int) []int {
+	parts, err := l.spans(piece, 0, l.PieceSize(piece))
+	if err != nil {
+		return nil
+	}
+
+	files := make([]int, 0, len(parts))
+	for _, part := range parts {
+		files = append(files, part.file)
+	}
+
+	return files
+}
+
+// span is the part of a file covered by a range of the torrent content
+type span struct {
+	file       int   // Index of the file in the layout
+	fileOffset int64 // Offset within the file
+	bufOffset  int   // Offset within the buffer being read or written
+	length     int
+}
+
+// spans maps a range of a piece onto the files it covers, ranges crossing file boundaries are split into one
+// span per file
+func (l Layout) spans(piece int, off int64, length int) ([]span, error) {
+	if off < 0 || length < 0 || off+int64(length) > int64(l.PieceSize(piece)) {
+		return nil, fmt.Errorf("range at offset %d with length %d is outside piece %d", off, length, piece)
+	}
+
+	var result []span
+	offset := int64(piece)*int64(l.PieceLength) + off
+	end := offset + int64(length)
+	for i, file := range l.Files {
+		fileEnd := file.Offset + file.Length
+		if fileEnd <= offset || file.Length == 0 {
+			continue
+		}
+		if file.Offset >= end {
+			break
+		}
+
+		start := max(offset, file.Offset)
+		stop := min(end, fileEnd)
+		result = append(result, span{
+			file:       i,
+			fileOffset: start - file.Offset,
+			bufOffset:  int(start - offset),
+			length:     int(stop - start),
+		})
+	}
+
+	return result, nil
+}
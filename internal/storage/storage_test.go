@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testLayout() Layout {
+	return NewLayout([]File{
+		{Path: []string{"album", "a.txt"}, Length: 5},
+		{Path: []string{"album", "empty"}, Length: 0},
+		{Path: []string{"album", "sub", "b.txt"}, Length: 3},
+		{Path: []string{"album", "c.txt"}, Length: 4},
+	}, 6)
+}
+
+func TestBackendsSpanFiles(t *testing.T) {
+	for _, backend := range []string{BackendFile, BackendMemory, BackendMmap} {
+		t.Run(backend, func(t *testing.T) {
+			if backend == BackendMmap && !mmapSupported {
+				t.Skip("mmap is not supported on this platform")
+			}
+
+			dir := t.TempDir()
+			s, err := New(backend, dir, testLayout(), nil)
+			if err != nil {
+				t.Fatalf("unexpected error creating storage: %v", err)
+			}
+
+			// The first piece crosses from a.txt into b.txt and the second from b.txt into c.txt
+			if _, err := s.WriteAt(0, []byte("hello "), 0); err != nil {
+				t.Fatalf("unexpected error writing first piece: %v", err)
+			}
+			if _, err := s.WriteAt(1, []byte("go"), 0); err != nil {
+				t.Fatalf("unexpected error writing second piece: %v", err)
+			}
+			if _, err := s.WriteAt(1, []byte("!abc"), 2); err != nil {
+				t.Fatalf("unexpected error writing second piece: %v", err)
+			}
+			for piece := range 2 {
+				if err := s.MarkComplete(piece); err != nil {
+					t.Errorf("unexpected error completing piece %d: %v", piece, err)
+				}
+			}
+
+			block := make([]byte, 4)
+			if _, err := s.ReadAt(0, block, 2); err != nil {
+				t.Fatalf("unexpected error reading across files: %v", err)
+			}
+			if !bytes.Equal(block, []byte("llo ")) {
+				t.Errorf("expected %q, got %q", "llo ", block)
+			}
+
+			if err := s.Close(); err != nil {
+				t.Fatalf("unexpected error closing storage: %v", err)
+			}
+
+			if backend == BackendMemory {
+				return
+			}
+			expected := map[string]string{
+				"album/a.txt":     "hello",
+				"album/empty":     "",
+				"album/sub/b.txt": " go",
+				"album/c.txt":     "!abc",
+			}
+			for path, content := range expected {
+				data, err := os.ReadFile(filepath.Join(dir, path))
+				if err != nil {
+					t.Errorf("unexpected error reading %s: %v", path, err)
+					continue
+				}
+				if string(data) != content {
+					t.Errorf("expected %q in %s, got %q", content, path, data)
+				}
+			}
+		})
+	}
+}
+
+func TestSpansOutOfRange(t *testing.T) {
+	layout := testLayout()
+
+	tests := []struct {
+		name   string
+		piece  int
+		offset int64
+		length int
+	}{
+		{"past the end of a piece", 0, 4, 4},
+		{"past the end of the last piece", 1, 5, 2},
+		{"negative offset", 0, -1, 2},
+		{"piece out of range", 2, 0, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := layout.spans(test.piece, test.offset, test.length); err == nil {
+				t.Errorf("expected an error for piece %d, offset %d and length %d, but got none", test.piece, test.offset, test.length)
+			}
+		})
+	}
+}
+
+func TestBackendsSkippedFiles(t *testing.T) {
+	for _, backend := range []string{BackendFile, BackendMmap} {
+		t.Run(backend, func(t *testing.T) {
+			if backend == BackendMmap && !mmapSupported {
+				t.Skip("mmap is not supported on this platform")
+			}
+
+			dir := t.TempDir()
+			wanted := []bool{true, true, false, false}
+			s, err := New(backend, dir, testLayout(), wanted)
+			if err != nil {
+				t.Fatalf("unexpected error creating storage: %v", err)
+			}
+
+			// The second piece is only in the skipped b.txt and c.txt, reading it creates neither
+			block := make([]byte, 6)
+			if _, err := s.ReadAt(1, block, 0); err != nil {
+				t.Fatalf("unexpected error reading a skipped piece: %v", err)
+			}
+			if !bytes.Equal(block, make([]byte, 6)) {
+				t.Errorf("expected zeros, got %q", block)
+			}
+
+			// The first piece ends in the skipped b.txt, whose byte goes to the part file
+			if _, err := s.WriteAt(0, []byte("hello "), 0); err != nil {
+				t.Fatalf("unexpected error writing a piece shared with a skipped file: %v", err)
+			}
+			if _, err := s.ReadAt(0, block, 0); err != nil {
+				t.Fatalf("unexpected error reading a piece shared with a skipped file: %v", err)
+			}
+			if !bytes.Equal(block, []byte("hello ")) {
+				t.Errorf("expected %q, got %q", "hello ", block)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatalf("unexpected error closing storage: %v", err)
+			}
+
+			for _, path := range []string{"album/sub/b.txt", "album/c.txt"} {
+				if _, err := os.Stat(filepath.Join(dir, path)); !os.IsNotExist(err) {
+					t.Errorf("expected skipped file %s not to be created, got %v", path, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dir, ".album.parts")); err != nil {
+				t.Errorf("expected the part file to be created, got %v", err)
+			}
+
+			// The bytes of the skipped file outlive the storage
+			s, err = New(backend, dir, testLayout(), wanted)
+			if err != nil {
+				t.Fatalf("unexpected error reopening storage: %v", err)
+			}
+			defer s.Close()
+			clear(block)
+			if _, err := s.ReadAt(0, block, 0); err != nil {
+				t.Fatalf("unexpected error reading a piece shared with a skipped file: %v", err)
+			}
+			if !bytes.Equal(block, []byte("hello ")) {
+				t.Errorf("expected %q after reopening, got %q", "hello ", block)
+			}
+		})
+	}
+}
+
+func TestBackendsSetWanted(t *testing.T) {
+	for _, backend := range []string{BackendFile, BackendMmap} {
+		t.Run(backend, func(t *testing.T) {
+			if backend == BackendMmap && !mmapSupported {
+				t.Skip("mmap is not supported on this platform")
+			}
+
+			dir := t.TempDir()
+			s, err := New(backend, dir, testLayout(), []bool{true, true, false, false})
+			if err != nil {
+				t.Fatalf("unexpected error creating storage: %v", err)
+			}
+			if _, err := s.WriteAt(0, []byte("hello "), 0); err != nil {
+				t.Fatalf("unexpected error writing: %v", err)
+			}
+			if _, err := s.WriteAt(1, []byte("world!"), 0); err != nil {
+				t.Fatalf("unexpected error writing: %v", err)
+			}
+
+			checkPieces := func(when string) {
+				t.Helper()
+				block := make([]byte, 6)
+				for piece, expected := range []string{"hello ", "world!"} {
+					if _, err := s.ReadAt(piece, block, 0); err != nil {
+						t.Fatalf("%s: unexpected error reading piece %d: %v", when, piece, err)
+					}
+					if string(block) != expected {
+						t.Errorf("%s: expected %q in piece %d, got %q", when, expected, piece, block)
+					}
+				}
+			}
+			checkFile := func(when, path, expected string) {
+				t.Helper()
+				data, err := os.ReadFile(filepath.Join(dir, path))
+				if err != nil {
+					t.Fatalf("%s: unexpected error reading %s: %v", when, path, err)
+				}
+				if string(data) != expected {
+					t.Errorf("%s: expected %q in %s, got %q", when, expected, path, data)
+				}
+			}
+
+			// The bytes of b.txt move out of the part file when it is wanted again and back when it is skipped
+			selector := s.(FileSelector)
+			if err := selector.SetWanted(2, true); err != nil {
+				t.Fatalf("unexpected error wanting b.txt: %v", err)
+			}
+			checkFile("after wanting b.txt", "album/sub/b.txt", " wo")
+			checkPieces("after wanting b.txt")
+			if err := selector.SetWanted(2, false); err != nil {
+				t.Fatalf("unexpected error skipping b.txt: %v", err)
+			}
+			checkPieces("after skipping b.txt")
+			if err := s.Close(); err != nil {
+				t.Fatalf("unexpected error closing storage: %v", err)
+			}
+
+			// A later run that wants every file takes the bytes of the part file too
+			s, err = New(backend, dir, testLayout(), nil)
+			if err != nil {
+				t.Fatalf("unexpected error reopening storage: %v", err)
+			}
+			defer s.Close()
+			checkPieces("after reopening")
+			checkFile("after reopening", "album/sub/b.txt", " wo")
+			checkFile("after reopening", "album/c.txt", "rld!")
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+const (
+	DefaultReadahead = 16 // Pieces raised ahead of every reader
+	shutdownTimeout  = 5 * time.Second
+)
+
+// Server serves the files of a torrent over HTTP while they download, reads block until the pieces they need
+// are verified and move a read-ahead window so those pieces are requested first
+type Server struct {
+	pm        *types.PieceManager
+	layout    storage.Layout
+	readahead int
+	readers   atomic.Int64 // Source of reader ids for the read-ahead windows
+}
+
+// NewServer creates a server for the files of a torrent, readahead is the number of pieces requested ahead of
+// every reader
+func NewServer(pm *types.PieceManager, layout storage.Layout, readahead int) *Server {
+	return &Server{pm: pm, layout: layout, readahead: readahead}
+}
+
+// ListenAndServe serves HTTP on an address until the context is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %w", addr, err)
+	}
+	log.Printf("Streaming server listening on %s", listener.Addr())
+
+	server := &http.Server{
+		Handler:     s.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("streaming server failed: %w", err)
+	}
+
+	return nil
+}
+
+// Handler returns the HTTP handler, "/" lists the files and "/<index>/<path>" serves a file with Range support
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", s.serveIndex)
+	mux.HandleFunc("GET /{file}/{path...}", s.serveFile)
+
+	return mux
+}
+
+// serveIndex lists the files of the torrent with links to stream them
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<!DOCTYPE html>\n<ul>")
+	for i, file := range s.layout.Files {
+		link := "/" + strconv.Itoa(i) + "/" + (&url.URL{Path: path.Join(file.Path...)}).EscapedPath()
+		fmt.Fprintf(w, "<li><a href=\"%s\">%s</a> (%d bytes)</li>\n", link, html.EscapeString(path.Join(file.Path...)), file.Length)
+	}
+	fmt.Fprintln(w, "</ul>")
+}
+
+// serveFile serves a single file, http.ServeContent takes care of Range and conditional requests
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("file"))
+	if err != nil || index < 0 || index >= len(s.layout.Files) {
+		http.NotFound(w, r)
+		return
+	}
+
+	file := s.layout.Files[index]
+	reader := &fileReader{
+		ctx:    r.Context(),
+		server: s,
+		id:     int(s.readers.Add(1)),
+		file:   file,
+	}
+	defer s.pm.ClearStreamWindow(reader.id)
+
+	name := ""
+	if len(file.Path) > 0 {
+		name = file.Path[len(file.Path)-1]
+	}
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
+
+// fileReader reads a file of the torrent, blocking until the piece under the read offset is verified
+type fileReader struct {
+	ctx    context.Context
+	server *Server
+	id     int
+	file   storage.File
+	offset int64
+}
+
+// Read reads from the piece under the offset, at most up to the end of that piece
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.offset >= r.file.Length {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	layout := r.server.layout
+	position := r.file.Offset + r.offset
+	index := int(position / int64(layout.PieceLength))
+	begin := int(position % int64(layout.PieceLength))
+	length := min(int64(len(p)), int64(layout.PieceSize(index)-begin), r.file.Length-r.offset)
+
+	r.server.pm.SetStreamWindow(r.id, index, r.server.readahead)
+	if err := r.server.pm.WaitPiece(r.ctx, index); err != nil {
+		return 0, err
+	}
+
+	data, err := r.server.pm.ReadBlock(index, begin, int(length))
+	if err != nil {
+		return 0, err
+	}
+
+	n := copy(p, data)
+	r.offset += int64(n)
+
+	return n, nil
+}
+
+// Seek moves the read offset, seeking never blocks since the file length is known up front
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.file.Length
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	r.offset = offset
+
+	return offset, nil
+}
@@ -0,0 +1,116 @@
+package stream
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestServeFileRange(t *testing.T) {
+	pieceLength := 100
+	layout := storage.NewLayout([]storage.File{
+		{Path: []string{"t", "a.txt"}, Length: 150},
+		{Path: []string{"t", "b.bin"}, Length: 250},
+	}, pieceLength)
+
+	content := make([]byte, layout.TotalLength)
+	for i := range content {
+		content[i] = byte(i)
+	}
+
+	pm := types.NewPieceManager(layout.PieceCount(), pieceLength, layout.TotalLength)
+	memory := storage.NewMemoryStorage(layout)
+	pm.SetStorage(memory)
+	pm.SetLayout(layout)
+	for i := range layout.PieceCount() {
+		pm.AddPiece(i, make([]byte, 20))
+		if _, err := memory.WriteAt(i, content[i*pieceLength:i*pieceLength+layout.PieceSize(i)], 0); err != nil {
+			t.Fatalf("unexpected error writing piece %d: %v", i, err)
+		}
+	}
+
+	// Only the pieces under the second file up to byte 300 of the torrent are verified at first
+	verified := types.NewBitfield(layout.PieceCount())
+	verified.SetPiece(1)
+	verified.SetPiece(2)
+	pm.SetDownloadedPieces(verified)
+
+	server := httptest.NewServer(NewServer(pm, layout, 2).Handler())
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		ranges   string
+		status   int
+		expected []byte
+	}{
+		{"range inside verified pieces", "/1/t/b.bin", "bytes=10-59", http.StatusPartialContent, content[160:210]},
+		{"range across a piece boundary", "/1/t/b.bin", "bytes=40-99", http.StatusPartialContent, content[190:250]},
+		{"missing file", "/2/t/c", "", http.StatusNotFound, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _ := http.NewRequest(http.MethodGet, server.URL+test.path, nil)
+			if test.ranges != "" {
+				request.Header.Set("Range", test.ranges)
+			}
+			response, err := http.DefaultClient.Do(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer response.Body.Close()
+
+			if response.StatusCode != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, response.StatusCode)
+			}
+			if test.expected == nil {
+				return
+			}
+			body, _ := io.ReadAll(response.Body)
+			if !bytes.Equal(body, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, body)
+			}
+		})
+	}
+
+	// Reading the start of the first file blocks until its piece is verified
+	done := make(chan []byte)
+	go func() {
+		request, _ := http.NewRequest(http.MethodGet, server.URL+"/0/t/a.txt", nil)
+		request.Header.Set("Range", "bytes=0-9")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		done <- body
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("expected the read to wait for piece 0")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	verified.SetPiece(0)
+	pm.SetDownloadedPieces(verified)
+
+	select {
+	case body := <-done:
+		if !bytes.Equal(body, content[:10]) {
+			t.Errorf("expected %v, got %v", content[:10], body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the read to finish once piece 0 was verified")
+	}
+}
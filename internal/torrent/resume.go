@@ -0,0 +1,253 @@
+package torrent
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ParamvirSran/GoTorrent/internal/bencode"
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+const (
+	_keyInfoHash   = "info hash"
+	_keyPartial    = "partial"
+	_keyIndex      = "index"
+	_keyBlocks     = "blocks"
+	_keyUploaded   = "uploaded"
+	_keyDownloaded = "downloaded"
+	_keyMtime      = "mtime"
+	_keyPriority   = "priority"
+	_resumeSuffix  = ".resume"
+)
+
+// ResumeData is the download progress of a torrent saved so a restart does not download everything again
+type ResumeData struct {
+	InfoHash      []byte
+	Pieces        types.Bitfield         // Verified pieces
+	PartialPieces map[int]types.Bitfield // Received blocks of pieces that are not complete yet
+	Uploaded      int64
+	Downloaded    int64
+	Files         []ResumeFile // State of the files when the resume data was saved
+}
+
+// ResumeFile is the size and modification time of a file of the torrent content along with its priority
+type ResumeFile struct {
+	Length   int64
+	Mtime    int64 // Unix seconds
+	Priority types.Priority
+}
+
+// ResumePath returns where the resume data of a torrent lives, next to its data in the download directory
+func ResumePath(dir string, info *types.InfoDictionary) string {
+	name := info.Name
+	if clean, err := storage.SanitizePath([]string{name}); err == nil {
+		name = clean[0]
+	}
+
+	return filepath.Join(dir, name+_resumeSuffix)
+}
+
+// NewResumeData captures the progress of a torrent along with the current state of its files. A storage that
+// holds written blocks back is flushed after the progress is taken so every block it names is in the files,
+// partial pieces are left out when that fails
+func NewResumeData(infoHash []byte, pm *types.PieceManager, uploaded, downloaded int64, dir string, layout storage.Layout) *ResumeData {
+	pieces, partial := pm.ResumeState()
+	if flusher, ok := pm.Storage().(storage.Flusher); ok {
+		if err := flusher.Flush(); err != nil {
+			log.Printf("Leaving partial pieces out of the resume data: %v", err)
+			partial = nil
+		}
+	}
+	priorities := pm.FilePriorities()
+	resume := &ResumeData{
+		InfoHash:      infoHash,
+		Pieces:        pieces,
+		PartialPieces: partial,
+		Uploaded:      uploaded,
+		Downloaded:    downloaded,
+		Files:         make([]ResumeFile, len(layout.Files)),
+	}
+
+	for i, file := range layout.Files {
+		resume.Files[i].Priority = types.PriorityNormal
+		if i < len(priorities) {
+			resume.Files[i].Priority = priorities[i]
+		}
+		if stat, err := os.Stat(filepath.Join(dir, file.RelativePath())); err == nil {
+			resume.Files[i].Length = stat.Size()
+			resume.Files[i].Mtime = stat.ModTime().Unix()
+		}
+	}
+
+	return resume
+}
+
+// SaveResumeData writes the resume data to a temporary file first so a crash never leaves a truncated file behind
+func SaveResumeData(path string, resume *ResumeData) error {
+	partial := make([]any, 0, len(resume.PartialPieces))
+	for index, blocks := range resume.PartialPieces {
+		partial = append(partial, map[string]any{
+			_keyIndex:  index,
+			_keyBlocks: []byte(blocks),
+		})
+	}
+
+	files := make([]any, 0, len(resume.Files))
+	for _, file := range resume.Files {
+		files = append(files, map[string]any{
+			_keyLength:   file.Length,
+			_keyMtime:    file.Mtime,
+			_keyPriority: int(file.Priority),
+		})
+	}
+
+	encoded, err := bencode.Encode(map[string]any{
+		_keyInfoHash:   resume.InfoHash,
+		_keyPieces:     []byte(resume.Pieces),
+		_keyPartial:    partial,
+		_keyUploaded:   resume.Uploaded,
+		_keyDownloaded: resume.Downloaded,
+		_keyFiles:      files,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode resume data: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, encoded, 0644); err != nil {
+		return fmt.Errorf("error writing resume data: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error replacing resume data: %w", err)
+	}
+
+	return nil
+}
+
+// LoadResumeData reads resume data saved by SaveResumeData
+func LoadResumeData(path string) (*ResumeData, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading resume data: %w", err)
+	}
+
+	data, err := bencode.Decode(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode resume data: %w", err)
+	}
+
+	resumeDict, ok := data.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid resume data format: expected a dictionary but got %T", data)
+	}
+
+	resume := &ResumeData{PartialPieces: make(map[int]types.Bitfield)}
+	infoHash, ok := resumeDict[_keyInfoHash].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s field missing or not a string", _keyInfoHash)
+	}
+	resume.InfoHash = []byte(infoHash)
+
+	pieces, ok := resumeDict[_keyPieces].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s field missing or not a string", _keyPieces)
+	}
+	resume.Pieces = types.Bitfield(pieces)
+
+	if uploaded, ok := resumeDict[_keyUploaded].(int); ok {
+		resume.Uploaded = int64(uploaded)
+	}
+	if downloaded, ok := resumeDict[_keyDownloaded].(int); ok {
+		resume.Downloaded = int64(downloaded)
+	}
+
+	partial, _ := resumeDict[_keyPartial].([]any)
+	for _, entry := range partial {
+		entryDict, ok := entry.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s entry is not a dictionary, got %T", _keyPartial, entry)
+		}
+		index, indexOk := entryDict[_keyIndex].(int)
+		blocks, blocksOk := entryDict[_keyBlocks].(string)
+		if !indexOk || !blocksOk {
+			return nil, fmt.Errorf("%s entry index: %t, blocks: %t", _keyPartial, indexOk, blocksOk)
+		}
+		resume.PartialPieces[index] = types.Bitfield(blocks)
+	}
+
+	files, _ := resumeDict[_keyFiles].([]any)
+	for _, entry := range files {
+		entryDict, ok := entry.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("%s entry is not a dictionary, got %T", _keyFiles, entry)
+		}
+		length, lengthOk := entryDict[_keyLength].(int)
+		mtime, mtimeOk := entryDict[_keyMtime].(int)
+		if !lengthOk || !mtimeOk {
+			return nil, fmt.Errorf("%s entry length: %t, mtime: %t", _keyFiles, lengthOk, mtimeOk)
+		}
+		// Resume data saved before file priorities existed wants every file
+		priority := types.PriorityNormal
+		if saved, ok := entryDict[_keyPriority].(int); ok {
+			priority = types.Priority(saved)
+			if !priority.IsValid() {
+				return nil, fmt.Errorf("%s entry has invalid priority %d", _keyFiles, saved)
+			}
+		}
+		resume.Files = append(resume.Files, ResumeFile{Length: int64(length), Mtime: int64(mtime), Priority: priority})
+	}
+
+	return resume, nil
+}
+
+// RestorePriorities sets the saved file priorities on the piece manager, they are kept even when the content
+// fails the sanity check since they are a choice of the user
+func (resume *ResumeData) RestorePriorities(pm *types.PieceManager) error {
+	if files := len(pm.FilePriorities()); len(resume.Files) != files {
+		return fmt.Errorf("resume data has %d files, torrent has %d", len(resume.Files), files)
+	}
+
+	for i, file := range resume.Files {
+		if err := pm.SetFilePriority(i, file.Priority); err != nil {
+			return fmt.Errorf("error restoring priorities: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Check is a fast sanity check that the resume data belongs to the torrent and its files were not replaced or
+// truncated since it was saved. Files only grow and get newer while downloading, so a file that is smaller or
+// older than recorded means the data on disk can not be trusted
+func (resume *ResumeData) Check(infoHash []byte, dir string, layout storage.Layout) error {
+	if !bytes.Equal(resume.InfoHash, infoHash) {
+		return fmt.Errorf("resume data is for infohash %x, expected %x", resume.InfoHash, infoHash)
+	}
+
+	if len(resume.Files) != len(layout.Files) {
+		return fmt.Errorf("resume data has %d files, torrent has %d", len(resume.Files), len(layout.Files))
+	}
+
+	for i, file := range layout.Files {
+		recorded := resume.Files[i]
+		stat, err := os.Stat(filepath.Join(dir, file.RelativePath()))
+		if err != nil {
+			if recorded.Length == 0 && os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("file %s: %w", file.RelativePath(), err)
+		}
+		if stat.Size() < recorded.Length {
+			return fmt.Errorf("file %s shrank from %d to %d bytes", file.RelativePath(), recorded.Length, stat.Size())
+		}
+		if stat.ModTime().Unix() < recorded.Mtime {
+			return fmt.Errorf("file %s is older than its resume data", file.RelativePath())
+		}
+	}
+
+	return nil
+}
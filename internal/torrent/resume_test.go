@@ -0,0 +1,67 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestResumeDataRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	layout := storage.NewLayout([]storage.File{{Path: []string{"t", "a"}, Length: 3 * types.BlockSize}}, 2*types.BlockSize)
+	infoHash := bytes.Repeat([]byte{0xab}, 20)
+
+	if err := os.MkdirAll(filepath.Join(dir, "t"), 0755); err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "t", "a"), make([]byte, 3*types.BlockSize), 0644); err != nil {
+		t.Fatalf("unexpected error writing file: %v", err)
+	}
+
+	pm := types.NewPieceManager(2, 2*types.BlockSize, 3*types.BlockSize)
+	pm.AddPiece(0, make([]byte, 20))
+	pm.AddPiece(1, make([]byte, 20))
+	pieces := types.NewBitfield(2)
+	pieces.SetPiece(0)
+	pm.RestoreState(pieces, nil)
+	if err := pm.SetFilePriority(0, types.PriorityHigh); err != nil {
+		t.Fatalf("unexpected error setting priority: %v", err)
+	}
+
+	path := filepath.Join(dir, "t.resume")
+	if err := SaveResumeData(path, NewResumeData(infoHash, pm, 10, 20, dir, layout)); err != nil {
+		t.Fatalf("unexpected error saving resume data: %v", err)
+	}
+
+	loaded, err := LoadResumeData(path)
+	if err != nil {
+		t.Fatalf("unexpected error loading resume data: %v", err)
+	}
+	if !loaded.Pieces.HasPiece(0) || loaded.Pieces.HasPiece(1) {
+		t.Errorf("expected only piece 0 in %x", loaded.Pieces)
+	}
+	if loaded.Uploaded != 10 || loaded.Downloaded != 20 {
+		t.Errorf("expected uploaded 10 and downloaded 20, got %d and %d", loaded.Uploaded, loaded.Downloaded)
+	}
+	if len(loaded.Files) != 1 || loaded.Files[0].Priority != types.PriorityHigh {
+		t.Errorf("expected a single file with high priority, got %v", loaded.Files)
+	}
+	if err := loaded.Check(infoHash, dir, layout); err != nil {
+		t.Errorf("unexpected error checking resume data: %v", err)
+	}
+
+	if err := loaded.Check(bytes.Repeat([]byte{0xcd}, 20), dir, layout); err == nil {
+		t.Errorf("expected an error for a different infohash, but got none")
+	}
+
+	if err := os.Truncate(filepath.Join(dir, "t", "a"), types.BlockSize); err != nil {
+		t.Fatalf("unexpected error truncating file: %v", err)
+	}
+	if err := loaded.Check(infoHash, dir, layout); err == nil {
+		t.Errorf("expected an error for a truncated file, but got none")
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/ParamvirSran/GoTorrent/internal/bencode"
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
 	"github.com/ParamvirSran/GoTorrent/internal/types"
 )
 
@@ -22,6 +24,8 @@ const (
 	_keyCreatedBy    = "created by"
 	_keyEncoding     = "encoding"
 	_keyPrivate      = "private"
+	_keyURLList      = "url-list"
+	_keyHTTPSeeds    = "httpseeds"
 )
 
 // ParseTorrentFile parses the .torrent file and returns the parsed TorrentFile object
@@ -47,6 +51,14 @@ func ParseTorrentFile(torrentPath string) (*types.Torrent, error) {
 		return nil, fmt.Errorf("error parsing metainfo: %v", err)
 	}
 
+	// Kept as the exact bytes of the file for the infohash and for peers fetching the metadata, encoding the
+	// parsed dictionary again would change an info dictionary that is not canonical
+	infoBytes, err := bencode.RawValue(content, _keyInfo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read info dictionary: %w", err)
+	}
+	torrent.InfoBytes = infoBytes
+
 	return torrent, nil
 }
 
@@ -81,14 +93,13 @@ func parseMetainfo(torrentDict map[string]any) (*types.Torrent, error) {
 		torrentFile.Encoding = encoding
 	}
 
-	if private, ok := torrentDict[_keyPrivate].(int); ok {
-		torrentFile.Info.Private = &private
-	}
-
 	if creationDate, ok := torrentDict["creation date"].(int64); ok {
 		torrentFile.CreationDate = creationDate
 	}
 
+	torrentFile.URLList = parseURLList(torrentDict, _keyURLList)
+	torrentFile.HTTPSeeds = parseURLList(torrentDict, _keyHTTPSeeds)
+
 	return torrentFile, nil
 }
 
@@ -120,6 +131,27 @@ func parseAnnounce(torrentDict map[string]any, torrentFile *types.Torrent) error
 	return nil
 }
 
+// parseURLList parses a field of seed URLs such as "url-list", a single URL or a list of them. Seeds are optional
+// so entries that are not strings are skipped instead of failing the torrent
+func parseURLList(torrentDict map[string]any, key string) []string {
+	switch urlList := torrentDict[key].(type) {
+	case string:
+		if urlList != "" {
+			return []string{urlList}
+		}
+	case []any:
+		var urls []string
+		for _, url := range urlList {
+			if urlString, ok := url.(string); ok && urlString != "" {
+				urls = append(urls, urlString)
+			}
+		}
+		return urls
+	}
+
+	return nil
+}
+
 // parseInfo parses the info dictionary from the torrent file
 func parseInfo(infoDict map[string]any) (*types.InfoDictionary, *types.PieceManager, error) {
 	info := &types.InfoDictionary{}
@@ -135,11 +167,26 @@ func parseInfo(infoDict map[string]any) (*types.InfoDictionary, *types.PieceMana
 		return nil, nil, err
 	}
 
+	// The private flag lives in the info dictionary (BEP 27) so it is covered by the infohash
+	if private, ok := infoDict[_keyPrivate].(int); ok {
+		info.Private = &private
+	}
+
 	pieceCount := len(info.Pieces) / 20
 	pieceLength := info.PieceLength
+	totalLength := info.TotalLength()
+
+	// Every piece but the last is a full piece, so the piece count has to match the content length
+	if pieceLength <= 0 {
+		return nil, nil, fmt.Errorf("%s must be positive, got %d", _keyPieceLength, pieceLength)
+	}
+	expectedCount := (totalLength + int64(pieceLength) - 1) / int64(pieceLength)
+	if int64(pieceCount) != expectedCount {
+		return nil, nil, fmt.Errorf("torrent has %d pieces but a length of %d needs %d", pieceCount, totalLength, expectedCount)
+	}
 
 	// Initialize PieceManager
-	pieceManager := types.NewPieceManager(pieceCount, pieceLength)
+	pieceManager := types.NewPieceManager(pieceCount, pieceLength, totalLength)
 
 	// Populate the PieceManager with piece hashes
 	for i := 0; i < pieceCount; i += 1 {
@@ -156,6 +203,9 @@ func parseNameAndPieceLength(infoDict map[string]any, info *types.InfoDictionary
 	if !ok {
 		return fmt.Errorf("%s field missing or not a string", _keyName)
 	}
+	if _, err := storage.SanitizePath([]string{name}); err != nil {
+		return fmt.Errorf("invalid %s field: %w", _keyName, err)
+	}
 	info.Name = name
 
 	switch pl := infoDict[_keyPieceLength].(type) {
@@ -175,6 +225,9 @@ func parsePiecesField(infoDict map[string]any, info *types.InfoDictionary) error
 	if !ok {
 		return fmt.Errorf("%s field missing or not a string", _keyPieces)
 	}
+	if len(pieces)%20 != 0 {
+		return fmt.Errorf("%s field length %d is not a multiple of 20", _keyPieces, len(pieces))
+	}
 	info.Pieces = []byte(pieces)
 	return nil
 }
@@ -200,14 +253,14 @@ func parseLengthOrFiles(infoDict map[string]any, info *types.InfoDictionary) err
 // parseFiles parses the "files" field into a list of File objects
 func parseFiles(files []any) ([]types.File, error) {
 	var fileList []types.File
-	for _, file := range files {
+	for i, file := range files {
 		fileDict, ok := file.(map[string]any)
 		if !ok {
-			return nil, fmt.Errorf("file entry is not a valid dictionary, got %T", file)
+			return nil, fmt.Errorf("file %d entry is not a valid dictionary, got %T", i, file)
 		}
 		fileInfo, err := parseFile(fileDict)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse file: %w", err)
+			return nil, fmt.Errorf("failed to parse file %d: %w", i, err)
 		}
 		fileList = append(fileList, fileInfo)
 	}
@@ -238,5 +291,33 @@ func parseFile(fileDict map[string]any) (types.File, error) {
 		return fileInfo, fmt.Errorf("path missing or of incorrect type")
 	}
 
+	// The original path is kept since the infohash is computed from it, storage rewrites it where needed
+	if _, err := storage.SanitizePath(fileInfo.Path); err != nil {
+		return fileInfo, fmt.Errorf("unsafe path %q: %w", strings.Join(fileInfo.Path, "/"), err)
+	}
+
 	return fileInfo, nil
 }
+
+// StorageLayout returns how the torrent content is laid out in files, a single file torrent is stored as the
+// file "name" and a multi-file torrent as its files inside the directory "name". Paths are sanitized so that
+// no file ends up outside the download directory
+func StorageLayout(info *types.InfoDictionary) (storage.Layout, error) {
+	var files []storage.File
+	if info.Files == nil {
+		files = []storage.File{{Path: []string{info.Name}, Length: info.Length}}
+	} else {
+		files = make([]storage.File, 0, len(*info.Files))
+		for _, file := range *info.Files {
+			path := append([]string{info.Name}, file.Path...)
+			files = append(files, storage.File{Path: path, Length: file.Length})
+		}
+	}
+
+	sanitized, err := storage.SanitizeFiles(files)
+	if err != nil {
+		return storage.Layout{}, err
+	}
+
+	return storage.NewLayout(sanitized, info.PieceLength), nil
+}
@@ -0,0 +1,66 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTorrentFileNonCanonicalInfo(t *testing.T) {
+	// The keys of the info dictionary are not sorted and it has a key we do not parse
+	info := "d4:name4:test12:piece lengthi16384e6:lengthi10e6:pieces20:" + strings.Repeat("a", 20) + "1:xi0ee"
+	path := filepath.Join(t.TempDir(), "test.torrent")
+	if err := os.WriteFile(path, []byte("d8:announce15:http://tracker/4:info"+info+"e"), 0644); err != nil {
+		t.Fatalf("unexpected error writing torrent file: %v", err)
+	}
+
+	torrentFile, err := ParseTorrentFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(torrentFile.InfoBytes, []byte(info)) {
+		t.Errorf("expected info bytes %q, got %q", info, torrentFile.InfoBytes)
+	}
+
+	infohash, err := GetInfohash(torrentFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := sha1.Sum([]byte(info)); !bytes.Equal(infohash, expected[:]) {
+		t.Errorf("expected infohash %x, got %x", expected, infohash)
+	}
+}
+
+func TestParseTorrentFilePrivate(t *testing.T) {
+	pieces := "6:pieces20:" + strings.Repeat("a", 20)
+	tests := []struct {
+		name     string
+		torrent  string
+		expected bool
+	}{
+		{"private in info", "d8:announce15:http://tracker/4:infod6:lengthi10e4:name4:test12:piece lengthi16384e" + pieces + "7:privatei1eee", true},
+		{"private zero", "d8:announce15:http://tracker/4:infod6:lengthi10e4:name4:test12:piece lengthi16384e" + pieces + "7:privatei0eee", false},
+		{"private outside info", "d8:announce15:http://tracker/4:infod6:lengthi10e4:name4:test12:piece lengthi16384e" + pieces + "e7:privatei1ee", false},
+		{"no private", "d8:announce15:http://tracker/4:infod6:lengthi10e4:name4:test12:piece lengthi16384e" + pieces + "ee", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.torrent")
+			if err := os.WriteFile(path, []byte(test.torrent), 0644); err != nil {
+				t.Fatalf("unexpected error writing torrent file: %v", err)
+			}
+
+			torrentFile, err := ParseTorrentFile(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if private := torrentFile.Info.IsPrivate(); private != test.expected {
+				t.Errorf("expected private %t, got %t", test.expected, private)
+			}
+		})
+	}
+}
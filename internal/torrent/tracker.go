@@ -88,42 +88,14 @@ func GeneratePeerID() (string, error) {
 	return string(peerID), nil
 }
 
-// GetInfohash calculates the SHA-1 hash of the bencoded "info" dictionary
-func GetInfohash(info *types.InfoDictionary) ([]byte, error) {
-	infoMap := make(map[string]any)
-	infoMap["name"] = info.Name
-	infoMap["piece length"] = info.PieceLength
-	infoMap["pieces"] = string(info.Pieces)
-
-	if info.Length > 0 {
-		// Single-file case
-		infoMap["length"] = info.Length
-	} else {
-		// Multi-file case
-		var files []any
-		if fileList := info.Files; fileList != nil {
-			for _, file := range *fileList {
-				pathInterfaceList := make([]any, len(file.Path))
-				for i, p := range file.Path {
-					pathInterfaceList[i] = p
-				}
-				fileMap := map[string]any{
-					"length": file.Length,
-					"path":   pathInterfaceList,
-				}
-				files = append(files, fileMap)
-			}
-		}
-		infoMap["files"] = files
-	}
-
-	encodedInfo, err := bencode.Encode(infoMap)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode info dictionary: %w", err)
+// GetInfohash calculates the SHA-1 hash of the bencoded "info" dictionary, with every key it has in the .torrent
+// file so it matches the metadata we serve to peers
+func GetInfohash(torrentFile *types.Torrent) ([]byte, error) {
+	if len(torrentFile.InfoBytes) == 0 {
+		return nil, fmt.Errorf("info dictionary missing")
 	}
 
-	// compute the SHA-1 hash of the bencoded dict
-	hash := sha1.Sum(encodedInfo)
+	hash := sha1.Sum(torrentFile.InfoBytes)
 	return hash[:], nil // converting the [20]byte hash to []byte
 }
 
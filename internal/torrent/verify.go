@@ -0,0 +1,136 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+// VerifyReport is the outcome of a full recheck of the torrent content
+type VerifyReport struct {
+	Verified      types.Bitfield
+	VerifiedCount int
+	FailedPieces  []int
+	MissingFiles  []string // Files that do not exist in the download directory
+	CorruptFiles  []string // Existing files with at least one piece that failed its hash check
+}
+
+// verifyResult is the outcome of hashing a single piece
+type verifyResult struct {
+	index int
+	ok    bool
+}
+
+// Verify reads every piece from storage and checks it against its hash on a pool of workers sized to the CPU
+// count, the piece manager is then set to exactly the verified pieces. Files are looked up in dir to report the
+// missing ones, an empty dir skips that for storage that does not live on disk. progress, when not nil, is
+// called after every piece
+func Verify(ctx context.Context, pm *types.PieceManager, layout storage.Layout, dir string, progress func(checked, total int)) (*VerifyReport, error) {
+	report := &VerifyReport{Verified: types.NewBitfield(pm.PieceCount)}
+
+	// Skipped files are never created and are neither missing nor corrupt, the bytes they share with wanted files
+	// are read from the part file
+	skipped := make(map[int]bool)
+	for i, priority := range pm.FilePriorities() {
+		skipped[i] = priority == types.PrioritySkip
+	}
+	missing := make(map[int]bool)
+	if dir != "" {
+		for i, file := range layout.Files {
+			if skipped[i] {
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(dir, file.RelativePath())); err != nil && file.Length > 0 {
+				missing[i] = true
+				report.MissingFiles = append(report.MissingFiles, file.RelativePath())
+			}
+		}
+	}
+
+	jobs := make(chan int)
+	results := make(chan verifyResult)
+	store := pm.Storage()
+
+	var wg sync.WaitGroup
+	for range runtime.NumCPU() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				results <- verifyResult{index: index, ok: verifyPiece(store, pm, layout, missing, index)}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for index := 0; index < pm.PieceCount; index++ {
+			select {
+			case jobs <- index:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	checked := 0
+	for result := range results {
+		checked++
+		if result.ok {
+			report.Verified.SetPiece(result.index)
+			report.VerifiedCount++
+		} else {
+			report.FailedPieces = append(report.FailedPieces, result.index)
+		}
+		if progress != nil {
+			progress(checked, pm.PieceCount)
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	corrupt := make(map[int]bool)
+	for _, index := range report.FailedPieces {
+		for _, file := range layout.PieceFiles(index) {
+			if !missing[file] && !skipped[file] && !corrupt[file] {
+				corrupt[file] = true
+				report.CorruptFiles = append(report.CorruptFiles, layout.Files[file].RelativePath())
+			}
+		}
+	}
+
+	pm.SetDownloadedPieces(report.Verified)
+
+	return report, nil
+}
+
+// verifyPiece reads a piece from storage and checks its hash, pieces in missing files fail without reading
+func verifyPiece(store storage.Storage, pm *types.PieceManager, layout storage.Layout, missing map[int]bool, index int) bool {
+	for _, file := range layout.PieceFiles(index) {
+		if missing[file] {
+			return false
+		}
+	}
+
+	data := make([]byte, pm.PieceLength(index))
+	if _, err := store.ReadAt(index, data, 0); err != nil {
+		return false
+	}
+
+	hash := sha1.Sum(data)
+	return bytes.Equal(hash[:], pm.PieceHash(index))
+}
@@ -0,0 +1,119 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	pieceLength := 2 * types.BlockSize
+	layout := storage.NewLayout([]storage.File{
+		{Path: []string{"t", "a"}, Length: int64(2 * pieceLength)},
+		{Path: []string{"t", "b"}, Length: int64(pieceLength)},
+		{Path: []string{"t", "c"}, Length: int64(pieceLength)},
+	}, pieceLength)
+
+	content := make([]byte, layout.TotalLength)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	pm := types.NewPieceManager(layout.PieceCount(), pieceLength, layout.TotalLength)
+	for i := range layout.PieceCount() {
+		hash := sha1.Sum(content[i*pieceLength : (i+1)*pieceLength])
+		pm.AddPiece(i, hash[:])
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "t"), 0755); err != nil {
+		t.Fatalf("unexpected error creating directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "t", "a"), content[:2*pieceLength], 0644); err != nil {
+		t.Fatalf("unexpected error writing file: %v", err)
+	}
+	corrupt := append([]byte(nil), content[2*pieceLength:3*pieceLength]...)
+	corrupt[0] ^= 0xff
+	if err := os.WriteFile(filepath.Join(dir, "t", "b"), corrupt, 0644); err != nil {
+		t.Fatalf("unexpected error writing file: %v", err)
+	}
+
+	fileStorage, err := storage.NewFileStorage(dir, layout, nil)
+	if err != nil {
+		t.Fatalf("unexpected error creating storage: %v", err)
+	}
+	defer fileStorage.Close()
+	pm.SetStorage(fileStorage)
+
+	checked := 0
+	report, err := Verify(context.Background(), pm, layout, dir, func(done, total int) { checked = done })
+	if err != nil {
+		t.Fatalf("unexpected error verifying: %v", err)
+	}
+
+	if checked != layout.PieceCount() {
+		t.Errorf("expected progress up to %d pieces, got %d", layout.PieceCount(), checked)
+	}
+	if report.VerifiedCount != 2 || pm.DownloadedCount != 2 {
+		t.Errorf("expected 2 verified pieces, got %d in the report and %d in the piece manager", report.VerifiedCount, pm.DownloadedCount)
+	}
+	for i := range layout.PieceCount() {
+		if expected := i < 2; pm.IsPieceDownloaded(i) != expected {
+			t.Errorf("expected piece %d downloaded to be %t", i, expected)
+		}
+	}
+	if len(report.MissingFiles) != 1 || report.MissingFiles[0] != filepath.Join("t", "c") {
+		t.Errorf("expected t/c to be missing, got %v", report.MissingFiles)
+	}
+	if len(report.CorruptFiles) != 1 || report.CorruptFiles[0] != filepath.Join("t", "b") {
+		t.Errorf("expected t/b to be corrupt, got %v", report.CorruptFiles)
+	}
+}
+
+func TestVerifySkippedFile(t *testing.T) {
+	dir := t.TempDir()
+	layout := storage.NewLayout([]storage.File{
+		{Path: []string{"t", "a"}, Length: 6},
+		{Path: []string{"t", "b"}, Length: 6},
+	}, 4)
+	content := []byte("abcdefghijkl")
+
+	pm := types.NewPieceManager(layout.PieceCount(), 4, layout.TotalLength)
+	for i := range layout.PieceCount() {
+		hash := sha1.Sum(content[i*4 : (i+1)*4])
+		pm.AddPiece(i, hash[:])
+	}
+	pm.SetLayout(layout)
+	if err := pm.SetFilePriority(1, types.PrioritySkip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fileStorage, err := storage.NewFileStorage(dir, layout, []bool{true, false})
+	if err != nil {
+		t.Fatalf("unexpected error creating storage: %v", err)
+	}
+	defer fileStorage.Close()
+	pm.SetStorage(fileStorage)
+	for i := range 2 {
+		if _, err := fileStorage.WriteAt(i, content[i*4:(i+1)*4], 0); err != nil {
+			t.Fatalf("unexpected error writing piece %d: %v", i, err)
+		}
+	}
+
+	// The shared piece verifies with the bytes of the skipped file in the part file
+	report, err := Verify(context.Background(), pm, layout, dir, nil)
+	if err != nil {
+		t.Fatalf("unexpected error verifying: %v", err)
+	}
+	if report.VerifiedCount != 2 || !pm.IsPieceDownloaded(1) {
+		t.Errorf("expected the first 2 pieces to be verified, got %d", report.VerifiedCount)
+	}
+	if len(report.MissingFiles) != 0 || len(report.CorruptFiles) != 0 {
+		t.Errorf("expected the skipped file to be neither missing nor corrupt, got %v and %v", report.MissingFiles, report.CorruptFiles)
+	}
+}
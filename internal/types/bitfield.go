@@ -0,0 +1,48 @@
+package types
+
+// Bitfield represents which pieces a peer has, the high bit of the first byte is piece 0
+type Bitfield []byte
+
+// NewBitfield returns an empty bitfield large enough to hold pieceCount pieces
+func NewBitfield(pieceCount int) Bitfield {
+	return make(Bitfield, (pieceCount+7)/8)
+}
+
+// HasPiece checks if the bit for a piece index is set
+func (bf Bitfield) HasPiece(index int) bool {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
+
+	return bf[byteIndex]>>(7-uint(index%8))&1 != 0
+}
+
+// SetPiece sets the bit for a piece index
+func (bf Bitfield) SetPiece(index int) {
+	byteIndex := index / 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+
+	bf[byteIndex] |= 1 << (7 - uint(index%8))
+}
+
+// IsComplete checks if the bitfield has every one of pieceCount pieces
+func (bf Bitfield) IsComplete(pieceCount int) bool {
+	for index := 0; index < pieceCount; index++ {
+		if !bf.HasPiece(index) {
+			return false
+		}
+	}
+
+	return pieceCount > 0
+}
+
+// SetAll sets the bits of every one of pieceCount pieces and clears the spare bits of the last byte
+func (bf Bitfield) SetAll(pieceCount int) {
+	clear(bf)
+	for index := 0; index < pieceCount; index++ {
+		bf.SetPiece(index)
+	}
+}
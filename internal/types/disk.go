@@ -0,0 +1,183 @@
+package types
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"sync"
+)
+
+// DefaultWriteQueueSize is the number of received blocks waiting to be written before peers are slowed down
+const DefaultWriteQueueSize = 64
+
+// PieceResult is the outcome of hashing a piece once all its blocks are written, Err is nil when it matched
+type PieceResult struct {
+	Index int
+	Err   error
+}
+
+// writeJob is a received block waiting to be written to storage
+type writeJob struct {
+	index, begin int
+	data         []byte
+}
+
+// Start runs the disk pipeline, one goroutine writes received blocks to storage in the order they arrive and
+// hashWorkers goroutines hash pieces once all their blocks are written. onVerified is called from a hash worker
+// with the result of every piece. Blocks already queued when the context is done are still written and every piece
+// queued for hashing is still hashed, Wait returns once they are
+func (pm *PieceManager) Start(ctx context.Context, hashWorkers int, onVerified func(PieceResult)) {
+	pm.mu.Lock()
+	pm.writes = make(chan writeJob, DefaultWriteQueueSize)
+	pm.hashes = make(chan int, pm.PieceCount)
+	pm.onVerified = onVerified
+	pm.running = true
+	pm.stopped = make(chan struct{})
+	pm.queueUnverified()
+	pm.mu.Unlock()
+
+	var workers sync.WaitGroup
+	for range max(hashWorkers, 1) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			pm.hashPieces()
+		}()
+	}
+	// The writer is the last to queue pieces for hashing, the hash workers stop once it is done and the queue is
+	// empty so no written piece is dropped
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		pm.writeBlocks(ctx)
+		close(pm.hashes)
+	}()
+
+	go func() {
+		workers.Wait()
+		close(pm.stopped)
+	}()
+}
+
+// Wait blocks until the disk pipeline has stopped and every queued block is written
+func (pm *PieceManager) Wait() {
+	pm.mu.RLock()
+	stopped := pm.stopped
+	pm.mu.RUnlock()
+
+	if stopped != nil {
+		<-stopped
+	}
+}
+
+// writeBlocks writes queued blocks until the context is done, then flushes what is left in the queue
+func (pm *PieceManager) writeBlocks(ctx context.Context) {
+	for {
+		select {
+		case job := <-pm.writes:
+			pm.writeBlock(job)
+		case <-ctx.Done():
+			pm.mu.Lock()
+			pm.running = false
+			pm.mu.Unlock()
+
+			// No block is queued once running is off, so the queue can be closed when the last sender is done
+			go func() {
+				pm.inflight.Wait()
+				close(pm.writes)
+			}()
+			for job := range pm.writes {
+				pm.writeBlock(job)
+			}
+			return
+		}
+	}
+}
+
+// writeBlock writes a single block and queues its piece for hashing once it was the last one outstanding
+func (pm *PieceManager) writeBlock(job writeJob) {
+	_, err := pm.Storage().WriteAt(job.index, job.data, int64(job.begin))
+
+	pm.mu.Lock()
+	piece := pm.pieces[job.index]
+	piece.pendingWrites--
+	if err != nil {
+		err = fmt.Errorf("error writing block at offset %d of piece %d: %w", job.begin, job.index, err)
+		pm.requeuePiece(job.index)
+	} else if state := &piece.Blocks[job.begin/BlockSize]; state.Received {
+		// A piece requeued while the block was queued has to download it again
+		state.Written = true
+	}
+	ready := err == nil && piece.pendingWrites == 0 && piece.IsDownloaded && !piece.IsVerified && !piece.hashing
+	if ready {
+		piece.hashing = true
+	}
+	pm.mu.Unlock()
+
+	if err != nil {
+		pm.report(PieceResult{Index: job.index, Err: err})
+	}
+	if ready {
+		// Every piece is queued at most once at a time, so this never blocks
+		pm.hashes <- job.index
+	}
+}
+
+// queueUnverified queues the pieces that are downloaded but not verified for hashing, e.g. pieces restored from
+// partial blocks, the caller must hold the lock
+func (pm *PieceManager) queueUnverified() {
+	for index, piece := range pm.pieces {
+		if piece.pendingWrites == 0 && piece.IsDownloaded && !piece.IsVerified && !piece.hashing {
+			piece.hashing = true
+			// The queue holds every piece, so this never blocks
+			pm.hashes <- index
+		}
+	}
+}
+
+// hashPieces hashes the pieces that are queued until the queue is closed
+func (pm *PieceManager) hashPieces() {
+	for index := range pm.hashes {
+		pm.hashPiece(index)
+	}
+}
+
+// hashPiece reads a piece back from storage and checks its hash without holding the lock, a piece that does not
+// match is requeued
+func (pm *PieceManager) hashPiece(index int) {
+	pm.mu.RLock()
+	piece := pm.pieces[index]
+	hash := piece.Hash
+	store := pm.storage
+	pm.mu.RUnlock()
+
+	data := make([]byte, pm.PieceLength(index))
+	_, err := store.ReadAt(index, data, 0)
+	if err != nil {
+		err = fmt.Errorf("error reading piece %d: %w", index, err)
+	} else if computed := sha1.Sum(data); !bytes.Equal(computed[:], hash) {
+		err = fmt.Errorf("piece %d hash does not match the expected hash", index)
+	} else if err = store.MarkComplete(index); err != nil {
+		err = fmt.Errorf("error completing piece %d: %w", index, err)
+	}
+
+	pm.mu.Lock()
+	piece.hashing = false
+	if err != nil {
+		pm.requeuePiece(index)
+	} else if piece.IsDownloaded {
+		piece.IsVerified = true
+		pm.notifyProgress()
+	}
+	pm.mu.Unlock()
+
+	pm.report(PieceResult{Index: index, Err: err})
+}
+
+// report hands the result of a piece to the callback given to Start
+func (pm *PieceManager) report(result PieceResult) {
+	if pm.onVerified != nil {
+		pm.onVerified(result)
+	}
+}
@@ -17,16 +17,26 @@ func (h *Handshake) SerializeHandshake() []byte {
 	return buf.Bytes()
 }
 
-// ValidateHandshakeResponse will check if received handshake is valid
-func ValidateHandshakeResponse(response []byte, expectedInfoHash [20]byte) error {
+// ValidateHandshakeResponse will check if received handshake is valid, it returns the reserved bytes of the peer
+func ValidateHandshakeResponse(response []byte, expectedInfoHash [20]byte) ([8]byte, error) {
 	if len(response) < 68 {
-		return fmt.Errorf("handshake response too short: %d bytes", len(response))
+		return [8]byte{}, fmt.Errorf("handshake response too short: %d bytes", len(response))
 	}
 
 	infoHash := [20]byte(response[28:48])
 	if !bytes.Equal(infoHash[:], expectedInfoHash[:]) {
-		return fmt.Errorf("invalid info hash: expected %x, got %x", expectedInfoHash, infoHash)
+		return [8]byte{}, fmt.Errorf("invalid info hash: expected %x, got %x", expectedInfoHash, infoHash)
 	}
 
-	return nil
+	return [8]byte(response[20:28]), nil
+}
+
+// SupportsExtensions checks if the reserved bytes of a handshake announce the extension protocol (BEP 10)
+func SupportsExtensions(reserved [8]byte) bool {
+	return reserved[extensionProtocolByte]&extensionProtocolBit != 0
+}
+
+// SupportsFast checks if the reserved bytes of a handshake announce the fast extension (BEP 6)
+func SupportsFast(reserved [8]byte) bool {
+	return reserved[fastExtensionByte]&fastExtensionBit != 0
 }
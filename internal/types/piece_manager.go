@@ -1,14 +1,17 @@
 package types
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"context"
 	"fmt"
 	"log"
+	"sort"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
 )
 
 const (
 	maxFailedAttempts = 3
+	cancelBufferSize  = 64
 )
 
 // AddPiece adds a piece to the piece manager
@@ -16,52 +19,375 @@ func (pm *PieceManager) AddPiece(index int, hash []byte) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	pm.pieces[index] = NewPiece(hash)
+	pm.pieces[index] = NewPiece(hash, (pm.PieceLength(index)+BlockSize-1)/BlockSize)
+	pm.pieces[index].Priority = pm.piecePriority(index)
+}
+
+// SetStorage sets where the torrent content is stored, it has to be set before any block arrives
+func (pm *PieceManager) SetStorage(s storage.Storage) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.storage = s
+}
+
+// SetLayout sets how the pieces map onto the files of the torrent, every file starts with normal priority
+func (pm *PieceManager) SetLayout(layout storage.Layout) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.layout = layout
+	pm.files = make([]Priority, len(layout.Files))
+	for i := range pm.files {
+		pm.files[i] = PriorityNormal
+	}
+	pm.updatePriorities()
+}
+
+// SetFilePriority sets the priority of a file, its pieces are requested by the highest priority of the files
+// they cover. Pieces only covering skipped files are not downloaded, while a piece shared with a wanted file is
+// downloaded whole since it can only be verified whole. The storage is told when a file is skipped or wanted again
+func (pm *PieceManager) SetFilePriority(file int, priority Priority) error {
+	pm.mu.Lock()
+	if file < 0 || file >= len(pm.files) {
+		pm.mu.Unlock()
+		return fmt.Errorf("file %d does not exist, the torrent has %d files", file, len(pm.files))
+	}
+	if !priority.IsValid() {
+		pm.mu.Unlock()
+		return fmt.Errorf("invalid priority %d for file %d", priority, file)
+	}
+
+	skipped := pm.files[file] == PrioritySkip
+	pm.files[file] = priority
+	pm.updatePriorities()
+	s := pm.storage
+	pm.mu.Unlock()
+
+	// A storage that leaves skipped files alone moves the bytes the file shares with other files along with it
+	if selector, ok := s.(storage.FileSelector); ok && skipped != (priority == PrioritySkip) {
+		return selector.SetWanted(file, priority != PrioritySkip)
+	}
+
+	return nil
 }
 
-// RequeuePiece will requeue a piece at an index
+// FilePriorities returns the priority of every file
+func (pm *PieceManager) FilePriorities() []Priority {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return append([]Priority(nil), pm.files...)
+}
+
+// updatePriorities derives the priority of every piece from the files it covers, the caller must hold the lock
+func (pm *PieceManager) updatePriorities() {
+	for index, piece := range pm.pieces {
+		piece.Priority = pm.piecePriority(index)
+	}
+	pm.endgame = false
+}
+
+// piecePriority returns the highest priority of the files a piece covers, the caller must hold the lock
+func (pm *PieceManager) piecePriority(index int) Priority {
+	priority := PrioritySkip
+	for _, file := range pm.layout.PieceFiles(index) {
+		if file < len(pm.files) && pm.files[file] > priority {
+			priority = pm.files[file]
+		}
+	}
+
+	return priority
+}
+
+// Storage returns where the torrent content is stored
+func (pm *PieceManager) Storage() storage.Storage {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return pm.storage
+}
+
+// PieceLength returns the exact length of a piece, the last piece is usually shorter than the rest
+func (pm *PieceManager) PieceLength(index int) int {
+	if index < 0 || index >= pm.PieceCount {
+		return 0
+	}
+
+	begin := int64(index) * int64(pm.PieceSize)
+	if remaining := pm.TotalLength - begin; remaining < int64(pm.PieceSize) {
+		return int(remaining)
+	}
+
+	return pm.PieceSize
+}
+
+// BytesLeft returns the number of bytes of verified content we are still missing from the wanted files
+func (pm *PieceManager) BytesLeft() int64 {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return pm.bytesLeft()
+}
+
+// bytesLeft returns the number of bytes we are still missing, the caller must hold the lock
+func (pm *PieceManager) bytesLeft() int64 {
+	var left int64
+	for index, piece := range pm.pieces {
+		if !piece.IsVerified && piece.Priority != PrioritySkip {
+			left += int64(pm.PieceLength(index))
+		}
+	}
+
+	return left
+}
+
+// piecesLeft returns the number of wanted pieces that are not verified yet, the caller must hold the lock
+func (pm *PieceManager) piecesLeft() int {
+	left := 0
+	for _, piece := range pm.pieces {
+		if !piece.IsVerified && piece.Priority != PrioritySkip {
+			left++
+		}
+	}
+
+	return left
+}
+
+// RequeuePiece will requeue a piece at an index, throwing away every block received for it
 func (pm *PieceManager) RequeuePiece(index int) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
+	pm.requeuePiece(index)
+}
+
+// requeuePiece throws away every block received for a piece, the caller must hold the lock
+func (pm *PieceManager) requeuePiece(index int) {
 	if piece, exists := pm.pieces[index]; exists {
 		if piece.IsDownloaded {
 			pm.DownloadedCount--
 		}
 		piece.IsDownloaded = false
-		piece.IsClaimed = false
-		piece.Data = nil // Clear the pointer to avoid memory leaks
+		piece.IsVerified = false
+		piece.ReceivedBlocks = 0
+		for i := range piece.Blocks {
+			piece.Blocks[i] = Block{RequestedBy: make(map[string]struct{})}
+		}
+		pm.endgame = false
 
 		log.Printf("Piece %d re-queued for download", index)
 	}
 }
 
-// IsDownloadComplete checks if all pieces are downloaded
+// IsDownloadComplete checks if all pieces of the wanted files are downloaded
 func (pm *PieceManager) IsDownloadComplete() bool {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
-	if pm.DownloadedCount == len(pm.pieces) {
+	left := pm.piecesLeft()
+	if left == 0 {
 		log.Println("Download complete!")
 
 		return true
 	}
 	log.Printf("Downloaded Pieces: %d\nTotal Pieces: %d", pm.DownloadedCount, len(pm.pieces))
-	log.Printf("Left: %d", len(pm.pieces)-pm.DownloadedCount)
+	log.Printf("Left: %d pieces, %d bytes", left, pm.bytesLeft())
 
 	return false
 }
 
-// ClaimPiece marks a piece as claimed by a worker for download
-func (pm *PieceManager) ClaimPiece(index int) bool {
+// HasAllWantedPieces checks if every piece of the wanted files is downloaded without logging progress, e.g. to
+// tell if we are seeding
+func (pm *PieceManager) HasAllWantedPieces() bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return pm.piecesLeft() == 0
+}
+
+// DownloadedPieces returns the number of pieces downloaded so far
+func (pm *PieceManager) DownloadedPieces() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return pm.DownloadedCount
+}
+
+// Bitfield returns a bitfield of the pieces we have downloaded and verified
+func (pm *PieceManager) Bitfield() Bitfield {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	bitfield := NewBitfield(pm.PieceCount)
+	for index, piece := range pm.pieces {
+		if piece.IsVerified {
+			bitfield.SetPiece(index)
+		}
+	}
+
+	return bitfield
+}
+
+// ResumeState returns the verified pieces and the blocks written to storage of the pieces that are not complete
+// yet. Complete pieces that are not verified yet are left out so they are downloaded again
+func (pm *PieceManager) ResumeState() (Bitfield, map[int]Bitfield) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	pieces := NewBitfield(pm.PieceCount)
+	partial := make(map[int]Bitfield)
+	for index, piece := range pm.pieces {
+		if piece.IsVerified {
+			pieces.SetPiece(index)
+			continue
+		}
+		if piece.IsDownloaded || piece.ReceivedBlocks == 0 {
+			continue
+		}
+
+		blocks := NewBitfield(len(piece.Blocks))
+		written := false
+		for block, state := range piece.Blocks {
+			// Blocks still waiting in the write queue would be lost by a crash, so they are left out
+			if state.Written {
+				blocks.SetPiece(block)
+				written = true
+			}
+		}
+		if written {
+			partial[index] = blocks
+		}
+	}
+
+	return pieces, partial
+}
+
+// RestoreState marks pieces and blocks as received from saved resume state, the data has to be in storage already.
+// Only the pieces the resume state has as verified skip hashing, a piece completed by its partial blocks is hashed
+// once the disk pipeline runs
+func (pm *PieceManager) RestoreState(pieces Bitfield, partial map[int]Bitfield) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for index, piece := range pm.pieces {
+		blocks, isPartial := partial[index]
+		if !pieces.HasPiece(index) && !isPartial {
+			continue
+		}
+
+		piece.ReceivedBlocks = 0
+		for block := range piece.Blocks {
+			if pieces.HasPiece(index) || blocks.HasPiece(block) {
+				piece.Blocks[block].Received = true
+				piece.Blocks[block].Written = true
+				piece.ReceivedBlocks++
+			}
+		}
+
+		if piece.ReceivedBlocks == len(piece.Blocks) && !piece.IsDownloaded {
+			piece.IsDownloaded = true
+			piece.IsVerified = pieces.HasPiece(index)
+			pm.DownloadedCount++
+		}
+	}
+	if pm.running {
+		pm.queueUnverified()
+	}
+	pm.notifyProgress()
+
+	log.Printf("Restored %d downloaded pieces and %d partial pieces", pm.DownloadedCount, len(partial))
+}
+
+// SetDownloadedPieces sets exactly which pieces are downloaded, e.g. after a recheck of the stored data. Every
+// other piece is reset so it is downloaded again
+func (pm *PieceManager) SetDownloadedPieces(pieces Bitfield) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
+	pm.DownloadedCount = 0
+	for index, piece := range pm.pieces {
+		downloaded := pieces.HasPiece(index)
+		piece.IsDownloaded = downloaded
+		piece.IsVerified = downloaded
+		piece.ReceivedBlocks = 0
+		for block := range piece.Blocks {
+			piece.Blocks[block] = Block{RequestedBy: make(map[string]struct{}), Received: downloaded, Written: downloaded}
+			if downloaded {
+				piece.ReceivedBlocks++
+			}
+		}
+		if downloaded {
+			pm.DownloadedCount++
+		}
+	}
+	pm.endgame = false
+	pm.notifyProgress()
+}
+
+// PieceHash returns the expected SHA-1 hash of a piece
+func (pm *PieceManager) PieceHash(index int) []byte {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
 	if piece, exists := pm.pieces[index]; exists {
-		if !piece.IsDownloaded && !piece.IsClaimed {
-			piece.IsClaimed = true
-			log.Printf("Piece %d claimed", index)
+		return piece.Hash
+	}
+
+	return nil
+}
+
+// RegisterPeer registers a peer with the piece manager, the returned channel receives the blocks the
+// peer has outstanding that were delivered by another peer first so that it can send CANCEL for them
+func (pm *PieceManager) RegisterPeer(peerAddress string) <-chan BlockRequest {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	cancels := make(chan BlockRequest, cancelBufferSize)
+	pm.cancels[peerAddress] = cancels
+
+	return cancels
+}
+
+// UnregisterPeer removes a disconnected peer, its outstanding requests are released while the blocks
+// it already delivered are kept
+func (pm *PieceManager) UnregisterPeer(peerAddress string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	delete(pm.cancels, peerAddress)
+	pm.releaseRequests(peerAddress)
+}
 
+// ReleaseRequests releases every block requested from a peer, e.g. after it choked us
+func (pm *PieceManager) ReleaseRequests(peerAddress string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.releaseRequests(peerAddress)
+}
+
+// releaseRequests releases every block requested from a peer, the caller must hold the lock
+func (pm *PieceManager) releaseRequests(peerAddress string) {
+	for _, piece := range pm.pieces {
+		for i := range piece.Blocks {
+			if _, requested := piece.Blocks[i].RequestedBy[peerAddress]; requested {
+				delete(piece.Blocks[i].RequestedBy, peerAddress)
+				if len(piece.Blocks[i].RequestedBy) == 0 && !piece.Blocks[i].Received {
+					pm.endgame = false
+				}
+			}
+		}
+	}
+}
+
+// IsInteresting checks if a peer has any piece of the wanted files that we still need
+func (pm *PieceManager) IsInteresting(bitfield Bitfield) bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	for index, piece := range pm.pieces {
+		if !piece.IsDownloaded && (piece.Priority != PrioritySkip || pm.inWindow(index)) && bitfield.HasPiece(index) {
 			return true
 		}
 	}
@@ -69,66 +395,344 @@ func (pm *PieceManager) ClaimPiece(index int) bool {
 	return false
 }
 
-// MarkPieceDownloaded marks a piece as downloaded
-func (pm *PieceManager) MarkPieceDownloaded(index int, data []byte) {
+// RequestBlocks picks up to count blocks to request from a peer and marks them as requested by it.
+// Blocks of partially downloaded pieces are preferred so pieces finish quickly, then pieces are picked by
+// priority or in order when sequential, and once every missing block has been requested (endgame) blocks outstanding with other peers
+// are duplicated to this one. Pieces in a streaming read-ahead window go before everything else, while
+// pieces of skipped files are otherwise never requested
+func (pm *PieceManager) RequestBlocks(bitfield Bitfield, peerAddress string, count int) []BlockRequest {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
-	if piece, exists := pm.pieces[index]; exists {
-		if !piece.IsDownloaded {
-			dataCopy := make([]byte, len(data))
-			copy(dataCopy, data)
+	var requests []BlockRequest
+	pick := func(index, block int) {
+		pm.pieces[index].Blocks[block].RequestedBy[peerAddress] = struct{}{}
+		requests = append(requests, pm.blockRequest(index, block))
+	}
 
-			piece.Data = &dataCopy
-			piece.IsDownloaded = true
-			piece.IsClaimed = false
-			pm.DownloadedCount++
+	// pickFree picks the blocks of a piece nobody has been asked for yet, when it matches
+	pickFree := func(index int, matches func(piece *Piece) bool) {
+		piece, exists := pm.pieces[index]
+		if !exists || piece.IsDownloaded || !bitfield.HasPiece(index) || !matches(piece) {
+			return
+		}
+		for block := range piece.Blocks {
+			if len(requests) == count {
+				break
+			}
+			if !piece.Blocks[block].Received && len(piece.Blocks[block].RequestedBy) == 0 {
+				pick(index, block)
+			}
+		}
+	}
 
-			log.Printf("Piece %d marked as downloaded: %x", index, *piece.Data)
+	// Pieces just ahead of a streaming reader come first, in order
+	for index := 0; index < pm.PieceCount && len(requests) < count && len(pm.windows) > 0; index++ {
+		pickFree(index, func(*Piece) bool { return pm.inWindow(index) })
+	}
+
+	if pm.sequential {
+		for index := 0; index < pm.PieceCount && len(requests) < count; index++ {
+			pickFree(index, func(piece *Piece) bool { return piece.Priority != PrioritySkip })
 		}
 	}
+
+	// Then unrequested blocks of started pieces, then new pieces, highest priority first
+	for _, started := range []bool{true, false} {
+		for priority := PriorityHigh; priority > PrioritySkip; priority-- {
+			for index := 0; index < pm.PieceCount && len(requests) < count; index++ {
+				pickFree(index, func(piece *Piece) bool {
+					return piece.Priority == priority && pm.isStarted(piece) == started
+				})
+			}
+		}
+	}
+
+	if len(requests) > 0 || !pm.isEndgame() {
+		return requests
+	}
+
+	// Endgame, duplicate the blocks with the fewest requesters that this peer is not already serving
+	type candidate struct{ index, block, requesters int }
+	var candidates []candidate
+	for index := 0; index < pm.PieceCount; index++ {
+		piece, exists := pm.pieces[index]
+		if !exists || piece.IsDownloaded || piece.Priority == PrioritySkip || !bitfield.HasPiece(index) {
+			continue
+		}
+		for block, state := range piece.Blocks {
+			if _, requested := state.RequestedBy[peerAddress]; !state.Received && !requested {
+				candidates = append(candidates, candidate{index, block, len(state.RequestedBy)})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].requesters < candidates[j].requesters })
+
+	for _, c := range candidates {
+		if len(requests) == count {
+			break
+		}
+		pick(c.index, c.block)
+	}
+
+	return requests
 }
 
-// VerifyPiece verifies that the piece is downloaded and the hash matches the expected hash
-func (pm *PieceManager) VerifyPiece(index int) error {
+// ReleaseBlock releases a single block requested from a peer so it can be requested elsewhere, e.g. one the peer
+// rejected
+func (pm *PieceManager) ReleaseBlock(peerAddress string, request BlockRequest) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	piece, exists := pm.pieces[request.Index]
+	block := request.Begin / BlockSize
+	if !exists || request.Begin%BlockSize != 0 || block < 0 || block >= len(piece.Blocks) {
+		return
+	}
+
+	delete(piece.Blocks[block].RequestedBy, peerAddress)
+	if len(piece.Blocks[block].RequestedBy) == 0 && !piece.Blocks[block].Received {
+		pm.endgame = false
+	}
+}
+
+// BlockReceived hands a block delivered by a peer to the disk queue, blocking while the queue is full so
+// fast peers are slowed down to the speed of the disk. Every other peer the block was requested from is told
+// to cancel its request, and once the last block of a piece is written the piece is hashed in the background
+func (pm *PieceManager) BlockReceived(peerAddress string, index, begin int, data []byte) error {
+	writes, err := pm.markReceived(peerAddress, index, begin, data)
+	if err != nil || writes == nil {
+		return err
+	}
+	defer pm.inflight.Done()
+
+	writes <- writeJob{index: index, begin: begin, data: data}
+
+	return nil
+}
+
+// markReceived marks a block as received and returns the queue it has to be written to, or nil when the block
+// is not needed anymore
+func (pm *PieceManager) markReceived(peerAddress string, index, begin int, data []byte) (chan<- writeJob, error) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
 
 	piece, exists := pm.pieces[index]
 	if !exists {
-		return fmt.Errorf("piece %d does not exist", index)
+		return nil, fmt.Errorf("piece %d does not exist", index)
 	}
 
-	if !piece.IsDownloaded || piece.Data == nil {
-		return fmt.Errorf("piece %d is not downloaded or data is nil", index)
+	block := begin / BlockSize
+	if begin%BlockSize != 0 || block >= len(piece.Blocks) {
+		return nil, fmt.Errorf("invalid block offset %d for piece %d", begin, index)
 	}
 
-	hasher := sha1.New()
-	hasher.Write(*piece.Data)
-	computedHash := hasher.Sum(nil)
+	request := pm.blockRequest(index, block)
+	if len(data) != request.Length {
+		return nil, fmt.Errorf("block %d of piece %d has length %d, expected %d", block, index, len(data), request.Length)
+	}
 
-	if !bytes.Equal(computedHash, piece.Hash) {
-		return fmt.Errorf("piece %d hash does not match the expected hash", index)
+	state := &piece.Blocks[block]
+	delete(state.RequestedBy, peerAddress)
+	if piece.IsDownloaded || state.Received {
+		return nil, nil
+	}
+	if !pm.running {
+		return nil, fmt.Errorf("disk pipeline is not running, dropping block %d of piece %d", block, index)
 	}
 
-	return nil
+	state.Received = true
+	piece.ReceivedBlocks++
+	piece.pendingWrites++
+	pm.inflight.Add(1)
+
+	for other := range state.RequestedBy {
+		select {
+		case pm.cancels[other] <- request:
+		default:
+			// The peer is busy, a duplicate block from it is simply ignored
+		}
+	}
+	state.RequestedBy = make(map[string]struct{})
+
+	if piece.ReceivedBlocks == len(piece.Blocks) {
+		piece.IsDownloaded = true
+		pm.DownloadedCount++
+		log.Printf("Piece %d marked as downloaded", index)
+	}
+
+	return pm.writes, nil
 }
 
-// GetPieceData returns the data stored for the index of a piece
-func (pm *PieceManager) GetPieceData(index int) ([]byte, error) {
+// IsPieceDownloaded checks if a piece has already been downloaded
+func (pm *PieceManager) IsPieceDownloaded(index int) bool {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
 
 	piece, exists := pm.pieces[index]
+	return exists && piece.IsDownloaded
+}
+
+// isEndgame checks for endgame and logs when we enter it, the caller must hold the lock
+func (pm *PieceManager) isEndgame() bool {
+	if pm.endgame {
+		return true
+	}
+	left := pm.piecesLeft()
+	if left == 0 {
+		return false
+	}
+
+	for _, piece := range pm.pieces {
+		if piece.IsDownloaded || piece.Priority == PrioritySkip {
+			continue
+		}
+		for _, block := range piece.Blocks {
+			if !block.Received && len(block.RequestedBy) == 0 {
+				return false
+			}
+		}
+	}
+
+	pm.endgame = true
+	log.Printf("Entering endgame with %d pieces left", left)
+
+	return true
+}
+
+// isStarted checks if any block of a piece has been requested or received, the caller must hold the lock
+func (pm *PieceManager) isStarted(piece *Piece) bool {
+	if piece.ReceivedBlocks > 0 {
+		return true
+	}
+	for _, block := range piece.Blocks {
+		if len(block.RequestedBy) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// blockRequest builds the request for a block of a piece, the last block of a piece can be shorter
+func (pm *PieceManager) blockRequest(index, block int) BlockRequest {
+	begin := block * BlockSize
+	length := BlockSize
+	if pieceLength := pm.PieceLength(index); begin+length > pieceLength {
+		length = pieceLength - begin
+	}
+
+	return BlockRequest{Index: index, Begin: begin, Length: length}
+}
+
+// SetSequential switches between picking pieces in order, e.g. to stream the content, and picking them by priority
+func (pm *PieceManager) SetSequential(sequential bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.sequential = sequential
+}
+
+// SetStreamWindow moves the read-ahead window of a streaming reader to count pieces from first, those pieces are
+// requested before any other even when their files are skipped
+func (pm *PieceManager) SetStreamWindow(reader, first, count int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.windows[reader] = pieceWindow{first: first, last: min(first+count, pm.PieceCount)}
+	pm.endgame = false
+}
+
+// ClearStreamWindow removes the read-ahead window of a reader that is done
+func (pm *PieceManager) ClearStreamWindow(reader int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	delete(pm.windows, reader)
+}
+
+// inWindow checks if a piece is inside the read-ahead window of any reader, the caller must hold the lock
+func (pm *PieceManager) inWindow(index int) bool {
+	for _, window := range pm.windows {
+		if index >= window.first && index < window.last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WaitPiece blocks until a piece has been verified or the context is done
+func (pm *PieceManager) WaitPiece(ctx context.Context, index int) error {
+	for {
+		pm.mu.RLock()
+		piece, exists := pm.pieces[index]
+		verified := exists && piece.IsVerified
+		progress := pm.progress
+		pm.mu.RUnlock()
+
+		if !exists {
+			return fmt.Errorf("piece %d does not exist", index)
+		}
+		if verified {
+			return nil
+		}
+
+		select {
+		case <-progress:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Progress returns a channel that is closed once the next piece is verified
+func (pm *PieceManager) Progress() <-chan struct{} {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return pm.progress
+}
+
+// notifyProgress wakes up everyone waiting for pieces, the caller must hold the write lock
+func (pm *PieceManager) notifyProgress() {
+	close(pm.progress)
+	pm.progress = make(chan struct{})
+}
+
+// ReadBlock returns a copy of a block of a verified piece, e.g. to upload it to a peer
+func (pm *PieceManager) ReadBlock(index, begin, length int) ([]byte, error) {
+	if begin < 0 || length < 0 || begin+length > pm.PieceLength(index) {
+		return nil, fmt.Errorf("block at offset %d with length %d is outside piece %d", begin, length, index)
+	}
+
+	return pm.readPiece(index, begin, length)
+}
+
+// GetPieceData returns the data stored for the index of a verified piece
+func (pm *PieceManager) GetPieceData(index int) ([]byte, error) {
+	return pm.readPiece(index, 0, pm.PieceLength(index))
+}
+
+// readPiece reads part of a verified piece from storage, the lock is only held to check the piece
+func (pm *PieceManager) readPiece(index, begin, length int) ([]byte, error) {
+	pm.mu.RLock()
+	piece, exists := pm.pieces[index]
+	verified := exists && piece.IsVerified
+	store := pm.storage
+	pm.mu.RUnlock()
+
 	if !exists {
 		return nil, fmt.Errorf("piece %d does not exist", index)
 	}
+	if !verified {
+		return nil, fmt.Errorf("piece %d is not verified", index)
+	}
 
-	if !piece.IsDownloaded || piece.Data == nil {
-		return nil, fmt.Errorf("piece %d is not downloaded or data is nil", index)
+	data := make([]byte, length)
+	if _, err := store.ReadAt(index, data, int64(begin)); err != nil {
+		return nil, fmt.Errorf("error reading piece %d: %w", index, err)
 	}
 
-	dataCopy := make([]byte, len(*piece.Data))
-	copy(dataCopy, *piece.Data)
-	return dataCopy, nil
+	return data, nil
 }
@@ -0,0 +1,322 @@
+package types
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+)
+
+func TestPieceLength(t *testing.T) {
+	tests := []struct {
+		name        string
+		pieceCount  int
+		pieceSize   int
+		totalLength int64
+		index       int
+		expected    int
+	}{
+		{"first piece", 3, 32768, 70000, 0, 32768},
+		{"middle piece", 3, 32768, 70000, 1, 32768},
+		{"short last piece", 3, 32768, 70000, 2, 4464},
+		{"exact last piece", 2, 32768, 65536, 1, 32768},
+		{"single short piece", 1, 32768, 100, 0, 100},
+		{"out of range", 3, 32768, 70000, 3, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pm := NewPieceManager(test.pieceCount, test.pieceSize, test.totalLength)
+			if result := pm.PieceLength(test.index); result != test.expected {
+				t.Errorf("expected %d, got %d for piece %d", test.expected, result, test.index)
+			}
+		})
+	}
+}
+
+func TestLastPieceDownload(t *testing.T) {
+	data := make([]byte, BlockSize+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	hash := sha1.Sum(data)
+
+	pm := NewPieceManager(2, 2*BlockSize, int64(2*BlockSize+len(data)))
+	pm.AddPiece(0, make([]byte, 20))
+	pm.AddPiece(1, hash[:])
+
+	bitfield := NewBitfield(2)
+	bitfield.SetPiece(1)
+
+	requests := pm.RequestBlocks(bitfield, "peer", 5)
+	expected := []BlockRequest{{Index: 1, Begin: 0, Length: BlockSize}, {Index: 1, Begin: BlockSize, Length: 100}}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %d requests, got %d: %v", len(expected), len(requests), requests)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Errorf("expected request %v, got %v", expected[i], requests[i])
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan PieceResult, 1)
+	pm.Start(ctx, 2, func(result PieceResult) { results <- result })
+
+	for _, request := range requests {
+		if err := pm.BlockReceived("peer", request.Index, request.Begin, data[request.Begin:request.Begin+request.Length]); err != nil {
+			t.Fatalf("unexpected error storing block %v: %v", request, err)
+		}
+	}
+
+	select {
+	case result := <-results:
+		if result.Index != 1 || result.Err != nil {
+			t.Errorf("expected piece 1 to verify, got %d: %v", result.Index, result.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected piece 1 to be hashed")
+	}
+
+	if block, err := pm.ReadBlock(1, BlockSize, 100); err != nil || !bytes.Equal(block, data[BlockSize:]) {
+		t.Errorf("expected the last block to read back, got %v", err)
+	}
+	if left := pm.BytesLeft(); left != 2*BlockSize {
+		t.Errorf("expected %d bytes left, got %d", 2*BlockSize, left)
+	}
+}
+
+func TestFilePriorities(t *testing.T) {
+	// Four pieces of one block over three files, piece 1 is shared by the first two files
+	layout := storage.NewLayout([]storage.File{
+		{Path: []string{"a"}, Length: BlockSize + 100},
+		{Path: []string{"b"}, Length: 2*BlockSize - 100},
+		{Path: []string{"c"}, Length: BlockSize},
+	}, BlockSize)
+
+	pm := NewPieceManager(layout.PieceCount(), BlockSize, layout.TotalLength)
+	for i := range layout.PieceCount() {
+		pm.AddPiece(i, make([]byte, 20))
+	}
+	pm.SetLayout(layout)
+
+	if err := pm.SetFilePriority(1, PrioritySkip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := pm.SetFilePriority(2, PriorityHigh); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := pm.SetFilePriority(3, PriorityLow); err == nil {
+		t.Errorf("expected an error for a file that does not exist, but got none")
+	}
+
+	bitfield := NewBitfield(layout.PieceCount())
+	for i := range layout.PieceCount() {
+		bitfield.SetPiece(i)
+	}
+
+	// The high priority piece comes first, the piece only covering the skipped file never
+	requests := pm.RequestBlocks(bitfield, "peer", 4)
+	expected := []int{3, 0, 1}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %d requests, got %d: %v", len(expected), len(requests), requests)
+	}
+	for i := range expected {
+		if requests[i].Index != expected[i] {
+			t.Errorf("expected request %d for piece %d, got piece %d", i, expected[i], requests[i].Index)
+		}
+	}
+
+	if left := pm.BytesLeft(); left != 3*BlockSize {
+		t.Errorf("expected %d bytes left, got %d", 3*BlockSize, left)
+	}
+
+	pm.SetDownloadedPieces(Bitfield{0b11010000})
+	if !pm.IsDownloadComplete() {
+		t.Errorf("expected the download to be complete with only the skipped file missing")
+	}
+
+	only := NewBitfield(layout.PieceCount())
+	only.SetPiece(2)
+	if pm.IsInteresting(only) {
+		t.Errorf("expected a peer with only a skipped piece not to be interesting")
+	}
+}
+
+func TestFilePriorityMovesSkippedBytes(t *testing.T) {
+	layout := storage.NewLayout([]storage.File{
+		{Path: []string{"a"}, Length: 4},
+		{Path: []string{"b"}, Length: 4},
+	}, 6)
+	dir := t.TempDir()
+	s, err := storage.NewFileStorage(dir, layout, []bool{true, false})
+	if err != nil {
+		t.Fatalf("unexpected error creating storage: %v", err)
+	}
+	defer s.Close()
+
+	pm := NewPieceManager(layout.PieceCount(), 6, layout.TotalLength)
+	pm.SetLayout(layout)
+	pm.SetStorage(s)
+	if err := pm.SetFilePriority(1, PrioritySkip); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := s.WriteAt(0, []byte("abcdef"), 0); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+
+	// The bytes of the shared piece sit in the part file until the file is wanted again
+	if err := pm.SetFilePriority(1, PriorityNormal); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatalf("expected the file to be created once it is wanted, got %v", err)
+	}
+	if string(data) != "ef" {
+		t.Errorf("expected %q, got %q", "ef", data)
+	}
+}
+
+func TestStreamWindowPicking(t *testing.T) {
+	pm := NewPieceManager(6, BlockSize, 6*BlockSize)
+	bitfield := NewBitfield(6)
+	for i := range 6 {
+		pm.AddPiece(i, make([]byte, 20))
+		bitfield.SetPiece(i)
+	}
+	pm.SetSequential(true)
+	pm.SetStreamWindow(1, 3, 2)
+
+	requests := pm.RequestBlocks(bitfield, "peer", 4)
+	expected := []int{3, 4, 0, 1}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %d requests, got %d: %v", len(expected), len(requests), requests)
+	}
+	for i := range expected {
+		if requests[i].Index != expected[i] {
+			t.Errorf("expected request %d for piece %d, got piece %d", i, expected[i], requests[i].Index)
+		}
+	}
+}
+
+func TestResumeStateWrittenBlocks(t *testing.T) {
+	pm := NewPieceManager(1, 2*BlockSize, 2*BlockSize)
+	pm.AddPiece(0, make([]byte, 20))
+	layout := storage.NewLayout([]storage.File{{Path: []string{"a"}, Length: 2 * BlockSize}}, 2*BlockSize)
+	pm.SetStorage(storage.NewMemoryStorage(layout))
+
+	// The disk pipeline is left stopped so the block stays in the write queue
+	pm.running = true
+	pm.writes = make(chan writeJob, 1)
+	if err := pm.BlockReceived("peer", 0, 0, make([]byte, BlockSize)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, partial := pm.ResumeState(); len(partial) != 0 {
+		t.Errorf("expected no partial pieces while the block is queued, got %v", partial)
+	}
+
+	pm.writeBlock(<-pm.writes)
+	_, partial := pm.ResumeState()
+	if blocks, ok := partial[0]; !ok || !blocks.HasPiece(0) || blocks.HasPiece(1) {
+		t.Errorf("expected block 0 of piece 0 once it is written, got %v", partial)
+	}
+}
+
+func TestRestoreStateHashesPartialPieces(t *testing.T) {
+	layout := storage.NewLayout([]storage.File{{Path: []string{"a"}, Length: 3 * BlockSize}}, BlockSize)
+	content := make([]byte, layout.TotalLength)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	store := storage.NewMemoryStorage(layout)
+	pm := NewPieceManager(layout.PieceCount(), BlockSize, layout.TotalLength)
+	for i := range layout.PieceCount() {
+		hash := sha1.Sum(content[i*BlockSize : (i+1)*BlockSize])
+		pm.AddPiece(i, hash[:])
+		// Piece 2 was not written before the client stopped
+		if i < 2 {
+			store.WriteAt(i, content[i*BlockSize:(i+1)*BlockSize], 0)
+		}
+	}
+	pm.SetStorage(store)
+
+	// Piece 0 was verified, pieces 1 and 2 only have all their blocks written
+	verified := NewBitfield(layout.PieceCount())
+	verified.SetPiece(0)
+	pm.RestoreState(verified, map[int]Bitfield{1: {0b10000000}, 2: {0b10000000}})
+
+	results := make(chan PieceResult, layout.PieceCount())
+	ctx, cancel := context.WithCancel(context.Background())
+	pm.Start(ctx, 1, func(result PieceResult) { results <- result })
+	hashed := make(map[int]error)
+	for range 2 {
+		select {
+		case result := <-results:
+			hashed[result.Index] = result.Err
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the restored partial pieces to be hashed, got %v", hashed)
+		}
+	}
+	cancel()
+	pm.Wait()
+
+	if err, ok := hashed[1]; !ok || err != nil {
+		t.Errorf("expected piece 1 to be hashed and verified, got %v", err)
+	}
+	if err, ok := hashed[2]; !ok || err == nil {
+		t.Errorf("expected piece 2 to fail hashing")
+	}
+	if _, ok := hashed[0]; ok {
+		t.Errorf("expected the verified piece 0 not to be hashed again")
+	}
+	if !pm.IsPieceDownloaded(1) || pm.IsPieceDownloaded(2) {
+		t.Errorf("expected piece 1 to be downloaded and piece 2 to be requeued")
+	}
+}
+
+func TestWaitHashesQueuedPieces(t *testing.T) {
+	const pieces = 8
+	layout := storage.NewLayout([]storage.File{{Path: []string{"a"}, Length: pieces * BlockSize}}, BlockSize)
+	store := storage.NewMemoryStorage(layout)
+	pm := NewPieceManager(pieces, BlockSize, layout.TotalLength)
+	partial := make(map[int]Bitfield)
+	for i := range pieces {
+		data := bytes.Repeat([]byte{byte(i)}, BlockSize)
+		hash := sha1.Sum(data)
+		pm.AddPiece(i, hash[:])
+		store.WriteAt(i, data, 0)
+		partial[i] = Bitfield{0b10000000}
+	}
+	pm.SetStorage(store)
+	pm.RestoreState(NewBitfield(pieces), partial)
+
+	// Stopping right away still hashes every piece that was queued
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var mu sync.Mutex
+	hashed := 0
+	pm.Start(ctx, 2, func(result PieceResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		if result.Err == nil {
+			hashed++
+		}
+	})
+	pm.Wait()
+
+	if hashed != pieces {
+		t.Errorf("expected %d pieces hashed before Wait returns, got %d", pieces, hashed)
+	}
+	if _, partial := pm.ResumeState(); len(partial) != 0 || pm.DownloadedCount != pieces {
+		t.Errorf("expected every piece to be verified, got %d downloaded and partial pieces %v", pm.DownloadedCount, partial)
+	}
+}
@@ -0,0 +1,48 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priority is how urgently the pieces of a file are downloaded, skipped files are not downloaded at all
+type Priority int
+
+const (
+	PrioritySkip   Priority = 0
+	PriorityLow    Priority = 1
+	PriorityNormal Priority = 2
+	PriorityHigh   Priority = 3
+)
+
+// String returns the name of a priority as used on the command line
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+}
+
+// IsValid checks if a priority is one of the known priorities
+func (p Priority) IsValid() bool {
+	return p >= PrioritySkip && p <= PriorityHigh
+}
+
+// ParsePriority parses the name of a priority
+func ParsePriority(name string) (Priority, error) {
+	for p := PrioritySkip; p <= PriorityHigh; p++ {
+		if strings.EqualFold(name, p.String()) {
+			return p, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown priority %q, expected skip, low, normal or high", name)
+}
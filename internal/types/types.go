@@ -3,11 +3,18 @@ package types
 import (
 	"fmt"
 	"sync"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
 )
 
 const (
 	ProtocolString = "BitTorrent protocol"
 	ProtocolLength = byte(len(ProtocolString))
+
+	extensionProtocolByte = 5    // Reserved byte holding the extension protocol bit
+	extensionProtocolBit  = 0x10 // Set by peers supporting the extension protocol (BEP 10)
+	fastExtensionByte     = 7    // Reserved byte holding the fast extension bit
+	fastExtensionBit      = 0x04 // Set by peers supporting the fast extension (BEP 6)
 )
 
 // MessageID will identify which message we are dealing with in the Peer Wire Protocol
@@ -24,6 +31,12 @@ const (
 	MsgPiece         MessageID = 7
 	MsgCancel        MessageID = 8
 	MsgPort          MessageID = 9
+	MsgSuggest       MessageID = 13 // Fast extension (BEP 6) messages from here up to MsgAllowedFast
+	MsgHaveAll       MessageID = 14
+	MsgHaveNone      MessageID = 15
+	MsgReject        MessageID = 16
+	MsgAllowedFast   MessageID = 17
+	MsgExtended      MessageID = 20 // Extension protocol (BEP 10), the first payload byte is the extended message ID
 	MsgKeepAlive     MessageID = 255
 )
 
@@ -36,6 +49,9 @@ type Torrent struct {
 	CreatedBy    string
 	Encoding     string
 	Info         *InfoDictionary
+	InfoBytes    []byte   // The info dictionary exactly as it is bencoded in the .torrent file
+	URLList      []string // Web seeds (BEP 19) serving the content over HTTP or FTP
+	HTTPSeeds    []string // Servers (BEP 17) serving pieces by infohash
 	PieceManager *PieceManager
 }
 
@@ -49,6 +65,25 @@ type InfoDictionary struct {
 	Files       *[]File
 }
 
+// TotalLength returns the length of the torrent content, the single file length or the sum of the files
+func (info *InfoDictionary) TotalLength() int64 {
+	if info.Files == nil {
+		return info.Length
+	}
+
+	var total int64
+	for _, file := range *info.Files {
+		total += file.Length
+	}
+
+	return total
+}
+
+// IsPrivate reports whether the torrent is private, peers of private torrents only come from its trackers
+func (info *InfoDictionary) IsPrivate() bool {
+	return info.Private != nil && *info.Private == 1
+}
+
 // File represents multiple file torrents defined in the .torrent file
 type File struct {
 	Length int64
@@ -56,42 +91,102 @@ type File struct {
 	Path   []string
 }
 
-// Piece represents a torrent piece
+// BlockSize is the size of the blocks we request pieces in, the last block of a piece can be shorter
+const BlockSize = 16384
+
+// BlockRequest identifies a block of a piece by its piece index, offset and length
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// Block tracks the download state of a single block of a piece
+type Block struct {
+	RequestedBy map[string]struct{} // Addresses of the peers we have requested this block from
+	Received    bool
+	Written     bool // The block reached the storage, a cache in front of it may still hold it back
+}
+
+// Piece represents a torrent piece, its data lives in the storage of the piece manager
 type Piece struct {
-	Hash         []byte
-	Data         *[]byte
-	IsDownloaded bool
-	IsClaimed    bool
+	Hash           []byte
+	IsDownloaded   bool
+	Blocks         []Block
+	ReceivedBlocks int
+	Priority       Priority // Highest priority of the files the piece covers
+	IsVerified     bool     // The stored data matched the hash, so it can be read back
+
+	pendingWrites int  // Received blocks still waiting in the disk queue
+	hashing       bool // Queued for or being hashed
 }
 
 // NewPiece will return a pointer to a new piece
-func NewPiece(hash []byte) *Piece {
-	return &Piece{
+func NewPiece(hash []byte, blockCount int) *Piece {
+	piece := &Piece{
 		Hash:         hash,
-		Data:         nil,
 		IsDownloaded: false,
-		IsClaimed:    false,
+		Blocks:       make([]Block, blockCount),
+		Priority:     PriorityNormal,
+	}
+	for i := range piece.Blocks {
+		piece.Blocks[i].RequestedBy = make(map[string]struct{})
 	}
+
+	return piece
 }
 
 // PieceManager tracks and manages the pieces of a torrent while we download and upload
 type PieceManager struct {
 	DownloadedCount int
 	PieceCount      int
-	PieceSize       int
+	PieceSize       int   // Nominal piece length, every piece but the last has exactly this length
+	TotalLength     int64 // Length of the whole torrent content
 
-	mu     sync.RWMutex // Use RWMutex for better concurrency
-	pieces map[int]*Piece
+	mu      sync.RWMutex // Use RWMutex for better concurrency
+	pieces  map[int]*Piece
+	endgame bool
+	cancels map[string]chan BlockRequest // Per peer channels told about blocks another peer delivered first
+	storage storage.Storage              // Blocks are written here as they arrive
+	layout  storage.Layout               // Maps pieces onto files for file priorities
+	files   []Priority                   // Priority of every file in the layout
+
+	sequential bool                // Pick pieces in order instead of by priority
+	windows    map[int]pieceWindow // Pieces just ahead of every streaming reader, requested before anything else
+	progress   chan struct{}       // Closed and replaced whenever pieces are verified
+
+	writes     chan writeJob     // Received blocks waiting to be written
+	hashes     chan int          // Pieces waiting to be hashed
+	onVerified func(PieceResult) // Told about every hashed piece
+	running    bool              // Blocks are accepted while the disk pipeline runs
+	inflight   sync.WaitGroup    // Blocks being handed to the write queue
+	stopped    chan struct{}     // Closed once the disk pipeline has stopped
+}
+
+// pieceWindow is a range of pieces from first up to but not including last
+type pieceWindow struct {
+	first, last int
 }
 
-// NewPieceManager creates a piece manager and returns a pointer to it
-func NewPieceManager(pieceCount, pieceSize int) *PieceManager {
+// NewPieceManager creates a piece manager and returns a pointer to it, pieces are kept in memory until
+// another storage is set
+func NewPieceManager(pieceCount, pieceSize int, totalLength int64) *PieceManager {
+	layout := storage.NewLayout([]storage.File{{Length: totalLength}}, pieceSize)
+
 	return &PieceManager{
 		DownloadedCount: 0,
 		PieceCount:      pieceCount,
 		PieceSize:       pieceSize,
+		TotalLength:     totalLength,
+
+		pieces:  make(map[int]*Piece),
+		cancels: make(map[string]chan BlockRequest),
+		storage: storage.NewMemoryStorage(layout),
+		layout:  layout,
+		files:   []Priority{PriorityNormal},
 
-		pieces: make(map[int]*Piece),
+		windows:  make(map[int]pieceWindow),
+		progress: make(chan struct{}),
 	}
 }
 
@@ -100,14 +195,16 @@ type Peer struct {
 	PeerID    string
 	Address   string
 	PeerState PeerState
+	Bitfield  Bitfield
 }
 
 // NewPeer returns a pointer to a peer type
-func NewPeer(peerID, address string, peerState PeerState) *Peer {
+func NewPeer(peerID, address string, peerState PeerState, pieceCount int) *Peer {
 	return &Peer{
 		PeerID:    peerID,
 		Address:   address,
 		PeerState: peerState,
+		Bitfield:  NewBitfield(pieceCount),
 	}
 }
 
@@ -150,7 +247,7 @@ func NewHandshake(infohash []byte, clientID []byte) ([]byte, error) {
 	handshake := &Handshake{
 		ProtocolStringLength: ProtocolLength,
 		ProtocolString:       ProtocolString,
-		Reserved:             [8]byte{}, // Reserved bytes are all zero
+		Reserved:             [8]byte{extensionProtocolByte: extensionProtocolBit, fastExtensionByte: fastExtensionBit}, // We support the extension protocol and fast extension
 		Infohash:             [20]byte(infohash),
 		PeerID:               [20]byte(clientID),
 	}
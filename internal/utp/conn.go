@@ -0,0 +1,708 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	packetSize      = 1400                    // Largest packet we send, it fits the MTU of most paths
+	maxPayload      = packetSize - headerSize // Bytes of data in a full packet
+	minWindow       = 2 * packetSize
+	maxWindow       = 1 << 20
+	sendBufferSize  = 1 << 20 // Bytes Write queues before it blocks
+	recvBufferSize  = 1 << 20 // Bytes we advertise as our receive window
+	maxReorderDepth = 1024    // Most packets past the next expected one we keep, later ones are dropped
+
+	targetDelay    = 100 * time.Millisecond // LEDBAT keeps the queuing delay it adds around this
+	gain           = 1.0                    // Most the window grows per round trip, in packets
+	baseDelayRange = time.Minute            // Base delays are kept for two of these
+
+	initialRTO     = time.Second
+	minRTO         = 500 * time.Millisecond
+	maxRTO         = 60 * time.Second
+	maxTimeouts    = 6 // Timeouts in a row before the connection is given up
+	maxSynTimeouts = 2 // Timeouts of the SYN before a dial fails
+	dupAckLimit    = 3 // Duplicate ACKs or later selective ACKs before a packet counts as lost
+	tickInterval   = 50 * time.Millisecond
+	closeTimeout   = 5 * time.Second // How long Close waits for the remote to acknowledge our data and FIN
+)
+
+var errTimeout = errors.New("uTP connection timed out")
+var errReset = errors.New("uTP connection reset by peer")
+
+// state of a connection
+type state int
+
+const (
+	stateSynSent state = iota
+	stateConnected
+	stateClosed
+)
+
+// outPacket is a packet we sent that has not been acknowledged yet
+type outPacket struct {
+	kind          uint8
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	acked         bool // Acknowledged by a selective ACK while an earlier packet is still missing
+}
+
+// Conn is a uTP connection (BEP 29), a reliable ordered byte stream over UDP that backs off with LEDBAT when it
+// adds queuing delay so it does not slow down other traffic on the link
+type Conn struct {
+	socket *Socket
+	remote *net.UDPAddr
+	recvID uint16 // Connection id the remote sends to us with
+	sendID uint16 // Connection id we send to the remote with
+
+	connected chan struct{} // Closed once the connection is established
+	closed    chan struct{} // Closed once the connection is torn down
+
+	mu       sync.Mutex
+	state    state
+	err      error         // Why the connection was torn down
+	changed  chan struct{} // Closed and replaced whenever data, acknowledgements or deadlines change
+	closing  bool          // Close was called, a FIN follows the queued data
+	finSent  bool
+	finSeq   uint16 // Sequence number of the FIN of the remote
+	gotFin   bool
+	needsAck bool // Data arrived that we have not acknowledged yet
+
+	seq        uint16 // Next sequence number we send
+	ack        uint16 // Last sequence number received in order
+	lastAck    uint16 // Last acknowledgement the remote sent, for duplicate ACKs
+	dupAcks    int
+	inflight   []*outPacket
+	inflightN  int // Bytes of unacknowledged data in flight
+	sendBuf    []byte
+	readBuf    bytes.Buffer
+	outOfOrder map[uint16][]byte
+	reordered  int // Bytes of the payloads in outOfOrder
+
+	cwnd       float64 // Congestion window in bytes
+	peerWnd    int     // Receive window the remote advertised
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	timeouts   int
+	lastLoss   time.Time
+	replyDelay uint32    // Delay we measured for the last packet of the remote, sent back in every packet
+	baseDelays [2]uint32 // Lowest delays the remote measured in the current and previous range
+	baseStart  time.Time // When the current base delay range started
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// newConn creates a connection, the caller registers it with the socket
+func newConn(s *Socket, remote *net.UDPAddr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		socket:     s,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		connected:  make(chan struct{}),
+		closed:     make(chan struct{}),
+		changed:    make(chan struct{}),
+		outOfOrder: make(map[uint16][]byte),
+		cwnd:       minWindow,
+		peerWnd:    recvBufferSize,
+		rto:        initialRTO,
+		baseDelays: [2]uint32{math.MaxUint32, math.MaxUint32},
+		baseStart:  time.Now(),
+	}
+}
+
+// connect sends the SYN of a connection we dial
+func (c *Conn) connect() {
+	c.mu.Lock()
+	c.state = stateSynSent
+	c.seq = 1
+	c.transmit(&outPacket{kind: stSyn, seq: c.seq})
+	c.seq++
+	c.mu.Unlock()
+
+	go c.run()
+}
+
+// accept answers the SYN of a connection the remote opened
+func (c *Conn) accept(syn header) {
+	seq, _ := randomUint16()
+
+	c.mu.Lock()
+	c.state = stateConnected
+	c.seq = seq
+	c.ack = syn.seq
+	c.receiveTimestamp(syn)
+	c.sendState()
+	close(c.connected)
+	c.mu.Unlock()
+
+	go c.run()
+}
+
+// run retransmits lost packets until the connection is torn down
+func (c *Conn) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			c.checkTimeout(now)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// checkTimeout resends the oldest unacknowledged packet when it timed out, the caller must hold the lock
+func (c *Conn) checkTimeout(now time.Time) {
+	oldest := c.firstUnacked()
+	if oldest == nil || now.Sub(oldest.sentAt) < c.rto {
+		return
+	}
+
+	c.timeouts++
+	limit := maxTimeouts
+	if c.state == stateSynSent {
+		limit = maxSynTimeouts
+	}
+	if c.timeouts > limit {
+		c.teardown(errTimeout)
+		return
+	}
+
+	// A timeout means the path is congested badly, so the window starts over at a single packet
+	c.rto = min(c.rto*2, maxRTO)
+	c.cwnd = packetSize
+	c.retransmit(oldest, now)
+}
+
+// handle processes a packet the remote sent
+func (c *Conn) handle(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	now := time.Now()
+
+	switch h.kind {
+	case stReset:
+		c.teardown(errReset)
+		return
+	case stSyn:
+		// Our STATE got lost, the remote dials again
+		c.sendState()
+		return
+	}
+
+	c.receiveTimestamp(h)
+	c.peerWnd = int(h.wnd)
+	if c.state == stateSynSent {
+		if h.kind != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ack = h.seq - 1
+		close(c.connected)
+	}
+	c.processAcks(h, now)
+
+	switch h.kind {
+	case stData:
+		c.receiveData(h.seq, payload)
+	case stFin:
+		if !c.gotFin {
+			c.gotFin = true
+			c.finSeq = h.seq
+		}
+		c.needsAck = true
+		c.deliver()
+	}
+
+	c.flush()
+	if c.needsAck {
+		c.sendState()
+	}
+	c.notify()
+
+	// Both sides finished and everything of ours arrived
+	if c.finSent && c.gotFin && c.ack == c.finSeq && len(c.inflight) == 0 {
+		c.teardown(net.ErrClosed)
+	}
+}
+
+// receiveTimestamp measures the delay of a packet of the remote, the caller must hold the lock
+func (c *Conn) receiveTimestamp(h header) {
+	c.replyDelay = micros(time.Now()) - h.timestamp
+}
+
+// processAcks marks the packets the remote acknowledged and adjusts the congestion window, the caller must hold the
+// lock
+func (c *Conn) processAcks(h header, now time.Time) {
+	ackedBytes := 0
+	for _, p := range c.inflight {
+		if p.acked || (seqLess(h.ack, p.seq) && !h.acks(p.seq)) {
+			continue
+		}
+		p.acked = true
+		ackedBytes += len(p.payload)
+		c.inflightN -= len(p.payload)
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+	}
+
+	newlyAcked := len(c.inflight) > 0 && c.inflight[0].acked
+	for len(c.inflight) > 0 && c.inflight[0].acked {
+		c.inflight = c.inflight[1:]
+	}
+
+	switch {
+	case ackedBytes > 0 || newlyAcked:
+		c.timeouts = 0
+		c.dupAcks = 0
+		c.ledbat(ackedBytes, h.timestampDiff, now)
+	case h.kind == stState && h.ack == c.lastAck && len(c.inflight) > 0:
+		c.dupAcks++
+		if c.dupAcks == dupAckLimit {
+			c.lost(c.firstUnacked(), now)
+		}
+	}
+	c.lastAck = h.ack
+
+	// A packet that dupAckLimit later packets overtook is lost
+	if len(h.sack) > 0 {
+		overtaken := 0
+		for i := len(c.inflight) - 1; i >= 0; i-- {
+			p := c.inflight[i]
+			if p.acked {
+				overtaken++
+			} else if overtaken >= dupAckLimit && p.transmissions == 1 {
+				c.lost(p, now)
+			}
+		}
+	}
+}
+
+// updateRTT adds a round trip time sample and updates the retransmission timeout, the caller must hold the lock
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		diff := c.rtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		c.rttVar += (diff - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = max(c.rtt+4*c.rttVar, minRTO)
+}
+
+// ledbat grows or shrinks the congestion window by how far the queuing delay is from the target, the delay is the
+// one the remote measured for our packets minus the lowest it measured lately. The caller must hold the lock
+func (c *Conn) ledbat(ackedBytes int, delay uint32, now time.Time) {
+	if ackedBytes == 0 {
+		return
+	}
+
+	var queuing time.Duration
+	if delay != 0 {
+		if now.Sub(c.baseStart) > baseDelayRange {
+			c.baseDelays[1], c.baseDelays[0] = c.baseDelays[0], math.MaxUint32
+			c.baseStart = now
+		}
+		if c.baseDelays[0] == math.MaxUint32 || int32(delay-c.baseDelays[0]) < 0 {
+			c.baseDelays[0] = delay
+		}
+		base := c.baseDelays[0]
+		if c.baseDelays[1] != math.MaxUint32 && int32(c.baseDelays[1]-base) < 0 {
+			base = c.baseDelays[1]
+		}
+		queuing = time.Duration(max(int32(delay-base), 0)) * time.Microsecond
+	}
+
+	offTarget := float64(targetDelay-queuing) / float64(targetDelay)
+	c.cwnd += gain * offTarget * float64(ackedBytes) * packetSize / c.cwnd
+	c.cwnd = min(max(c.cwnd, minWindow), maxWindow)
+}
+
+// lost retransmits a lost packet and halves the window at most once a round trip, the caller must hold the lock
+func (c *Conn) lost(p *outPacket, now time.Time) {
+	if p == nil {
+		return
+	}
+
+	if now.Sub(c.lastLoss) > c.rtt {
+		c.cwnd = max(c.cwnd/2, minWindow)
+		c.lastLoss = now
+	}
+	c.retransmit(p, now)
+}
+
+// firstUnacked returns the oldest packet still waiting for an acknowledgement, the caller must hold the lock
+func (c *Conn) firstUnacked() *outPacket {
+	for _, p := range c.inflight {
+		if !p.acked {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// receiveData queues a data packet for reading, packets arriving early wait until the gap is filled. Packets too
+// far ahead or beyond the receive window we advertise are dropped, the remote sends them again. The caller must
+// hold the lock
+func (c *Conn) receiveData(seq uint16, payload []byte) {
+	c.needsAck = true
+	if !seqLess(c.ack, seq) {
+		return // A retransmission of data we already have
+	}
+	if seq-c.ack > maxReorderDepth {
+		return
+	}
+	if _, queued := c.outOfOrder[seq]; !queued && len(payload) > 0 {
+		if len(payload) > int(c.window()) {
+			return
+		}
+		c.outOfOrder[seq] = payload
+		c.reordered += len(payload)
+	}
+	c.deliver()
+}
+
+// deliver moves packets that are now in order to the read buffer, the caller must hold the lock
+func (c *Conn) deliver() {
+	for {
+		next := c.ack + 1
+		if payload, ok := c.outOfOrder[next]; ok {
+			c.readBuf.Write(payload)
+			delete(c.outOfOrder, next)
+			c.reordered -= len(payload)
+			c.ack = next
+			continue
+		}
+		if c.gotFin && next == c.finSeq {
+			c.ack = next
+		}
+		return
+	}
+}
+
+// window returns the receive window we advertise, the caller must hold the lock
+func (c *Conn) window() uint32 {
+	return uint32(max(recvBufferSize-c.readBuf.Len()-c.reordered, 0))
+}
+
+// selectiveAck builds the selective ACK bitmask of the packets received out of order, the caller must hold the lock
+func (c *Conn) selectiveAck() []byte {
+	if len(c.outOfOrder) == 0 {
+		return nil
+	}
+
+	sack := make([]byte, maxSelectiveAck)
+	last := -1
+	for seq := range c.outOfOrder {
+		offset := int(seq - c.ack - 2)
+		if offset < 0 || offset >= maxSelectiveAck*8 {
+			continue
+		}
+		sack[offset/8] |= 1 << (offset % 8)
+		last = max(last, offset)
+	}
+	if last < 0 {
+		return nil
+	}
+
+	// The bitmask is a multiple of 4 bytes
+	return sack[:(last/32+1)*4]
+}
+
+// flush sends queued data as far as the congestion window and the window of the remote allow, once Close was called
+// and everything is sent the FIN follows. The caller must hold the lock
+func (c *Conn) flush() {
+	if c.state != stateConnected {
+		return
+	}
+
+	window := min(int(c.cwnd), c.peerWnd)
+	for len(c.sendBuf) > 0 {
+		n := min(len(c.sendBuf), maxPayload)
+		// A packet may always go out when nothing is in flight, it probes a closed window of the remote
+		if c.inflightN > 0 && c.inflightN+n > window {
+			return
+		}
+
+		payload := make([]byte, n)
+		copy(payload, c.sendBuf)
+		c.sendBuf = c.sendBuf[n:]
+		c.transmit(&outPacket{kind: stData, seq: c.seq, payload: payload})
+		c.inflightN += n
+		c.seq++
+	}
+
+	if c.closing && !c.finSent {
+		c.transmit(&outPacket{kind: stFin, seq: c.seq})
+		c.seq++
+		c.finSent = true
+	}
+}
+
+// transmit sends a new packet and keeps it until it is acknowledged, the caller must hold the lock
+func (c *Conn) transmit(p *outPacket) {
+	c.inflight = append(c.inflight, p)
+	c.retransmit(p, time.Now())
+}
+
+// retransmit sends a packet again with the current acknowledgement, the caller must hold the lock
+func (c *Conn) retransmit(p *outPacket, now time.Time) {
+	p.sentAt = now
+	p.transmissions++
+
+	connID := c.sendID
+	if p.kind == stSyn {
+		connID = c.recvID
+	}
+	c.needsAck = false
+	c.socket.send(header{
+		kind:          p.kind,
+		connID:        connID,
+		timestamp:     micros(now),
+		timestampDiff: c.replyDelay,
+		wnd:           c.window(),
+		seq:           p.seq,
+		ack:           c.ack,
+	}, p.payload, c.remote)
+}
+
+// sendState acknowledges what we received, the caller must hold the lock
+func (c *Conn) sendState() {
+	c.needsAck = false
+	c.socket.send(header{
+		kind:          stState,
+		connID:        c.sendID,
+		timestamp:     micros(time.Now()),
+		timestampDiff: c.replyDelay,
+		wnd:           c.window(),
+		seq:           c.seq,
+		ack:           c.ack,
+		sack:          c.selectiveAck(),
+	}, nil, c.remote)
+}
+
+// notify wakes up readers and writers waiting for a change, the caller must hold the lock
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// teardown closes the connection for good, the caller must hold the lock
+func (c *Conn) teardown(err error) {
+	if c.state == stateClosed {
+		return
+	}
+
+	c.state = stateClosed
+	c.err = err
+	close(c.closed)
+	c.notify()
+	c.socket.remove(c)
+}
+
+// fail tears the connection down and tells the remote
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != stateClosed {
+		c.socket.send(header{kind: stReset, connID: c.sendID, timestamp: micros(time.Now()), seq: c.seq, ack: c.ack}, nil, c.remote)
+	}
+	c.teardown(err)
+}
+
+// closeErr returns why the connection was torn down
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// wait blocks until the connection changes or the deadline passes, it returns false on the deadline
+func wait(changed <-chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-changed
+		return true
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Read reads data received in order, it returns io.EOF once the remote closed the connection and everything it
+// sent was read
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.readBuf.Len() > 0 {
+			before := c.window()
+			n, _ := c.readBuf.Read(b)
+			// The remote stops sending on a closed window, so it is told as soon as there is room again
+			if before < packetSize && c.window() >= packetSize && c.state == stateConnected {
+				c.sendState()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.gotFin && c.ack == c.finSeq {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.state == stateClosed {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		changed, deadline := c.changed, c.readDeadline
+		c.mu.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if !wait(changed, deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write queues data to send, it blocks while the send buffer is full
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		c.mu.Lock()
+		if c.state == stateClosed {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+		if c.closing {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+
+		n := min(sendBufferSize-len(c.sendBuf), len(b))
+		c.sendBuf = append(c.sendBuf, b[:n]...)
+		b = b[n:]
+		written += n
+		c.flush()
+		changed, deadline := c.changed, c.writeDeadline
+		c.mu.Unlock()
+
+		if len(b) == 0 {
+			return written, nil
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+		if !wait(changed, deadline) {
+			return written, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Close sends the queued data and a FIN, it waits a little for the remote to acknowledge them
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.state == stateClosed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closing = true
+	c.flush()
+	c.mu.Unlock()
+
+	deadline := time.Now().Add(closeTimeout)
+	for {
+		c.mu.Lock()
+		done := c.state == stateClosed || (c.finSent && len(c.inflight) == 0 && len(c.sendBuf) == 0)
+		changed := c.changed
+		c.mu.Unlock()
+
+		if done || !wait(changed, deadline) {
+			break
+		}
+	}
+
+	c.mu.Lock()
+	c.teardown(net.ErrClosed)
+	c.mu.Unlock()
+
+	return nil
+}
+
+// LocalAddr returns the address of the socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+// RemoteAddr returns the address of the remote
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline, c.writeDeadline = t, t
+	c.notify()
+
+	return nil
+}
+
+// SetReadDeadline sets when reads give up, zero means never
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.notify()
+
+	return nil
+}
+
+// SetWriteDeadline sets when writes give up, zero means never
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+	c.notify()
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version         = 1
+	headerSize      = 20
+	extSelectiveAck = 1
+	maxSelectiveAck = 32 // Bytes of the selective ACK bitmask we send at most, covering 256 packets
+)
+
+// header is the header of a uTP packet
+type header struct {
+	kind          uint8
+	connID        uint16
+	timestamp     uint32 // Microseconds when the packet was sent
+	timestampDiff uint32 // Delay the sender measured for the last packet it received from us
+	wnd           uint32 // Bytes the sender can still receive
+	seq           uint16
+	ack           uint16
+	sack          []byte // Selective ACK bitmask, bit i acknowledges packet ack+2+i
+}
+
+// marshal builds a packet from the header and a payload
+func (h header) marshal(payload []byte) []byte {
+	packet := make([]byte, headerSize, headerSize+2+len(h.sack)+len(payload))
+	packet[0] = h.kind<<4 | version
+	if len(h.sack) > 0 {
+		packet[1] = extSelectiveAck
+	}
+	binary.BigEndian.PutUint16(packet[2:], h.connID)
+	binary.BigEndian.PutUint32(packet[4:], h.timestamp)
+	binary.BigEndian.PutUint32(packet[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(packet[12:], h.wnd)
+	binary.BigEndian.PutUint16(packet[16:], h.seq)
+	binary.BigEndian.PutUint16(packet[18:], h.ack)
+
+	if len(h.sack) > 0 {
+		packet = append(packet, 0, byte(len(h.sack)))
+		packet = append(packet, h.sack...)
+	}
+
+	return append(packet, payload...)
+}
+
+// parsePacket splits a packet into its header and payload, unknown extensions are skipped
+func parsePacket(packet []byte) (header, []byte, error) {
+	if len(packet) < headerSize {
+		return header{}, nil, fmt.Errorf("packet too short: %d bytes", len(packet))
+	}
+
+	h := header{
+		kind:          packet[0] >> 4,
+		connID:        binary.BigEndian.Uint16(packet[2:]),
+		timestamp:     binary.BigEndian.Uint32(packet[4:]),
+		timestampDiff: binary.BigEndian.Uint32(packet[8:]),
+		wnd:           binary.BigEndian.Uint32(packet[12:]),
+		seq:           binary.BigEndian.Uint16(packet[16:]),
+		ack:           binary.BigEndian.Uint16(packet[18:]),
+	}
+	if packet[0]&0x0f != version {
+		return header{}, nil, fmt.Errorf("unsupported version %d", packet[0]&0x0f)
+	}
+	if h.kind > stSyn {
+		return header{}, nil, fmt.Errorf("unknown packet type %d", h.kind)
+	}
+
+	offset := headerSize
+	for extension := packet[1]; extension != 0; {
+		if offset+2 > len(packet) {
+			return header{}, nil, fmt.Errorf("truncated extension header")
+		}
+		next, length := packet[offset], int(packet[offset+1])
+		if offset+2+length > len(packet) {
+			return header{}, nil, fmt.Errorf("extension %d of %d bytes is truncated", extension, length)
+		}
+		if extension == extSelectiveAck {
+			h.sack = packet[offset+2 : offset+2+length]
+		}
+		extension = next
+		offset += 2 + length
+	}
+
+	return h, packet[offset:], nil
+}
+
+// acks checks if the selective ACK of a header acknowledges a sequence number
+func (h header) acks(seq uint16) bool {
+	offset := int(seq - h.ack - 2)
+	if offset >= len(h.sack)*8 {
+		return false
+	}
+
+	return h.sack[offset/8]&(1<<(offset%8)) != 0
+}
+
+// seqLess compares sequence numbers, they wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// micros returns a timestamp in microseconds, it wraps around
+func micros(t time.Time) uint32 {
+	return uint32(t.UnixMicro())
+}
@@ -0,0 +1,224 @@
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	acceptQueueSize = 16
+	maxPacketSize   = 65535
+)
+
+// connKey identifies a connection by the remote address and the connection id the remote sends to us with
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket carries every uTP connection over a single UDP socket, it dials connections and accepts the
+// connections remote peers open to it
+type Socket struct {
+	conn *net.UDPConn
+
+	mu     sync.Mutex
+	conns  map[connKey]*Conn
+	accept chan *Conn
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	drop func() bool // Drops outgoing packets it returns true for, tests use it to simulate loss
+}
+
+// Listen opens a socket on a UDP address, e.g. ":6881"
+func Listen(address string) (*Socket, error) {
+	return listen(address, nil)
+}
+
+// listen opens a socket that drops the outgoing packets drop returns true for
+func listen(address string, drop func() bool) (*Socket, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving uTP address %s: %w", address, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening for uTP on %s: %w", address, err)
+	}
+
+	s := &Socket{
+		conn:   conn,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptQueueSize),
+		closed: make(chan struct{}),
+		drop:   drop,
+	}
+	go s.readLoop()
+
+	return s, nil
+}
+
+// Addr returns the UDP address of the socket
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Accept waits for a remote peer to open a connection, it makes the socket a net.Listener
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the socket and every connection on it
+func (s *Socket) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.conn.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	})
+
+	return nil
+}
+
+// Dial opens a connection to a host:port
+func (s *Socket) Dial(ctx context.Context, address string) (*Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %w", address, err)
+	}
+
+	// The remote sends to us with our receive id, which has to be unique for the address
+	s.mu.Lock()
+	var c *Conn
+	for c == nil {
+		recvID, err := randomUint16()
+		if err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		if _, taken := s.conns[connKey{remote.String(), recvID}]; !taken {
+			c = newConn(s, remote, recvID, recvID+1)
+			s.conns[connKey{remote.String(), recvID}] = c
+		}
+	}
+	s.mu.Unlock()
+
+	c.connect()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.closed:
+		return nil, fmt.Errorf("error connecting to %s: %w", address, c.closeErr())
+	case <-ctx.Done():
+		c.fail(ctx.Err())
+		return nil, fmt.Errorf("error connecting to %s: %w", address, ctx.Err())
+	}
+}
+
+// readLoop hands every packet to its connection until the socket is closed
+func (s *Socket) readLoop() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				log.Printf("uTP socket stopped reading: %v", err)
+				s.Close()
+			}
+			return
+		}
+
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		// The connection keeps the selective ACK and payload after the buffer is reused
+		h.sack = append([]byte(nil), h.sack...)
+		s.dispatch(h, append([]byte(nil), payload...), from)
+	}
+}
+
+// dispatch hands a packet to its connection, a SYN opens a new connection and packets of unknown connections
+// are answered with a reset
+func (s *Socket) dispatch(h header, payload []byte, from *net.UDPAddr) {
+	id := h.connID
+	if h.kind == stSyn {
+		id++
+	}
+
+	s.mu.Lock()
+	c, exists := s.conns[connKey{from.String(), id}]
+	if !exists && h.kind == stSyn {
+		c = newConn(s, from, id, h.connID)
+		s.conns[connKey{from.String(), id}] = c
+	}
+	s.mu.Unlock()
+
+	switch {
+	case exists:
+		c.handle(h, payload)
+	case h.kind == stSyn:
+		c.accept(h)
+		select {
+		case s.accept <- c:
+		default:
+			c.fail(fmt.Errorf("accept queue full"))
+		}
+	case h.kind != stReset:
+		s.send(header{kind: stReset, connID: h.connID, timestamp: micros(time.Now()), ack: h.seq}, nil, from)
+	}
+}
+
+// remove forgets a closed connection
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// send writes a packet to a remote address
+func (s *Socket) send(h header, payload []byte, to *net.UDPAddr) {
+	if s.drop != nil && s.drop() {
+		return
+	}
+
+	s.conn.WriteToUDP(h.marshal(payload), to)
+}
+
+// randomUint16 returns a random number for connection ids and sequence numbers
+func randomUint16() (uint16, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("error generating random number: %w", err)
+	}
+
+	return binary.BigEndian.Uint16(b[:]), nil
+}
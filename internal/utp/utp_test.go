@@ -0,0 +1,201 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	mathrand "math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	h := header{kind: stState, connID: 7, timestamp: 1, timestampDiff: 2, wnd: 3, seq: 65535, ack: 10, sack: []byte{0x05, 0, 0, 0x80}}
+
+	parsed, payload, err := parsePacket(h.marshal([]byte("data")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parsed.kind != h.kind || parsed.connID != h.connID || parsed.seq != h.seq || parsed.ack != h.ack || !bytes.Equal(parsed.sack, h.sack) || string(payload) != "data" {
+		t.Errorf("expected %+v with data, got %+v with %q", h, parsed, payload)
+	}
+
+	// Bit i of the selective ACK acknowledges ack+2+i
+	for seq, expected := range map[uint16]bool{11: false, 12: true, 13: false, 14: true, 43: true, 44: false} {
+		if result := parsed.acks(seq); result != expected {
+			t.Errorf("expected selective ACK of %d to be %t, got %t", seq, expected, result)
+		}
+	}
+
+	if _, _, err := parsePacket([]byte{0x41, 1}); err == nil {
+		t.Errorf("expected an error for a short packet, but got none")
+	}
+	if _, _, err := parsePacket(header{kind: 9}.marshal(nil)); err == nil {
+		t.Errorf("expected an error for an unknown packet type, but got none")
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	tests := []struct {
+		a, b     uint16
+		expected bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{65535, 0, true},
+		{0, 65535, false},
+		{5, 5, false},
+	}
+
+	for _, test := range tests {
+		if result := seqLess(test.a, test.b); result != test.expected {
+			t.Errorf("expected seqLess(%d, %d) to be %t, got %t", test.a, test.b, test.expected, result)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name     string
+		lossRate float64
+	}{
+		{"lossless", 0},
+		{"lossy", 0.05},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testTransfer(t, test.lossRate)
+		})
+	}
+}
+
+// testTransfer sends data both ways between two sockets that drop a share of their packets
+func testTransfer(t *testing.T, lossRate float64) {
+	drop := func() bool { return mathrand.Float64() < lossRate }
+	listener, err := listen("127.0.0.1:0", drop)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer listener.Close()
+
+	dialer, err := listen("127.0.0.1:0", drop)
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer dialer.Close()
+
+	upload := make([]byte, 512<<10)
+	download := make([]byte, 256<<10)
+	rand.Read(upload)
+	rand.Read(download)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+		received := make([]byte, len(upload))
+		if _, err := io.ReadFull(conn, received); err != nil {
+			served <- err
+			return
+		}
+		if !bytes.Equal(received, upload) {
+			t.Errorf("expected the uploaded data to arrive intact")
+		}
+		if _, err := conn.Write(download); err != nil {
+			served <- err
+			return
+		}
+		served <- conn.Close()
+	}()
+
+	conn, err := dialer.Dial(ctx, listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error dialing: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := conn.Write(upload); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if !bytes.Equal(received, download) {
+		t.Errorf("expected %d downloaded bytes intact, got %d bytes", len(download), len(received))
+	}
+	conn.Close()
+
+	if err := <-served; err != nil {
+		t.Errorf("unexpected error serving: %v", err)
+	}
+}
+
+func TestDialUnreachable(t *testing.T) {
+	socket, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	defer socket.Close()
+
+	// Nothing answers on a closed socket, the dial gives up with the context
+	closed, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	address := closed.Addr().String()
+	closed.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := socket.Dial(ctx, address); err == nil {
+		t.Errorf("expected an error dialing a closed socket, but got none")
+	}
+}
+
+func TestReceiveDataLimits(t *testing.T) {
+	c := newConn(nil, nil, 1, 2)
+	payload := make([]byte, 1000)
+
+	tests := []struct {
+		name   string
+		seq    uint16
+		queued bool
+	}{
+		{"next but one", 2, true},
+		{"deepest kept", maxReorderDepth, true},
+		{"too far ahead", maxReorderDepth + 1, false},
+		{"far past the window", 30000, false},
+	}
+
+	for _, test := range tests {
+		c.receiveData(test.seq, payload)
+		if _, queued := c.outOfOrder[test.seq]; queued != test.queued {
+			t.Errorf("%s: expected queued to be %t, got %t", test.name, test.queued, queued)
+		}
+	}
+
+	// Early packets stop being kept once they fill the advertised window
+	c.outOfOrder = make(map[uint16][]byte)
+	c.reordered = 0
+	big := make([]byte, recvBufferSize/4)
+	for seq := uint16(2); seq < 10; seq++ {
+		c.receiveData(seq, big)
+	}
+	if c.reordered > recvBufferSize || len(c.outOfOrder) != 4 {
+		t.Errorf("expected 4 packets and at most %d bytes kept, got %d packets and %d bytes", recvBufferSize, len(c.outOfOrder), c.reordered)
+	}
+	if c.window() != 0 {
+		t.Errorf("expected a closed window, got %d", c.window())
+	}
+}
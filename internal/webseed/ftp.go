@@ -0,0 +1,176 @@
+package webseed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	FTPPort          = "21"
+	FTPAnonymousUser = "anonymous"
+	FTPAnonymousPass = "anonymous@"
+)
+
+// getFTP reads length bytes of a file starting at start from an FTP server. Every read logs in on a connection of
+// its own, restarts the transfer at start and closes the data connection once it has the bytes it wants
+func getFTP(ctx context.Context, fileURL string, start, length int64) ([]byte, error) {
+	u, err := url.Parse(fileURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FTP URL %s: %w", fileURL, err)
+	}
+	// A line break in the path would end the RETR command and start another one
+	if strings.ContainsAny(u.Path, "\r\n") {
+		return nil, fmt.Errorf("invalid FTP path in %s", fileURL)
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), FTPPort)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, RequestTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %w", fileURL, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	// Cancelling the context unblocks a read or write that is waiting on the server
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	control := textproto.NewConn(conn)
+	if _, _, err := control.ReadResponse(2); err != nil {
+		return nil, fmt.Errorf("error greeting %s: %w", fileURL, err)
+	}
+	if err := ftpLogin(control, u.User); err != nil {
+		return nil, fmt.Errorf("error logging in to %s: %w", fileURL, err)
+	}
+	if _, _, err := ftpCommand(control, 2, "TYPE I"); err != nil {
+		return nil, fmt.Errorf("error setting binary mode for %s: %w", fileURL, err)
+	}
+
+	dataAddress, err := ftpPassive(control, conn.RemoteAddr())
+	if err != nil {
+		return nil, fmt.Errorf("error entering passive mode for %s: %w", fileURL, err)
+	}
+	data, err := d.DialContext(ctx, "tcp", dataAddress)
+	if err != nil {
+		return nil, fmt.Errorf("error opening data connection for %s: %w", fileURL, err)
+	}
+	defer data.Close()
+	data.SetDeadline(deadline)
+
+	if start > 0 {
+		if _, _, err := ftpCommand(control, 3, "REST %d", start); err != nil {
+			return nil, fmt.Errorf("error restarting %s at byte %d: %w", fileURL, start, err)
+		}
+	}
+	if _, _, err := ftpCommand(control, 1, "RETR %s", strings.TrimPrefix(u.Path, "/")); err != nil {
+		return nil, fmt.Errorf("error retrieving %s: %w", fileURL, err)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(data, buf); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", fileURL, err)
+	}
+
+	return buf, nil
+}
+
+// ftpLogin logs in with the user of the URL, anonymously when it has none
+func ftpLogin(control *textproto.Conn, user *url.Userinfo) error {
+	name, password := FTPAnonymousUser, FTPAnonymousPass
+	if user != nil {
+		name = user.Username()
+		password, _ = user.Password()
+	}
+
+	code, _, err := ftpCommand(control, 0, "USER %s", name)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230:
+		return nil
+	case 331:
+		_, _, err := ftpCommand(control, 2, "PASS %s", password)
+		return err
+	default:
+		return fmt.Errorf("unexpected reply %d to USER", code)
+	}
+}
+
+// ftpPassive asks the server for a data connection address, with EPSV and with PASV for servers without it. The
+// host of the control connection is used for both, an address in a PASV reply may be one we can not reach
+func ftpPassive(control *textproto.Conn, remote net.Addr) (string, error) {
+	host, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return "", err
+	}
+
+	code, message, err := ftpCommand(control, 0, "EPSV")
+	if err != nil {
+		return "", err
+	}
+	if code == 229 {
+		// 229 Entering Extended Passive Mode (|||port|)
+		fields := strings.Split(between(message, "(", ")"), "|")
+		if len(fields) != 5 {
+			return "", fmt.Errorf("invalid EPSV reply %q", message)
+		}
+		port, err := strconv.Atoi(fields[3])
+		if err != nil || port <= 0 || port > 65535 {
+			return "", fmt.Errorf("invalid EPSV port in %q", message)
+		}
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	}
+
+	_, message, err = ftpCommand(control, 2, "PASV")
+	if err != nil {
+		return "", err
+	}
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+	fields := strings.Split(between(message, "(", ")"), ",")
+	if len(fields) != 6 {
+		return "", fmt.Errorf("invalid PASV reply %q", message)
+	}
+	high, highErr := strconv.Atoi(strings.TrimSpace(fields[4]))
+	low, lowErr := strconv.Atoi(strings.TrimSpace(fields[5]))
+	if highErr != nil || lowErr != nil || high < 0 || high > 255 || low < 0 || low > 255 {
+		return "", fmt.Errorf("invalid PASV port in %q", message)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(high<<8|low)), nil
+}
+
+// ftpCommand sends a command and reads its reply, which has to start with the digits of expectCode when it is not 0
+func ftpCommand(control *textproto.Conn, expectCode int, format string, args ...any) (int, string, error) {
+	id, err := control.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	control.StartResponse(id)
+	defer control.EndResponse(id)
+
+	return control.ReadResponse(expectCode)
+}
+
+// between returns the part of s between the first open and the last close after it, or "" when there is none
+func between(s, open, close string) string {
+	first := strings.Index(s, open)
+	last := strings.LastIndex(s, close)
+	if first < 0 || last < first {
+		return ""
+	}
+	return s[first+len(open) : last]
+}
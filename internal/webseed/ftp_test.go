@@ -0,0 +1,176 @@
+package webseed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+// serveFTP runs a minimal FTP server for files, keyed by path, until the listener is closed. Servers with epsv
+// false reject EPSV so clients have to fall back to PASV
+func serveFTP(t *testing.T, files map[string][]byte, epsv bool) net.Listener {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error listening: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleFTP(conn, files, epsv)
+		}
+	}()
+
+	return listener
+}
+
+// handleFTP answers the commands of one FTP control connection
+func handleFTP(conn net.Conn, files map[string][]byte, epsv bool) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(format string, args ...any) { fmt.Fprintf(conn, format+"\r\n", args...) }
+	reply("220 ready")
+
+	var data net.Listener
+	var offset int64
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command, argument, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+
+		switch command {
+		case "USER":
+			reply("331 password please")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 binary")
+		case "EPSV", "PASV":
+			if command == "EPSV" && !epsv {
+				reply("500 unknown command")
+				continue
+			}
+			data, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			defer data.Close()
+			port := data.Addr().(*net.TCPAddr).Port
+			if command == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (10,0,0,1,%d,%d)", port>>8, port&0xff)
+			}
+		case "REST":
+			offset, _ = strconv.ParseInt(argument, 10, 64)
+			reply("350 restarting")
+		case "RETR":
+			content, ok := files[argument]
+			if !ok || data == nil || offset > int64(len(content)) {
+				reply("550 no such file")
+				continue
+			}
+			reply("150 opening data connection")
+			dataConn, err := data.Accept()
+			if err != nil {
+				return
+			}
+			dataConn.Write(content[offset:])
+			dataConn.Close()
+			reply("226 transfer complete")
+			data, offset = nil, 0
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestGetFTP(t *testing.T) {
+	content := []byte("0123456789abcdef")
+	files := map[string][]byte{"pub/dir/a file": content}
+
+	for _, epsv := range []bool{true, false} {
+		listener := serveFTP(t, files, epsv)
+		defer listener.Close()
+		address := "ftp://" + listener.Addr().String() + "/pub/dir/a%20file"
+
+		tests := []struct {
+			start, length int64
+		}{
+			{0, 16},
+			{4, 6},
+			{15, 1},
+		}
+		for _, test := range tests {
+			data, err := getFTP(context.Background(), address, test.start, test.length)
+			if err != nil {
+				t.Errorf("epsv %t, bytes %d+%d: unexpected error: %v", epsv, test.start, test.length, err)
+				continue
+			}
+			if !bytes.Equal(data, content[test.start:test.start+test.length]) {
+				t.Errorf("epsv %t, bytes %d+%d: expected %q, got %q", epsv, test.start, test.length, content[test.start:test.start+test.length], data)
+			}
+		}
+
+		if _, err := getFTP(context.Background(), address, 10, 10); err == nil {
+			t.Errorf("epsv %t: expected an error for bytes past the end of the file, but got none", epsv)
+		}
+		if _, err := getFTP(context.Background(), "ftp://"+listener.Addr().String()+"/missing", 0, 1); err == nil {
+			t.Errorf("epsv %t: expected an error for a missing file, but got none", epsv)
+		}
+	}
+}
+
+func TestRunFTP(t *testing.T) {
+	first, second := make([]byte, 20000), make([]byte, 50000)
+	rand.Read(first)
+	rand.Read(second)
+	listener := serveFTP(t, map[string][]byte{"content/first": first, "content/second": second}, true)
+	defer listener.Close()
+
+	const pieceLength = 2 * types.BlockSize
+	content := append(append([]byte(nil), first...), second...)
+	info := &types.InfoDictionary{Name: "content", PieceLength: pieceLength, Files: &[]types.File{
+		{Path: []string{"first"}, Length: int64(len(first))},
+		{Path: []string{"second"}, Length: int64(len(second))},
+	}}
+	layout := storage.NewLayout([]storage.File{
+		{Path: []string{"content", "first"}, Length: int64(len(first))},
+		{Path: []string{"content", "second"}, Length: int64(len(second))},
+	}, pieceLength)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pm := startPieceManager(ctx, content, layout)
+
+	seed, err := New("ftp://"+listener.Addr().String()+"/", info, pm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	seed.Run(ctx, nil)
+
+	if !pm.HasAllWantedPieces() {
+		t.Fatalf("expected every piece to be downloaded")
+	}
+	cancel()
+	pm.Wait()
+	checkPieces(t, pm, content, layout)
+}
@@ -0,0 +1,105 @@
+package webseed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+const (
+	DefaultRetryAfter = time.Minute // Wait when a busy server does not say how long
+
+	maxRetryAfterBody = 32 // Most bytes of a 503 response read for the seconds to wait
+)
+
+// HashSeed downloads pieces from an httpseeds server (BEP 17), which serves pieces of torrents by infohash
+type HashSeed struct {
+	address  string
+	infoHash []byte
+	pm       *types.PieceManager
+	client   *http.Client
+}
+
+// NewHashSeed creates an httpseeds downloader for the server at address
+func NewHashSeed(address string, infoHash []byte, pm *types.PieceManager) (*HashSeed, error) {
+	base, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid httpseed URL %q: %w", address, err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported httpseed URL %q, only http and https are supported", address)
+	}
+
+	return &HashSeed{
+		address:  address,
+		infoHash: infoHash,
+		pm:       pm,
+		client:   &http.Client{Timeout: RequestTimeout},
+	}, nil
+}
+
+// Run downloads pieces from the server until every wanted piece is downloaded or the context is done, received
+// is called with the length of each block. A busy server is asked again after the time it answers with
+func (h *HashSeed) Run(ctx context.Context, received func(int)) {
+	run(ctx, h.pm, h.address, h.fetchPiece, received)
+}
+
+// fetchPiece requests length bytes of a piece starting at begin, the range end is inclusive
+func (h *HashSeed) fetchPiece(ctx context.Context, index, begin, length int) ([]byte, error) {
+	pieceURL, err := url.Parse(h.address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid httpseed URL %q: %w", h.address, err)
+	}
+	query := pieceURL.Query()
+	query.Set("info_hash", string(h.infoHash))
+	query.Set("piece", strconv.Itoa(index))
+	query.Set("ranges", fmt.Sprintf("%d-%d", begin, begin+length-1))
+	pieceURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pieceURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for %s: %w", h.address, err)
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting piece %d from %s: %w", index, h.address, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		return nil, &retryAfterError{after: retryAfter(resp), err: fmt.Errorf("%s is busy", h.address)}
+	default:
+		return nil, fmt.Errorf("unexpected status %s for piece %d from %s", resp.Status, index, h.address)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("error reading piece %d from %s: %w", index, h.address, err)
+	}
+
+	return data, nil
+}
+
+// retryAfter returns how long a busy server wants us to wait, the body of the response holds the seconds and the
+// Retry-After header is used when it does not
+func retryAfter(resp *http.Response) time.Duration {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxRetryAfterBody))
+	if seconds, err := strconv.Atoi(strings.TrimSpace(string(body))); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return DefaultRetryAfter
+}
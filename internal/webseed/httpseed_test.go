@@ -0,0 +1,93 @@
+package webseed
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		body     string
+		header   string
+		expected time.Duration
+	}{
+		{"30", "", 30 * time.Second},
+		{" 5\n", "120", 5 * time.Second},
+		{"busy", "120", 2 * time.Minute},
+		{"", "", DefaultRetryAfter},
+		{"-1", "", DefaultRetryAfter},
+	}
+
+	for _, test := range tests {
+		resp := &http.Response{Body: io.NopCloser(strings.NewReader(test.body)), Header: http.Header{}}
+		if test.header != "" {
+			resp.Header.Set("Retry-After", test.header)
+		}
+		if result := retryAfter(resp); result != test.expected {
+			t.Errorf("expected %v for body %q and header %q, got %v", test.expected, test.body, test.header, result)
+		}
+	}
+}
+
+func TestHashSeedRun(t *testing.T) {
+	const pieceLength = 2 * types.BlockSize
+	content := make([]byte, 3*pieceLength-500)
+	rand.Read(content)
+	infoHash := []byte("01234567890123456789")
+	layout := storage.NewLayout([]storage.File{{Path: []string{"content"}, Length: int64(len(content))}}, pieceLength)
+
+	// The server is busy for the first request
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, "1")
+			return
+		}
+
+		query := r.URL.Query()
+		piece, err := strconv.Atoi(query.Get("piece"))
+		if query.Get("info_hash") != string(infoHash) || err != nil {
+			http.Error(w, "unknown torrent", http.StatusNotFound)
+			return
+		}
+		for _, byteRange := range strings.Split(query.Get("ranges"), ",") {
+			var begin, end int
+			if _, err := fmt.Sscanf(byteRange, "%d-%d", &begin, &end); err != nil {
+				http.Error(w, "invalid range", http.StatusBadRequest)
+				return
+			}
+			w.Write(content[piece*pieceLength+begin : piece*pieceLength+end+1])
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pm := startPieceManager(ctx, content, layout)
+
+	seed, err := NewHashSeed(server.URL+"/seed?x=1", infoHash, pm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	seed.Run(ctx, nil)
+
+	if !pm.HasAllWantedPieces() {
+		t.Fatalf("expected every piece to be downloaded")
+	}
+	cancel()
+	pm.Wait()
+	checkPieces(t, pm, content, layout)
+}
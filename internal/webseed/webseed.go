@@ -0,0 +1,254 @@
+package webseed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+const (
+	MaxRequestBlocks = 64               // Most blocks fetched in a round, contiguous blocks of a piece go in one HTTP request
+	MinBackoff       = 30 * time.Second // Wait after the first failed request, doubled with every failure in a row
+	MaxBackoff       = 10 * time.Minute
+	IdleInterval     = 5 * time.Second // Most we wait before asking again when every missing block is requested elsewhere
+	RequestTimeout   = 60 * time.Second
+)
+
+// Downloader downloads pieces from a server, a web seed or an httpseed
+type Downloader interface {
+	Run(ctx context.Context, received func(int))
+}
+
+// file is a file of the torrent content and the URL the web seed serves it at
+type file struct {
+	url    string
+	offset int64 // Offset of the first byte of the file within the torrent content
+	length int64
+}
+
+// Seed downloads pieces from a web seed (BEP 19), an HTTP or FTP server with the torrent content as plain files
+type Seed struct {
+	address     string
+	files       []file
+	pieceLength int
+	pm          *types.PieceManager
+	client      *http.Client
+}
+
+// New creates a web seed for the url-list entry address. An address ending in "/" is the directory the content is
+// in, otherwise it is the single file of a single file torrent
+func New(address string, info *types.InfoDictionary, pm *types.PieceManager) (*Seed, error) {
+	base, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid web seed URL %q: %w", address, err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" && base.Scheme != "ftp" {
+		return nil, fmt.Errorf("unsupported web seed URL %q, only http, https and ftp are supported", address)
+	}
+
+	s := &Seed{
+		address:     address,
+		pieceLength: info.PieceLength,
+		pm:          pm,
+		client:      &http.Client{Timeout: RequestTimeout},
+	}
+
+	if info.Files == nil {
+		fileURL := address
+		if strings.HasSuffix(address, "/") {
+			fileURL += url.PathEscape(info.Name)
+		}
+		s.files = []file{{url: fileURL, length: info.Length}}
+		return s, nil
+	}
+
+	if !strings.HasSuffix(address, "/") {
+		address += "/"
+	}
+	var offset int64
+	for _, f := range *info.Files {
+		escaped := []string{url.PathEscape(info.Name)}
+		for _, component := range f.Path {
+			escaped = append(escaped, url.PathEscape(component))
+		}
+		s.files = append(s.files, file{url: address + strings.Join(escaped, "/"), offset: offset, length: f.Length})
+		offset += f.Length
+	}
+
+	return s, nil
+}
+
+// Run downloads pieces from the web seed until every wanted piece is downloaded or the context is done. Blocks
+// go through the piece manager like those of peers and received is called with the length of each one. The
+// seed backs off after failed requests
+func (s *Seed) Run(ctx context.Context, received func(int)) {
+	run(ctx, s.pm, s.address, s.fetchPiece, received)
+}
+
+// fetchFunc fetches length bytes of a piece starting at begin
+type fetchFunc func(ctx context.Context, index, begin, length int) ([]byte, error)
+
+// retryAfterError is a failure after which the server told us how long to wait
+type retryAfterError struct {
+	after time.Duration
+	err   error
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", e.err, e.after)
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// run requests blocks for a server with every piece and fetches them until every wanted piece is downloaded or the
+// context is done, backing off after failures
+func run(ctx context.Context, pm *types.PieceManager, address string, fetch fetchFunc, received func(int)) {
+	pm.RegisterPeer(address)
+	defer pm.UnregisterPeer(address)
+
+	// The server has every piece
+	bitfield := types.NewBitfield(pm.PieceCount)
+	bitfield.SetAll(pm.PieceCount)
+
+	backoff := time.Duration(0)
+	for !pm.HasAllWantedPieces() {
+		// Idle until a piece is verified, which may be the last one, or until requests of other peers are released
+		progress := pm.Progress()
+		wait := IdleInterval
+		if requests := pm.RequestBlocks(bitfield, address, MaxRequestBlocks); len(requests) > 0 {
+			err := download(ctx, pm, address, fetch, requests, received)
+			if err == nil {
+				backoff = 0
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+
+			pm.ReleaseRequests(address)
+			var retry *retryAfterError
+			if errors.As(err, &retry) {
+				wait = min(retry.after, MaxBackoff)
+			} else {
+				backoff = min(max(2*backoff, MinBackoff), MaxBackoff)
+				wait = backoff
+			}
+			progress = nil
+			log.Printf("Web seed %s failed, retrying in %v: %v", address, wait, err)
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-progress:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// download fetches the requested blocks, each run of contiguous blocks of a piece with a single fetch
+func download(ctx context.Context, pm *types.PieceManager, address string, fetch fetchFunc, requests []types.BlockRequest, received func(int)) error {
+	for start := 0; start < len(requests); {
+		end := start + 1
+		for end < len(requests) && requests[end].Index == requests[start].Index && requests[end].Begin == requests[end-1].Begin+requests[end-1].Length {
+			end++
+		}
+
+		first, last := requests[start], requests[end-1]
+		data, err := fetch(ctx, first.Index, first.Begin, last.Begin+last.Length-first.Begin)
+		if err != nil {
+			return err
+		}
+
+		for _, request := range requests[start:end] {
+			block := data[request.Begin-first.Begin : request.Begin-first.Begin+request.Length]
+			if err := pm.BlockReceived(address, request.Index, request.Begin, block); err != nil {
+				return fmt.Errorf("error storing block %d of piece %d: %w", request.Begin, request.Index, err)
+			}
+			if received != nil {
+				received(request.Length)
+			}
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// fetchPiece reads length bytes of a piece starting at begin from the files they are in
+func (s *Seed) fetchPiece(ctx context.Context, index, begin, length int) ([]byte, error) {
+	return s.fetch(ctx, int64(index)*int64(s.pieceLength)+int64(begin), length)
+}
+
+// fetch reads length bytes of the torrent content starting at offset, with a range request to each file the
+// bytes are in
+func (s *Seed) fetch(ctx context.Context, offset int64, length int) ([]byte, error) {
+	data := make([]byte, 0, length)
+	for _, f := range s.files {
+		if len(data) == length {
+			break
+		}
+		if f.length == 0 || offset >= f.offset+f.length {
+			continue
+		}
+
+		start := offset - f.offset
+		n := min(f.length-start, int64(length-len(data)))
+		part, err := s.get(ctx, f.url, start, n)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, part...)
+		offset += n
+	}
+
+	if len(data) != length {
+		return nil, fmt.Errorf("content ends after %d of %d bytes", len(data), length)
+	}
+
+	return data, nil
+}
+
+// get reads length bytes of a file starting at start. A server that ignores the range is only accepted when the
+// range starts at the beginning of the file
+func (s *Seed) get(ctx context.Context, fileURL string, start, length int64) ([]byte, error) {
+	if strings.HasPrefix(fileURL, "ftp://") {
+		return getFTP(ctx, fileURL, start, length)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for %s: %w", fileURL, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting %s: %w", fileURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && start == 0:
+	default:
+		return nil, fmt.Errorf("unexpected status %s for bytes %d-%d of %s", resp.Status, start, start+length-1, fileURL)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", fileURL, err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,131 @@
+package webseed
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestFileURLs(t *testing.T) {
+	single := &types.InfoDictionary{Name: "a file.iso", Length: 10, PieceLength: 16}
+	multi := &types.InfoDictionary{Name: "dir", PieceLength: 16, Files: &[]types.File{
+		{Path: []string{"sub", "x#1"}, Length: 4},
+		{Path: []string{"y"}, Length: 6},
+	}}
+
+	tests := []struct {
+		name     string
+		address  string
+		info     *types.InfoDictionary
+		expected []string
+	}{
+		{"single file", "http://host/a.iso", single, []string{"http://host/a.iso"}},
+		{"single file in directory", "http://host/pub/", single, []string{"http://host/pub/a%20file.iso"}},
+		{"multi file", "http://host/pub", multi, []string{"http://host/pub/dir/sub/x%231", "http://host/pub/dir/y"}},
+	}
+
+	for _, test := range tests {
+		seed, err := New(test.address, test.info, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if len(seed.files) != len(test.expected) {
+			t.Fatalf("%s: expected %d files, got %d", test.name, len(test.expected), len(seed.files))
+		}
+		for i, expected := range test.expected {
+			if seed.files[i].url != expected {
+				t.Errorf("%s: expected URL %s, got %s", test.name, expected, seed.files[i].url)
+			}
+		}
+	}
+
+	if _, err := New("ftp://host/a.iso", single, nil); err != nil {
+		t.Errorf("unexpected error for an ftp web seed: %v", err)
+	}
+	if _, err := New("gopher://host/a.iso", single, nil); err == nil {
+		t.Errorf("expected an error for a gopher web seed, but got none")
+	}
+}
+
+func TestRun(t *testing.T) {
+	// Two files that share the middle piece
+	dir := t.TempDir()
+	first, second := make([]byte, 20000), make([]byte, 50000)
+	rand.Read(first)
+	rand.Read(second)
+	os.MkdirAll(filepath.Join(dir, "content"), 0o755)
+	os.WriteFile(filepath.Join(dir, "content", "first"), first, 0o644)
+	os.WriteFile(filepath.Join(dir, "content", "second"), second, 0o644)
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	const pieceLength = 2 * types.BlockSize
+	content := append(append([]byte(nil), first...), second...)
+	info := &types.InfoDictionary{Name: "content", PieceLength: pieceLength, Files: &[]types.File{
+		{Path: []string{"first"}, Length: int64(len(first))},
+		{Path: []string{"second"}, Length: int64(len(second))},
+	}}
+	layout := storage.NewLayout([]storage.File{
+		{Path: []string{"content", "first"}, Length: int64(len(first))},
+		{Path: []string{"content", "second"}, Length: int64(len(second))},
+	}, pieceLength)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pm := startPieceManager(ctx, content, layout)
+
+	seed, err := New(server.URL+"/", info, pm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var received int
+	seed.Run(ctx, func(n int) { received += n })
+
+	if !pm.HasAllWantedPieces() {
+		t.Fatalf("expected every piece to be downloaded")
+	}
+	cancel()
+	pm.Wait()
+	if received != len(content) {
+		t.Errorf("expected %d bytes received, got %d", len(content), received)
+	}
+	checkPieces(t, pm, content, layout)
+}
+
+// startPieceManager starts a piece manager for content stored in memory
+func startPieceManager(ctx context.Context, content []byte, layout storage.Layout) *types.PieceManager {
+	pm := types.NewPieceManager(layout.PieceCount(), layout.PieceLength, layout.TotalLength)
+	for index := 0; index < layout.PieceCount(); index++ {
+		end := min((index+1)*layout.PieceLength, len(content))
+		hash := sha1.Sum(content[index*layout.PieceLength : end])
+		pm.AddPiece(index, hash[:])
+	}
+	pm.SetStorage(storage.NewMemoryStorage(layout))
+	pm.SetLayout(layout)
+	pm.Start(ctx, 2, nil)
+
+	return pm
+}
+
+// checkPieces checks that every piece reads back as the content
+func checkPieces(t *testing.T, pm *types.PieceManager, content []byte, layout storage.Layout) {
+	t.Helper()
+
+	for index := 0; index < layout.PieceCount(); index++ {
+		data, err := pm.GetPieceData(index)
+		end := min((index+1)*layout.PieceLength, len(content))
+		if err != nil || !bytes.Equal(data, content[index*layout.PieceLength:end]) {
+			t.Errorf("expected piece %d to read back, got %v", index, err)
+		}
+	}
+}
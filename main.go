@@ -1,24 +1,41 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/ParamvirSran/GoTorrent/internal/dht"
+	"github.com/ParamvirSran/GoTorrent/internal/lsd"
+	"github.com/ParamvirSran/GoTorrent/internal/mse"
 	"github.com/ParamvirSran/GoTorrent/internal/peers"
+	"github.com/ParamvirSran/GoTorrent/internal/storage"
+	"github.com/ParamvirSran/GoTorrent/internal/stream"
 	"github.com/ParamvirSran/GoTorrent/internal/torrent"
 	"github.com/ParamvirSran/GoTorrent/internal/types"
+	"github.com/ParamvirSran/GoTorrent/internal/utp"
+	"github.com/ParamvirSran/GoTorrent/internal/webseed"
 )
 
 const (
-	defaultPort        = "6881"
-	startEvent         = "started"
-	maxConcurrentPeers = 10
+	defaultPort         = "6881"
+	startEvent          = "started"
+	maxConcurrentPeers  = 10
+	resumeInterval      = 30 * time.Second
+	dhtAnnounceInterval = 15 * time.Minute
 )
 
 var pieceSize int
@@ -33,27 +50,212 @@ func main() {
 	log.SetOutput(logFile)
 	log.Println("Starting")
 
-	torrentPath := parseArgs()
-	torrentFile, infohash, peerID, err := initializeTorrent(torrentPath)
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		os.Exit(runVerify(os.Args[2:]))
+	}
+
+	opts := parseArgs()
+	torrentFile, infohash, peerID, err := initializeTorrent(opts.torrentPath)
 	if err != nil {
 		fmt.Printf("Failed to initialize torrent: %v", err)
 		os.Exit(1)
 	}
 
-	peerIDList, peerAddressList, err := getPeers(torrentFile, infohash, peerID)
+	layout, err := torrent.StorageLayout(torrentFile.Info)
 	if err != nil {
-		fmt.Printf("Failed to get peers: %v", err)
+		fmt.Printf("Failed to lay out torrent files: %v", err)
 		os.Exit(1)
 	}
 
+	torrentFile.PieceManager.SetLayout(layout)
+
+	// Peers connect to us over TCP on the peer port, and over uTP on the same port number when enabled
+	tcpListener, err := net.Listen("tcp", ":"+defaultPort)
+	if err != nil {
+		log.Printf("Failed to listen for TCP peers, continuing with outgoing connections only: %v", err)
+	} else {
+		defer tcpListener.Close()
+	}
+
+	var utpSocket *utp.Socket
+	if opts.utp {
+		utpSocket, err = utp.Listen(":" + defaultPort)
+		if err != nil {
+			log.Printf("Failed to listen for uTP, continuing with TCP only: %v", err)
+		} else {
+			defer utpSocket.Close()
+		}
+	}
+
+	opts.restrictPrivate(torrentFile.Info)
+	swarm := peers.NewSwarm(torrentFile.PieceManager, infohash, peerID, opts.peerConfig)
+	swarm.SetMetadata(torrentFile.InfoBytes)
+	if utpSocket != nil {
+		swarm.SetUTP(utpSocket)
+	}
+
+	// Progress only survives a restart when the content is on disk
+	var resume *resumer
+	if opts.storageBackend != storage.BackendMemory {
+		resume = &resumer{
+			path:     torrent.ResumePath(opts.downloadDir, torrentFile.Info),
+			dir:      opts.downloadDir,
+			infohash: infohash,
+			layout:   layout,
+			pm:       torrentFile.PieceManager,
+			swarm:    swarm,
+		}
+		resume.loadPriorities()
+	}
+
+	// Priorities from the command line override the ones restored from the resume file
+	for file, priority := range opts.priorities {
+		if err := torrentFile.PieceManager.SetFilePriority(file, priority); err != nil {
+			fmt.Printf("Failed to set file priority: %v", err)
+			os.Exit(1)
+		}
+	}
+	torrentFile.PieceManager.SetSequential(opts.sequential)
+
+	// The storage is created once the priorities are known so skipped files are not created. Free space is
+	// checked before anything is created or the existing content is rechecked so a full disk fails fast
+	wanted := wantedFiles(torrentFile.PieceManager)
+	if opts.storageBackend != storage.BackendMemory {
+		if err := storage.CheckFreeSpace(opts.downloadDir, layout, wanted); err != nil {
+			fmt.Printf("Failed to start download: %v", err)
+			os.Exit(1)
+		}
+	}
+	torrentStorage, err := storage.New(opts.storageBackend, opts.downloadDir, layout, wanted)
+	if err != nil {
+		fmt.Printf("Failed to create storage: %v", err)
+		os.Exit(1)
+	}
+
+	// Memory mapped files already live in the page cache, so only the file backend gets a cache of its own
+	var cache *storage.Cache
+	if opts.storageBackend == storage.BackendFile && opts.cacheSize > 0 {
+		cache = storage.NewCache(opts.cacheSize << 20)
+		torrentStorage = storage.NewCachedStorage(torrentStorage, cache, layout, storage.DefaultWriteBuffer)
+	}
+	defer torrentStorage.Close()
+	torrentFile.PieceManager.SetStorage(torrentStorage)
+	if resume != nil {
+		resume.load()
+	}
+
+	if opts.storageBackend != storage.BackendMemory {
+		if err := storage.Preallocate(opts.downloadDir, layout, opts.prealloc, wanted); err != nil {
+			fmt.Printf("Failed to preallocate files: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	var dhtNode *dht.Node
+	if opts.dht {
+		dhtNode, err = dht.New(dht.Config{
+			Addr:           fmt.Sprintf(":%d", opts.dhtPort),
+			BootstrapNodes: splitList(opts.dhtBootstrap),
+			StatePath:      opts.dhtState,
+		})
+		if err != nil {
+			log.Printf("Failed to start DHT, continuing with trackers only: %v", err)
+		}
+	}
+
+	var localDiscovery *lsd.Service
+	if opts.lsd {
+		port, _ := strconv.Atoi(defaultPort)
+		localDiscovery, err = lsd.New(port)
+		if err != nil {
+			log.Printf("Failed to start local service discovery: %v", err)
+		} else {
+			localDiscovery.Add(infohash, swarm.AddPeer)
+		}
+	}
+
+	var webSeeds []webseed.Downloader
+	if opts.webSeeds {
+		for _, address := range torrentFile.URLList {
+			seed, err := webseed.New(address, torrentFile.Info, torrentFile.PieceManager)
+			if err != nil {
+				log.Printf("Skipping web seed: %v", err)
+				continue
+			}
+			webSeeds = append(webSeeds, seed)
+		}
+		for _, address := range torrentFile.HTTPSeeds {
+			seed, err := webseed.NewHashSeed(address, infohash, torrentFile.PieceManager)
+			if err != nil {
+				log.Printf("Skipping httpseed: %v", err)
+				continue
+			}
+			webSeeds = append(webSeeds, seed)
+		}
+	}
+
+	downloaded, uploaded := swarm.TransferTotals()
+	peerIDList, peerAddressList, err := getPeers(torrentFile, infohash, peerID, uploaded, downloaded)
+	if err != nil {
+		if dhtNode == nil && localDiscovery == nil && len(webSeeds) == 0 {
+			fmt.Printf("Failed to get peers: %v", err)
+			os.Exit(1)
+		}
+		log.Printf("Failed to get peers from trackers, relying on the DHT, local network and web seeds: %v", err)
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	go peerManager(torrentFile, ctx, peerIDList, peerAddressList, infohash, peerID)
-	go monitorDownloadCompletion(ctx, cancel, torrentFile)
+	if dhtNode != nil {
+		go dhtNode.Run(ctx)
+		go runDHT(ctx, dhtNode, swarm, infohash)
+	}
+	if localDiscovery != nil {
+		go localDiscovery.Run(ctx)
+	}
+	if tcpListener != nil {
+		go acceptPeers(ctx, tcpListener, swarm)
+	}
+	if utpSocket != nil {
+		go acceptPeers(ctx, utpSocket, swarm)
+	}
+
+	torrentFile.PieceManager.Start(ctx, runtime.NumCPU(), swarm.PieceVerified)
+	go swarm.RunChoker(ctx)
+	go peerManager(swarm, ctx, peerIDList, peerAddressList)
+	for _, seed := range webSeeds {
+		go seed.Run(ctx, func(n int) { swarm.AddTransferTotals(int64(n), 0) })
+	}
+	if resume != nil {
+		go resume.run(ctx)
+	}
+	if cache != nil {
+		go logCacheStats(ctx, cache)
+	}
+
+	// While streaming we keep running after the download completes so the files can still be watched, and a
+	// superseeding seed starts out complete so it keeps running to serve its peers
+	if opts.streamAddr != "" {
+		server := stream.NewServer(torrentFile.PieceManager, layout, opts.readahead)
+		go func() {
+			if err := server.ListenAndServe(ctx, opts.streamAddr); err != nil {
+				log.Printf("Failed to stream: %v", err)
+			}
+		}()
+	}
+	if opts.streamAddr != "" || opts.peerConfig.SuperSeed {
+		go monitorDownloadCompletion(ctx, nil, torrentFile)
+	} else {
+		go monitorDownloadCompletion(ctx, cancel, torrentFile)
+	}
 
 	<-ctx.Done()
 	log.Printf("Exiting. Context error: %v", ctx.Err())
+	torrentFile.PieceManager.Wait()
+	if resume != nil {
+		resume.save()
+	}
 }
 
 func setupLogging() (*os.File, error) {
@@ -67,12 +269,203 @@ func setupLogging() (*os.File, error) {
 	return logFile, nil
 }
 
-func parseArgs() string {
-	if len(os.Args) < 2 {
-		fmt.Printf("Usage: %s <torrent-file>\n", os.Args[0])
+// options holds the command line configuration
+type options struct {
+	torrentPath    string
+	downloadDir    string
+	storageBackend string
+	peerConfig     peers.Config
+	priorities     filePriorities
+	sequential     bool
+	streamAddr     string
+	readahead      int
+	prealloc       string
+	cacheSize      int64
+	utp            bool
+	lsd            bool
+	dht            bool
+	dhtPort        int
+	dhtBootstrap   string
+	dhtState       string
+	webSeeds       bool
+}
+
+// restrictPrivate turns off every peer source but the trackers for a private torrent (BEP 27)
+func (opts *options) restrictPrivate(info *types.InfoDictionary) {
+	if !info.IsPrivate() {
+		return
+	}
+
+	opts.peerConfig.PeerExchange = false
+	opts.dht = false
+	opts.lsd = false
+}
+
+// filePriorities is a repeatable flag of file indexes and the priority they are downloaded with, e.g. 0,2=skip
+type filePriorities map[int]types.Priority
+
+func (fp filePriorities) String() string {
+	return fmt.Sprint(map[int]types.Priority(fp))
+}
+
+func (fp filePriorities) Set(value string) error {
+	indexes, name, found := strings.Cut(value, "=")
+	if !found {
+		return fmt.Errorf("expected <file index>[,<file index>...]=<priority>, got %q", value)
+	}
+
+	priority, err := types.ParsePriority(name)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range strings.Split(indexes, ",") {
+		file, err := strconv.Atoi(index)
+		if err != nil || file < 0 {
+			return fmt.Errorf("invalid file index %q", index)
+		}
+		fp[file] = priority
+	}
+
+	return nil
+}
+
+func parseArgs() options {
+	opts := options{peerConfig: peers.DefaultConfig(), priorities: make(filePriorities)}
+
+	flag.Usage = func() {
+		fmt.Printf("Usage: %s [flags] <torrent-file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.StringVar(&opts.downloadDir, "dir", ".", "directory the torrent content is downloaded into")
+	flag.StringVar(&opts.storageBackend, "storage", storage.BackendFile, "storage backend for the torrent content: file, memory or mmap")
+	flag.IntVar(&opts.peerConfig.UploadSlots, "upload-slots", peers.DefaultUploadSlots, "number of peers unchoked for their rate, not counting the optimistic unchoke")
+	flag.DurationVar(&opts.peerConfig.SnubTimeout, "snub-timeout", peers.DefaultSnubTimeout, "time an unchoking peer may go without sending a requested block before it is snubbed")
+	flag.DurationVar(&opts.peerConfig.UselessPeerTimeout, "useless-peer-timeout", peers.DefaultUselessPeerTimeout, "time a snubbed or uninterested peer is kept before it is disconnected")
+	flag.Var(opts.priorities, "priority", "priority of files by their index in the torrent as <index>[,<index>...]=skip|low|normal|high, can be repeated")
+	flag.StringVar(&opts.prealloc, "prealloc", storage.PreallocNone, "how files are created: none (as pieces arrive), sparse (full size without allocating space) or full (space allocated up front)")
+	flag.Int64Var(&opts.cacheSize, "cache-size", storage.DefaultCacheSize>>20, "MiB of memory for caching blocks read from disk with the file backend, 0 disables the cache and write coalescing")
+	flag.BoolVar(&opts.sequential, "sequential", false, "download pieces in order instead of by priority, e.g. to play media while it downloads")
+	flag.StringVar(&opts.streamAddr, "stream-addr", "", "address to serve the torrent files over HTTP while they download, e.g. localhost:8080, disabled when empty")
+	flag.IntVar(&opts.readahead, "readahead", stream.DefaultReadahead, "number of pieces requested ahead of every streaming reader")
+	flag.BoolVar(&opts.peerConfig.PeerExchange, "pex", true, "exchange peer lists with connected peers (ut_pex), never used for private torrents")
+	flag.BoolVar(&opts.peerConfig.SuperSeed, "superseed", false, "when seeding every piece, reveal pieces to each peer one at a time and only reveal more once other peers have them (BEP 16)")
+	flag.StringVar(&opts.peerConfig.Encryption, "encryption", mse.PolicyPrefer, "peer connection encryption (MSE): disabled, prefer (plaintext when a peer does not support it) or require")
+	flag.BoolVar(&opts.utp, "utp", true, "connect to peers over uTP before trying TCP and accept uTP connections on the peer port")
+	flag.BoolVar(&opts.webSeeds, "webseeds", true, "download from the web seeds (url-list) and httpseeds of the torrent as well as from peers")
+	flag.BoolVar(&opts.lsd, "lsd", true, "find peers on the local network with multicast announces, never used for private torrents")
+	flag.BoolVar(&opts.dht, "dht", true, "find peers through the mainline DHT, never used for private torrents")
+	flag.IntVar(&opts.dhtPort, "dht-port", dht.DefaultPort, "UDP port the DHT node listens on")
+	flag.StringVar(&opts.dhtBootstrap, "dht-bootstrap", strings.Join(dht.DefaultBootstrapNodes, ","), "comma separated host:port of nodes used to join the DHT")
+	flag.StringVar(&opts.dhtState, "dht-state", "dht.dat", "file the DHT node id and routing table are kept in between runs, nothing is kept when empty")
+	flag.Parse()
+
+	if _, err := mse.Methods(opts.peerConfig.Encryption); err != nil {
+		fmt.Println(err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	if flag.NArg() < 1 || opts.dhtPort < 0 || opts.dhtPort > 65535 || opts.readahead < 1 || opts.cacheSize < 0 || opts.peerConfig.UploadSlots < 0 || opts.peerConfig.SnubTimeout <= 0 || opts.peerConfig.UselessPeerTimeout <= 0 {
+		flag.Usage()
 		os.Exit(1)
 	}
-	return os.Args[1]
+	opts.torrentPath = flag.Arg(0)
+
+	return opts
+}
+
+// wantedFiles returns which files of the torrent are downloaded, every file that is not skipped
+func wantedFiles(pm *types.PieceManager) []bool {
+	priorities := pm.FilePriorities()
+	wanted := make([]bool, len(priorities))
+	for i, priority := range priorities {
+		wanted[i] = priority != types.PrioritySkip
+	}
+
+	return wanted
+}
+
+// runVerify rechecks the content of a torrent already in the download directory and saves the verified pieces
+// to its resume file, it returns the exit code
+func runVerify(args []string) int {
+	verifyFlags := flag.NewFlagSet("verify", flag.ExitOnError)
+	downloadDir := verifyFlags.String("dir", ".", "directory the torrent content was downloaded into")
+	storageBackend := verifyFlags.String("storage", storage.BackendFile, "storage backend for the torrent content: file or mmap")
+	verifyFlags.Usage = func() {
+		fmt.Printf("Usage: %s verify [flags] <torrent-file>\n", os.Args[0])
+		verifyFlags.PrintDefaults()
+	}
+	verifyFlags.Parse(args)
+
+	if verifyFlags.NArg() < 1 || *storageBackend == storage.BackendMemory {
+		verifyFlags.Usage()
+		return 1
+	}
+
+	torrentFile, infohash, _, err := initializeTorrent(verifyFlags.Arg(0))
+	if err != nil {
+		fmt.Printf("Failed to initialize torrent: %v\n", err)
+		return 1
+	}
+
+	layout, err := torrent.StorageLayout(torrentFile.Info)
+	if err != nil {
+		fmt.Printf("Failed to lay out torrent files: %v\n", err)
+		return 1
+	}
+
+	// File priorities of earlier runs are kept, skipped files were never created
+	torrentFile.PieceManager.SetLayout(layout)
+	previous, err := torrent.LoadResumeData(torrent.ResumePath(*downloadDir, torrentFile.Info))
+	if err != nil || !bytes.Equal(previous.InfoHash, infohash) {
+		previous = nil
+	} else if err := previous.RestorePriorities(torrentFile.PieceManager); err != nil {
+		log.Printf("Ignoring saved file priorities: %v", err)
+	}
+
+	torrentStorage, err := storage.New(*storageBackend, *downloadDir, layout, wantedFiles(torrentFile.PieceManager))
+	if err != nil {
+		fmt.Printf("Failed to create storage: %v\n", err)
+		return 1
+	}
+	defer torrentStorage.Close()
+	torrentFile.PieceManager.SetStorage(torrentStorage)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	report, err := torrent.Verify(ctx, torrentFile.PieceManager, layout, *downloadDir, func(checked, total int) {
+		fmt.Printf("\rChecked %d/%d pieces", checked, total)
+	})
+	fmt.Println()
+	if err != nil {
+		fmt.Printf("Verification stopped: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("%d of %d pieces verified\n", report.VerifiedCount, torrentFile.PieceManager.PieceCount)
+	for _, file := range report.MissingFiles {
+		fmt.Printf("Missing: %s\n", file)
+	}
+	for _, file := range report.CorruptFiles {
+		fmt.Printf("Corrupt: %s\n", file)
+	}
+
+	// Transfer totals of earlier runs are kept
+	var uploaded, downloaded int64
+	if previous != nil {
+		uploaded, downloaded = previous.Uploaded, previous.Downloaded
+	}
+	resumeData := torrent.NewResumeData(infohash, torrentFile.PieceManager, uploaded, downloaded, *downloadDir, layout)
+	if err := torrent.SaveResumeData(torrent.ResumePath(*downloadDir, torrentFile.Info), resumeData); err != nil {
+		fmt.Printf("Failed to save resume data: %v\n", err)
+		return 1
+	}
+
+	if len(report.FailedPieces) > 0 {
+		return 2
+	}
+	return 0
 }
 
 func initializeTorrent(torrentPath string) (*types.Torrent, []byte, []byte, error) {
@@ -82,7 +475,7 @@ func initializeTorrent(torrentPath string) (*types.Torrent, []byte, []byte, erro
 	}
 	pieceSize = torrentFile.Info.PieceLength
 
-	infohash, err := torrent.GetInfohash(torrentFile.Info)
+	infohash, err := torrent.GetInfohash(torrentFile)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("error getting infohash: %w", err)
 	}
@@ -95,17 +488,16 @@ func initializeTorrent(torrentPath string) (*types.Torrent, []byte, []byte, erro
 	return torrentFile, infohash, []byte(peerID), nil
 }
 
-func getPeers(torrentFile *types.Torrent, infoHash, peerID []byte) ([]string, []string, error) {
+func getPeers(torrentFile *types.Torrent, infoHash, peerID []byte, uploaded, downloaded int64) ([]string, []string, error) {
 	trackerList := torrent.GatherTrackers(torrentFile)
 	if len(trackerList) == 0 {
 		return nil, nil, fmt.Errorf("no valid trackers found")
 	}
 
-	left := torrentFile.Info.PieceLength * (len(torrentFile.Info.Pieces) / 20)
-	log.Printf("Torrent Stats - Piece Count: %d - Piece Size: %d - Left to Download: %d", len(torrentFile.Info.Pieces)/20, torrentFile.Info.PieceLength, left)
+	left := torrentFile.PieceManager.BytesLeft()
+	log.Printf("Torrent Stats - Piece Count: %d - Piece Size: %d - Total Length: %d - Left to Download: %d", torrentFile.PieceManager.PieceCount, torrentFile.Info.PieceLength, torrentFile.Info.TotalLength(), left)
 
-	uploaded, downloaded := 0, 0
-	peerIDList, peerAddressList, err := torrent.ContactTrackers(trackerList, string(infoHash), string(peerID), startEvent, uploaded, downloaded, left, defaultPort)
+	peerIDList, peerAddressList, err := torrent.ContactTrackers(trackerList, string(infoHash), string(peerID), startEvent, int(uploaded), int(downloaded), int(left), defaultPort)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error contacting trackers: %w", err)
 	}
@@ -117,35 +509,136 @@ func getPeers(torrentFile *types.Torrent, infoHash, peerID []byte) ([]string, []
 	return peerIDList, peerAddressList, nil
 }
 
-func peerManager(torrentFile *types.Torrent, ctx context.Context, peerIDList, peerAddressList []string, infohash, clientID []byte) {
+// peerManager connects to the peers from the trackers and then to the peers other sources add to the swarm
+// until the context is done, an address is not dialed again while a connection to it is open
+func peerManager(swarm *peers.Swarm, ctx context.Context, peerIDList, peerAddressList []string) {
 	var wg sync.WaitGroup
 	sem := make(chan struct{}, maxConcurrentPeers)
-	pm := torrentFile.PieceManager
+
+	var mu sync.Mutex
+	connected := make(map[string]bool)
+
+	connect := func(peerID, peerAddress string) bool {
+		mu.Lock()
+		if connected[peerAddress] {
+			mu.Unlock()
+			return true
+		}
+		connected[peerAddress] = true
+		mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer func() {
+				mu.Lock()
+				delete(connected, peerAddress)
+				mu.Unlock()
+			}()
+
+			if err := swarm.HandlePeerConnection(ctx, peerID, peerAddress); err != nil {
+				log.Printf("Failed with Peer: %s - %v", peerAddress, err)
+			} else {
+				log.Printf("Done with Peer: %s", peerAddress)
+			}
+		}()
+
+		return true
+	}
 
 	for i := range peerAddressList {
+		if !connect(peerIDList[i], peerAddressList[i]) {
+			break
+		}
+	}
+
+loop:
+	for {
 		select {
 		case <-ctx.Done():
-			log.Println("Context canceled, stopping peer connections.")
-			return
-		default:
-			sem <- struct{}{}
-			wg.Add(1)
-			go func(peerID, peerAddress string) {
-				defer wg.Done()
-				defer func() { <-sem }()
-
-				if err := peers.HandlePeerConnection(pm, ctx, peerID, infohash, clientID, peerAddress); err != nil {
-					log.Printf("Failed with Peer: %s - %v", peerAddress, err)
-				} else {
-					log.Printf("Done with Peer: %s", peerAddress)
-				}
-			}(peerIDList[i], peerAddressList[i])
+			break loop
+		case peerAddress := <-swarm.DiscoveredPeers():
+			if !connect("", peerAddress) {
+				break loop
+			}
 		}
 	}
+
+	log.Println("Context canceled, stopping peer connections.")
 	wg.Wait()
 	log.Println("All peer connections finished. Peer manager finished")
 }
 
+// acceptPeers hands the connections peers open to us to the swarm until the context is done
+func acceptPeers(ctx context.Context, listener net.Listener, swarm *peers.Swarm) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Stopped accepting peers: %v", err)
+			}
+			return
+		}
+
+		go func() {
+			if err := swarm.HandleIncomingConnection(ctx, conn); err != nil {
+				log.Printf("Failed with incoming Peer: %s - %v", conn.RemoteAddr(), err)
+			} else {
+				log.Printf("Done with incoming Peer: %s", conn.RemoteAddr())
+			}
+		}()
+	}
+}
+
+// runDHT announces the torrent to the DHT right away and then periodically, the peers found are added to the swarm
+func runDHT(ctx context.Context, node *dht.Node, swarm *peers.Swarm, infohash []byte) {
+	port, _ := strconv.Atoi(defaultPort)
+	ticker := time.NewTicker(dhtAnnounceInterval)
+	defer ticker.Stop()
+
+	for {
+		found, err := node.Announce(ctx, infohash, port)
+		if err != nil {
+			log.Printf("Failed to announce to the DHT: %v", err)
+		}
+		for _, peerAddress := range found {
+			swarm.AddPeer(peerAddress)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// splitList splits a comma separated flag value, empty entries are dropped
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+
+	return list
+}
+
+// monitorDownloadCompletion checks the download progress every minute, the context is canceled once it is
+// complete unless cancel is nil
 func monitorDownloadCompletion(ctx context.Context, cancel context.CancelFunc, torrentFile *types.Torrent) {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
@@ -155,7 +648,9 @@ func monitorDownloadCompletion(ctx context.Context, cancel context.CancelFunc, t
 		case <-ticker.C:
 			if torrentFile.PieceManager.IsDownloadComplete() {
 				log.Println("Torrent download complete.")
-				cancel()
+				if cancel != nil {
+					cancel()
+				}
 				return
 			}
 		case <-ctx.Done():
@@ -163,3 +658,113 @@ func monitorDownloadCompletion(ctx context.Context, cancel context.CancelFunc, t
 		}
 	}
 }
+
+// logCacheStats logs the counters of the storage cache every minute
+func logCacheStats(ctx context.Context, cache *storage.Cache) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			stats := cache.Stats()
+			log.Printf("Cache Stats - Hit Rate: %.1f%% - Hits: %d - Misses: %d - Evictions: %d - Size: %d/%d - Blocks Written: %d - Disk Writes: %d",
+				100*stats.HitRate(), stats.Hits, stats.Misses, stats.Evictions, stats.Size, stats.Budget, stats.BlocksWritten, stats.Flushes)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resumer saves and restores the download progress of a torrent
+type resumer struct {
+	path     string
+	dir      string
+	infohash []byte
+	layout   storage.Layout
+	pm       *types.PieceManager
+	swarm    *peers.Swarm
+
+	data    *torrent.ResumeData // Loaded by loadPriorities, nil when there is no usable resume file
+	loadErr error
+}
+
+// loadPriorities reads the resume file and restores the file priorities saved in it, which decide the files the
+// storage creates
+func (r *resumer) loadPriorities() {
+	r.data, r.loadErr = torrent.LoadResumeData(r.path)
+	if r.loadErr != nil {
+		return
+	}
+
+	if err := r.data.RestorePriorities(r.pm); err != nil {
+		log.Printf("Ignoring saved file priorities: %v", err)
+	}
+}
+
+// load restores the progress from the resume file when it passes the sanity check, otherwise any content already
+// in the download directory is rechecked. It needs the storage of the piece manager
+func (r *resumer) load() {
+	if r.loadErr != nil {
+		if !errors.Is(r.loadErr, os.ErrNotExist) {
+			log.Printf("Ignoring resume data: %v", r.loadErr)
+		}
+		r.recheck()
+		return
+	}
+
+	if err := r.data.Check(r.infohash, r.dir, r.layout); err != nil {
+		log.Printf("Ignoring resume data: %v", err)
+		r.recheck()
+		return
+	}
+
+	r.pm.RestoreState(r.data.Pieces, r.data.PartialPieces)
+	r.swarm.AddTransferTotals(r.data.Downloaded, r.data.Uploaded)
+}
+
+// recheck verifies the content in the download directory when there is any, so a missing or stale resume file
+// does not mean downloading everything again
+func (r *resumer) recheck() {
+	hasContent := false
+	for _, file := range r.layout.Files {
+		if stat, err := os.Stat(filepath.Join(r.dir, file.RelativePath())); err == nil && stat.Size() > 0 {
+			hasContent = true
+			break
+		}
+	}
+	if !hasContent {
+		return
+	}
+
+	report, err := torrent.Verify(context.Background(), r.pm, r.layout, r.dir, nil)
+	if err != nil {
+		log.Printf("Failed to recheck existing content: %v", err)
+		return
+	}
+	log.Printf("Rechecked existing content - Verified: %d - Failed: %d - Missing files: %d - Corrupt files: %d", report.VerifiedCount, len(report.FailedPieces), len(report.MissingFiles), len(report.CorruptFiles))
+}
+
+// save writes the current progress to the resume file
+func (r *resumer) save() {
+	downloaded, uploaded := r.swarm.TransferTotals()
+	resumeData := torrent.NewResumeData(r.infohash, r.pm, uploaded, downloaded, r.dir, r.layout)
+	if err := torrent.SaveResumeData(r.path, resumeData); err != nil {
+		log.Printf("Failed to save resume data: %v", err)
+	}
+}
+
+// run saves the progress periodically until the context is done
+func (r *resumer) run(ctx context.Context) {
+	ticker := time.NewTicker(resumeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.save()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
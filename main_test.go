@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ParamvirSran/GoTorrent/internal/peers"
+	"github.com/ParamvirSran/GoTorrent/internal/types"
+)
+
+func TestRestrictPrivate(t *testing.T) {
+	private, public := 1, 0
+	tests := []struct {
+		name    string
+		private *int
+		enabled bool
+	}{
+		{"private torrent", &private, false},
+		{"private flag zero", &public, true},
+		{"no private flag", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := options{peerConfig: peers.DefaultConfig(), dht: true, lsd: true}
+			opts.restrictPrivate(&types.InfoDictionary{Private: test.private})
+
+			if opts.peerConfig.PeerExchange != test.enabled {
+				t.Errorf("expected peer exchange %t, got %t", test.enabled, opts.peerConfig.PeerExchange)
+			}
+			if opts.dht != test.enabled {
+				t.Errorf("expected DHT %t, got %t", test.enabled, opts.dht)
+			}
+			if opts.lsd != test.enabled {
+				t.Errorf("expected local service discovery %t, got %t", test.enabled, opts.lsd)
+			}
+		})
+	}
+}